@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
+
+	"github.com/golang/glog"
+)
+
+////
+//// Admin HTTP endpoints: "/loglevel" (see logging.LevelHandler)
+////
+//// XXX - Notes:
+//// - Not authenticated: Listens on "admin-address" only, by default on localhost (e.g. "kubectl exec" / "kubectl port-forward" into the agent pod). Empty disables them
+//// - Served by all the agents, incl. the standby ones waiting for the leader lock
+//// - A separate HTTP mux: Nothing registered on the default one (e.g. by vendored packages) is exposed
+//// - "admin-address" changes need a restart (not a "liveSettings" one)
+
+// Serve the admin HTTP endpoints on the given address. Returns on errors only, e.g. the address is in use
+func adminServer(addr string) {
+	if addr == "" {
+		glog.Infof("No admin address configured. Admin HTTP endpoints (\"/loglevel\") disabled")
+		return
+	}
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			glog.Warningf("Admin HTTP endpoints (\"/loglevel\") are not authenticated and reachable from other hosts on: %s", addr)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loglevel", logging.LevelHandler)
+
+	glog.Infof("Serving the admin HTTP endpoints on: %s", addr)
+	glog.Errorf("Admin HTTP endpoints error: %s", http.ListenAndServe(addr, mux))
+}
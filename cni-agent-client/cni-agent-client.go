@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
 
 	"github.com/golang/glog"
 
@@ -14,28 +15,56 @@ import (
 )
 
 var (
-	AgentClient     *http.Client
-	AgentServerPort string
+	// The CNI Agent server client and port. Replaced together when the configuration is reloaded: See "Agent" / "SetAgent"
+	agentClient     *http.Client
+	agentServerPort string
+	agentMutex      sync.RWMutex
 )
 
 func InitClient(conf *config.AgentConfig) error {
+	client, err := NewAgentClient(conf)
+	if err != nil {
+		return err
+	}
 
 	// Pick up Agent server port from startup configuration
-	AgentServerPort = conf.CniConfig.ServerPort
+	SetAgent(client, conf.CniConfig.ServerPort)
+
+	return nil
+}
+
+// The current CNI Agent server client and port
+func Agent() (*http.Client, string) {
+	agentMutex.RLock()
+	defer agentMutex.RUnlock()
+
+	return agentClient, agentServerPort
+}
 
+// Switch to a new CNI Agent server client and port, e.g. on configuration reloads. Requests in flight complete with the previous client
+func SetAgent(client *http.Client, port string) {
+	agentMutex.Lock()
+	defer agentMutex.Unlock()
+
+	agentClient, agentServerPort = client, port
+}
+
+// A CNI Agent server client for the given configuration. Used at startup and when reloading the configuration (e.g. rotated CA file)
+func NewAgentClient(conf *config.AgentConfig) (*http.Client, error) {
 	certPool := x509.NewCertPool()
 
 	if pemData, err := ioutil.ReadFile(conf.CniConfig.CaFile); err != nil {
 		err = fmt.Errorf("Error loading CNI agent server CA certificate data from: %s. Error: %s", conf.CniConfig.CaFile, err)
 		glog.Error(err)
-		return err
-	} else {
-		certPool.AppendCertsFromPEM(pemData)
+		return nil, err
+	} else if !certPool.AppendCertsFromPEM(pemData) {
+		err = fmt.Errorf("No valid CNI agent server CA certificate found in: %s", conf.CniConfig.CaFile)
+		glog.Error(err)
+		return nil, err
 	}
 
 	// configure a TLS client to use those certificates
-	AgentClient = new(http.Client)
-	*AgentClient = http.Client{
+	return &http.Client{
 		Transport: &http.Transport{
 			MaxIdleConns:    agenttypes.MAX_CONNS,
 			IdleConnTimeout: agenttypes.MAX_IDLE,
@@ -44,7 +73,5 @@ func InitClient(conf *config.AgentConfig) error {
 				// InsecureSkipVerify: true, // In case we want to skip server verification
 			},
 		},
-	}
-
-	return nil
+	}, nil
 }
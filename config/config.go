@@ -7,6 +7,10 @@ import (
 	"log"
 	"os"
 	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
@@ -15,27 +19,128 @@ import (
 type AgentConfig struct {
 
 	// Not supplied in YAML config file
-	EtcdServerUrl string `yaml:"-"` // May also be specified by EtcdClientInfo below. Overriden by the latter if valid.
-	ConfigFile    string `yaml:"-"`
+	EtcdServerUrl string       `yaml:"-" env:"NUAGE_ETCD_SERVER_URL"` // May also be specified by EtcdClientInfo below. Overriden by the latter if valid.
+	ConfigFile    string       `yaml:"-" env:"NUAGE_CONFIG_FILE"`
+	Audit         bool         `yaml:"-" env:"NUAGE_AUDIT"`           // Run a one-shot policy audit and exit
+	IPAMCheck     bool         `yaml:"-" env:"NUAGE_IPAM_CHECK"`      // Run a one-shot IPAM consistency check and exit
+	ValidateOnly  bool         `yaml:"-" env:"NUAGE_VALIDATE_CONFIG"` // Validate the configuration, print the problems found and exit
+	MasterConfig  MasterConfig `yaml:"-"`                             // Resolved from "k8s-master-config" or "k8s-master-configmap", then the NUAGE_* environment variables. See main: resolveMasterConfig
 	// Config file fields
-	KubeConfigFile   string    `yaml:"nuage-k8s-master-agent-kubeconfig"`
-	MasterConfigFile string    `yaml:"k8s-master-config"`
-	VsdConfig        vsdConfig `yaml:"vsd-config"`
-	CniConfig        cniConfig `yaml:"cni-config"`
+	KubeConfigFile   string        `yaml:"nuage-k8s-master-agent-kubeconfig" env:"NUAGE_KUBECONFIG"` // If empty, the in-cluster config (the service account of the agent pod)
+	MasterConfigFile string        `yaml:"k8s-master-config" env:"NUAGE_K8S_MASTER_CONFIG"`
+	MasterConfigMap  string        `yaml:"k8s-master-configmap" env:"NUAGE_K8S_MASTER_CONFIGMAP"` // "namespace/name" of a K8S ConfigMap with the network config, over the "k8s-master-config" one. See ApplyMasterConfigMap
+	ShutdownTimeout  time.Duration `yaml:"shutdown-timeout" env:"NUAGE_SHUTDOWN_TIMEOUT"`         // Time given to the in-flight K8S events on shutdown (SIGTERM / SIGINT). Keep it below the pod "terminationGracePeriodSeconds"
+	LogLevel         string        `yaml:"log-level" env:"NUAGE_LOG_LEVEL"`                       // Level of the K8S / VSD client logs: "debug", "info", "warning" or "error". Can be changed at runtime, see logging.LevelHandler
+	AdminAddress     string        `yaml:"admin-address" env:"NUAGE_ADMIN_ADDRESS"`               // "host:port" of the (unauthenticated) admin HTTP endpoints, e.g. "/loglevel". Empty disables them
+	VsdConfig        vsdConfig     `yaml:"vsd-config"`
+	CniConfig        cniConfig     `yaml:"cni-config"`
+	IpamConfig       ipamConfig    `yaml:"ipam-config"`
+	PolicyConfig     policyConfig  `yaml:"policy-config"`
+	NamingConfig     namingConfig  `yaml:"naming-config"`
 }
 
 type vsdConfig struct {
-	VsdUrl     string `yaml:"vsd-url"`
-	APIVersion string `yaml:"apiversion"`
-	Enterprise string `yaml:"enterprise"`
-	Domain     string `yaml:"domain"`
-	CertFile   string `yaml:"certFile"`
-	KeyFile    string `yaml:"keyFile"`
+	VsdUrl            string         `yaml:"vsd-url" env:"NUAGE_VSD_URL"`
+	APIVersion        string         `yaml:"apiversion" env:"NUAGE_VSD_API_VERSION"`
+	Enterprise        string         `yaml:"enterprise" env:"NUAGE_VSD_ENTERPRISE"`
+	Domain            string         `yaml:"domain" env:"NUAGE_VSD_DOMAIN"`
+	CertFile          string         `yaml:"certFile" env:"NUAGE_VSD_CERT_FILE"`
+	KeyFile           string         `yaml:"keyFile" env:"NUAGE_VSD_KEY_FILE"`
+	Username          string         `yaml:"username" env:"NUAGE_VSD_USERNAME"`               // User + password authentication, instead of the X509 certificate
+	UsernameFile      string         `yaml:"username-file" env:"NUAGE_VSD_USERNAME_FILE"`     // File with the username, e.g. a K8S Secret mount. Takes precedence over "username"
+	Password          string         `yaml:"password" env:"NUAGE_VSD_PASSWORD"`               // Password or API key of the user
+	PasswordFile      string         `yaml:"password-file" env:"NUAGE_VSD_PASSWORD_FILE"`     // File with the password or API key, e.g. a K8S Secret mount. Takes precedence over "password". Re-read when logging in again (rejected API key)
+	Organization      string         `yaml:"organization" env:"NUAGE_VSD_ORGANIZATION"`       // VSD Enterprise of the user. Default: "csp"
+	TenantsConfigFile string         `yaml:"tenants-config" env:"NUAGE_VSD_TENANTS_CONFIG"`   // Mapping of K8S namespaces to separate VSD Domains / Enterprises. If absent, all namespaces are in "Domain"
+	DomainTemplate    string         `yaml:"domain-template" env:"NUAGE_VSD_DOMAIN_TEMPLATE"` // Existing VSD Domain template (in the Enterprise) to instantiate missing Domains from. If absent, a new Domain template with default settings is created per Domain
+	DomainSettings    DomainSettings `yaml:"domain-settings"`                                 // Desired settings of the VSD Domains. Set on the Domains created by the agent, checked against existing ones
+}
+
+// VSD Domain settings, with the VSD values. Empty fields: As per the Domain template / VSD defaults, not checked
+type DomainSettings struct {
+	Underlay           string `yaml:"underlay" env:"NUAGE_VSD_DOMAIN_UNDERLAY"`                       // Underlay breakout: "ENABLED", "DISABLED" or "INHERITED"
+	PAT                string `yaml:"pat" env:"NUAGE_VSD_DOMAIN_PAT"`                                 // PAT to underlay: "ENABLED", "DISABLED" or "INHERITED"
+	DHCPBehavior       string `yaml:"dhcp-behavior" env:"NUAGE_VSD_DOMAIN_DHCP_BEHAVIOR"`             // "CONSUME", "FLOOD", "OVERLAY_RELAY" or "UNDERLAY_RESOLVE"
+	Encryption         string `yaml:"encryption" env:"NUAGE_VSD_DOMAIN_ENCRYPTION"`                   // "ENABLED" or "DISABLED"
+	RouteDistinguisher string `yaml:"route-distinguisher" env:"NUAGE_VSD_DOMAIN_ROUTE_DISTINGUISHER"` // E.g. "65000:100"
+	RouteTarget        string `yaml:"route-target" env:"NUAGE_VSD_DOMAIN_ROUTE_TARGET"`               // E.g. "65000:100"
 }
 
 type cniConfig struct {
-	ServerPort string `yaml:"server-port"` // CNI Agent server port
-	CaFile     string `yaml:"caFile"`      // CNI Agent server CA certificate
+	ServerPort string `yaml:"server-port" env:"NUAGE_CNI_SERVER_PORT"` // CNI Agent server port
+	CaFile     string `yaml:"caFile" env:"NUAGE_CNI_CA_FILE"`          // CNI Agent server CA certificate
+}
+
+type ipamConfig struct {
+	QuarantinePeriod time.Duration `yaml:"quarantine-period" env:"NUAGE_IPAM_QUARANTINE_PERIOD"` // Hold time for released pod IP addresses before they can be allocated again. Zero disables the quarantine
+	CheckInterval    time.Duration `yaml:"check-interval" env:"NUAGE_IPAM_CHECK_INTERVAL"`       // Interval for the periodic IPAM consistency check (K8S pods vs. VSD Container interfaces vs. subnet allocators). Zero disables the periodic check
+	CheckRepair      bool          `yaml:"check-repair" env:"NUAGE_IPAM_CHECK_REPAIR"`           // Whether the IPAM check repairs leaked IP addresses or only reports them
+}
+
+type policyConfig struct {
+	ServiceCrossNamespace bool          `yaml:"service-cross-namespace" env:"NUAGE_POLICY_SERVICE_CROSS_NAMESPACE"` // Default for whether K8S services may be reached from other namespaces. Per service override: "nuage.io/service-access" annotation
+	NamespaceIsolation    string        `yaml:"default-namespace-isolation" env:"NUAGE_POLICY_NAMESPACE_ISOLATION"` // Default isolation mode for K8S namespaces: "open", "isolated" or "deny". Per namespace override: "net.beta.kubernetes.io/network-policy" annotation
+	AuthzConfigFile       string        `yaml:"authorization-config" env:"NUAGE_POLICY_AUTHORIZATION_CONFIG"`       // Service account based authorization rules for custom network settings and Nuage policies. If absent, everything is allowed
+	AuditInterval         time.Duration `yaml:"audit-interval" env:"NUAGE_POLICY_AUDIT_INTERVAL"`                   // Interval for the periodic audit of the VSD Policy Elements against the K8S state. Zero disables the periodic audit
+	AuditCorrect          bool          `yaml:"audit-correct" env:"NUAGE_POLICY_AUDIT_CORRECT"`                     // Whether the audit corrects drift (missing, extra or modified Policy Elements) or only reports it
+}
+
+// Names and ownership of the VSD objects. Name templates are Go text/template, see vsd-client/naming.go for the fields and defaults
+type namingConfig struct {
+	ClusterID        string `yaml:"cluster-id" env:"NUAGE_NAMING_CLUSTER_ID"`               // ID of the K8S cluster, in the ownership metadata (externalID) of the VSD objects and the {{.Cluster}} template field. Defaults to the VSD Domain name
+	StrictOwnership  bool   `yaml:"strict-ownership" env:"NUAGE_NAMING_STRICT_OWNERSHIP"`   // Only modify VSD objects with this cluster's externalID. If false, VSD objects without an externalID (e.g. created by earlier versions) are adopted
+	SharedEnterprise bool   `yaml:"shared-enterprise" env:"NUAGE_NAMING_SHARED_ENTERPRISE"` // Other K8S clusters share the VSD Enterprise: The name templates of the Enterprise level objects (Network Macros / Groups) must include {{.Cluster}}
+	Zone             string `yaml:"zone" env:"NUAGE_NAMING_ZONE"`                           // VSD Zone of a K8S namespace
+	ServicesNMG      string `yaml:"services-nmg" env:"NUAGE_NAMING_SERVICES_NMG"`           // Network Macro Group of the K8S services in a namespace
+	ServiceNM        string `yaml:"service-nm" env:"NUAGE_NAMING_SERVICE_NM"`               // Network Macro of a K8S service ClusterIP
+	EndpointsNMG     string `yaml:"endpoints-nmg" env:"NUAGE_NAMING_ENDPOINTS_NMG"`         // Network Macro Group of the endpoints of a K8S service
+	EndpointNM       string `yaml:"endpoint-nm" env:"NUAGE_NAMING_ENDPOINT_NM"`             // Network Macro of an endpoint IP address
+	NuagePolicy      string `yaml:"nuage-policy" env:"NUAGE_NAMING_NUAGE_POLICY"`           // VSD Policy of a NuageNetworkPolicy resource
+	ExternalNMG      string `yaml:"external-nmg" env:"NUAGE_NAMING_EXTERNAL_NMG"`           // Network Macro Group of the external networks declared in a ConfigMap
+	ExternalNM       string `yaml:"external-nm" env:"NUAGE_NAMING_EXTERNAL_NM"`             // Network Macro of an external network declared in a ConfigMap
+}
+
+////////
+//////// Service account based authorization file
+////////
+
+//// XXX - Notes:
+//// - An action is allowed if any of the rules matching the namespace and service account allows it. If no rule matches, the action is denied
+//// - "*" matches any namespace / service account / subnet / Policy Group
+//// - Nuage policies are allowed per namespace: Rules with "policies" must apply to all the service accounts ("*"). Restrict who may create NuageNetworkPolicy resources with K8S RBAC
+//// - Nuage policies apply to their own namespace, and to the namespaces listed in "policy-namespaces" of the rules allowing them ("*" for all the namespaces)
+
+type AuthzConfig struct {
+	Rules []AuthzRule `yaml:"rules"`
+}
+
+type AuthzRule struct {
+	Namespace        string   `yaml:"namespace"`         // K8S namespace the rule applies to. Empty or "*" for all namespaces (cluster wide)
+	ServiceAccounts  []string `yaml:"service-accounts"`  // Service account names (in "Namespace") the rule applies to
+	Subnets          []string `yaml:"subnets"`           // Custom subnets the service accounts may use ("nuage.io/Subnet" pod label)
+	IPRanges         []string `yaml:"ip-ranges"`         // CIDRs for the custom IP addresses the service accounts may use ("nuage.io/IPAddress" pod label)
+	PolicyGroups     []string `yaml:"policy-groups"`     // Policy Groups the service accounts may use ("nuage.io/PolicyGroup" pod label)
+	Policies         bool     `yaml:"policies"`          // If Nuage policies (NuageNetworkPolicy resources) are allowed in "Namespace"
+	PolicyNamespaces []string `yaml:"policy-namespaces"` // Other namespaces the Nuage policies in "Namespace" may apply to (their Zones / Subnets as traffic destination or source). By default, a Nuage policy applies to its own namespace only
+}
+
+////////
+//////// Tenants mapping file: K8S namespaces in separate VSD Domains / Enterprises
+////////
+
+//// XXX - Notes:
+//// - Namespaces not listed in the mapping file are in the Enterprise / Domain of the agent configuration
+//// - A namespace may be listed for one tenant only
+
+type TenantsConfig struct {
+	Tenants []TenantConfig `yaml:"tenants"`
+}
+
+type TenantConfig struct {
+	Enterprise     string   `yaml:"enterprise"`      // VSD Enterprise of the tenant. If empty, the Enterprise of the agent configuration
+	Domain         string   `yaml:"domain"`          // VSD Domain of the tenant. Created -- with the Domain settings of the agent configuration -- if it does not exist
+	DomainTemplate string   `yaml:"domain-template"` // Existing VSD Domain template (in the tenant Enterprise) to instantiate the Domain from. If empty, the Domain template of the agent configuration
+	Namespaces     []string `yaml:"namespaces"`      // K8S namespaces of the tenant
 }
 
 ////////
@@ -48,17 +153,17 @@ type MasterConfig struct {
 }
 
 type networkConfig struct {
-	ClusterCIDR  string `yaml:"clusterNetworkCIDR"`
-	SubnetLength int    `yaml:"hostSubnetLength"`
-	ServiceCIDR  string `yaml:"serviceNetworkCIDR"`
+	ClusterCIDR  string `yaml:"clusterNetworkCIDR" env:"NUAGE_CLUSTER_CIDR"`
+	SubnetLength int    `yaml:"hostSubnetLength" env:"NUAGE_HOST_SUBNET_LENGTH"`
+	ServiceCIDR  string `yaml:"serviceNetworkCIDR" env:"NUAGE_SERVICE_CIDR"`
 }
 
 // follow K8S master denomination instead of naming consistency
 type etcdClientInfo struct {
-	EtcdCA         string   `yaml:"ca"`
-	EtcdCertFile   string   `yaml:"certFile"`
-	EtcdKeyFile    string   `yaml:"keyFile"`
-	EtcdServerUrls []string `yaml:"urls"`
+	EtcdCA         string   `yaml:"ca" env:"NUAGE_ETCD_CA"`
+	EtcdCertFile   string   `yaml:"certFile" env:"NUAGE_ETCD_CERT_FILE"`
+	EtcdKeyFile    string   `yaml:"keyFile" env:"NUAGE_ETCD_KEY_FILE"`
+	EtcdServerUrls []string `yaml:"urls" env:"NUAGE_ETCD_URLS"`
 }
 
 ////////
@@ -74,15 +179,49 @@ func Flags(conf *AgentConfig, flagSet *flag.FlagSet) {
 	flagSet.StringVar(&conf.EtcdServerUrl, "etcd-server",
 		"http://127.0.0.1:4001", "etcd Server URL. If Kubernetes Master configuration file contains etcd client info, that information will be used instead")
 	flagSet.StringVar(&conf.KubeConfigFile, "kubeconfig",
-		"./nuage-k8s-master-agent.kubeconfig", "kubeconfig file for Nuage Kuberenetes masters agent")
+		"", "kubeconfig file for Nuage Kuberenetes masters agent. If not specified, the in-cluster configuration (the pod service account) is used")
 	flagSet.StringVar(&conf.MasterConfigFile, "masterconfig",
 		"", "Kubernetes masters configuration file")
+	flagSet.StringVar(&conf.MasterConfigMap, "masterconfigmap",
+		"", "Kubernetes ConfigMap (\"namespace/name\") with the cluster network configuration, instead of the Kubernetes masters configuration file")
+	flagSet.DurationVar(&conf.ShutdownTimeout, "shutdowntimeout",
+		20*time.Second, "time given to the in-flight Kubernetes events on shutdown (SIGTERM / SIGINT) before exiting")
+	flagSet.StringVar(&conf.LogLevel, "loglevel",
+		"info", "level of the structured (JSON) Kubernetes / VSD client logs: \"debug\", \"info\", \"warning\" or \"error\"")
+	flagSet.StringVar(&conf.AdminAddress, "adminaddress",
+		"127.0.0.1:8099", "address (\"host:port\") of the admin HTTP endpoints (\"/loglevel\"). Not authenticated: Keep it on localhost unless access to it is restricted otherwise. Empty disables them")
 	// CNI flags
 	flagSet.StringVar(&conf.CniConfig.ServerPort, "cniserverport",
 		"7443", "server port for Kubernetes nodes Nuage CNI Agent server")
 	flagSet.StringVar(&conf.CniConfig.CaFile, "cniserverca",
 		"/opt/nuage/etc/ca.crt", "CA file for Kubernetes nodes Nuage CNI Agent server")
+	// IPAM flags
+	flagSet.DurationVar(&conf.IpamConfig.QuarantinePeriod, "ipquarantine",
+		0, "quarantine period for released pod IP addresses before they can be re-allocated (e.g. \"5m\"). Zero disables the quarantine")
+	flagSet.BoolVar(&conf.ValidateOnly, "validate-config",
+		false, "validate the configuration file and the files it references, print all the problems found and exit (with a non-zero status if any are found)")
+	flagSet.BoolVar(&conf.IPAMCheck, "ipamcheck",
+		false, "check the pod IP addresses in Kubernetes against the VSD Container interfaces and subnet allocators, report inconsistencies and exit (with a non-zero status if any are found)")
+	flagSet.DurationVar(&conf.IpamConfig.CheckInterval, "ipamcheckinterval",
+		0, "interval for the periodic IPAM consistency check (e.g. \"10m\"). Zero disables the periodic check")
+	flagSet.BoolVar(&conf.IpamConfig.CheckRepair, "ipamrepair",
+		false, "repair leaked IP addresses found by IPAM checks, instead of only reporting them")
+	// Policy flags
+	flagSet.BoolVar(&conf.PolicyConfig.ServiceCrossNamespace, "svccrossnamespace",
+		false, "allow traffic to Kubernetes services from pods in other namespaces, unless overriden per service by the \"nuage.io/service-access\" annotation")
+	flagSet.StringVar(&conf.PolicyConfig.NamespaceIsolation, "nsisolation",
+		"isolated", "default isolation mode for Kubernetes namespaces: \"open\" (allow all traffic), \"isolated\" (allow intra-namespace traffic only) or \"deny\" (deny all traffic)")
+	flagSet.StringVar(&conf.PolicyConfig.AuthzConfigFile, "authzconfig",
+		"", "service account based authorization file for custom network settings and Nuage policies. If not specified, everything is allowed")
+	flagSet.BoolVar(&conf.Audit, "audit",
+		false, "audit the VSD Policy Elements against the Kubernetes state, report drift and exit (with a non-zero status if drift is found)")
+	flagSet.DurationVar(&conf.PolicyConfig.AuditInterval, "auditinterval",
+		0, "interval for the periodic audit of the VSD Policy Elements against the Kubernetes state (e.g. \"10m\"). Zero disables the periodic audit")
+	flagSet.BoolVar(&conf.PolicyConfig.AuditCorrect, "auditcorrect",
+		false, "correct drift found by policy audits, instead of only reporting it")
 	// VSD flags
+	flagSet.StringVar(&conf.NamingConfig.ClusterID, "clusterid",
+		"", "ID of the Kubernetes cluster, for the ownership metadata of the VSD objects. Defaults to the Nuage Domain name")
 	flagSet.StringVar(&conf.VsdConfig.VsdUrl, "vsdurl",
 		"", "Nuage VSD URL")
 	flagSet.StringVar(&conf.VsdConfig.APIVersion, "vsdapiversion",
@@ -91,10 +230,20 @@ func Flags(conf *AgentConfig, flagSet *flag.FlagSet) {
 		"", "Nuage Enterprise Name for the Kuberenetes cluster")
 	flagSet.StringVar(&conf.VsdConfig.Domain, "vsddomain",
 		"", "Nuage Domain Name for the Kuberenetes cluster")
+	flagSet.StringVar(&conf.VsdConfig.TenantsConfigFile, "tenantsconfig",
+		"", "mapping file of Kubernetes namespaces to separate Nuage Domains / Enterprises. If not specified, all namespaces are in the Nuage Domain of the cluster")
+	flagSet.StringVar(&conf.VsdConfig.DomainTemplate, "vsddomaintemplate",
+		"", "existing Nuage Domain template to instantiate missing Nuage Domains from. If not specified, a new Domain template is created per Domain")
 	flagSet.StringVar(&conf.VsdConfig.CertFile, "vsdcertfile",
 		"./nuage-k8s-master-agent.crt", "VSD certificate file for Nuage Kubernetes masters agent")
 	flagSet.StringVar(&conf.VsdConfig.KeyFile, "vsdkeyfile",
 		"./nuage-k8s-master-agent.key", "VSD private key file for Nuage Kubernetes masters agent")
+	flagSet.StringVar(&conf.VsdConfig.Username, "vsdusername",
+		"", "VSD username for Nuage Kubernetes masters agent. If specified, user + password authentication is used instead of the VSD certificate")
+	flagSet.StringVar(&conf.VsdConfig.PasswordFile, "vsdpasswordfile",
+		"", "file with the VSD password or API key for Nuage Kubernetes masters agent (e.g. a Kubernetes Secret mount)")
+	flagSet.StringVar(&conf.VsdConfig.Organization, "vsdorganization",
+		"csp", "VSD Enterprise of the VSD user")
 	// Set the values for log_dir and logtostderr.  Because this happens before flag.Parse(), cli arguments will override these.
 	// Also set the DefValue parameter so -help shows the new defaults.
 	// XXX - Make sure "glog" package is imported at this point, otherwise this will panic
@@ -110,15 +259,119 @@ func Flags(conf *AgentConfig, flagSet *flag.FlagSet) {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
+// Load the configuration file over "conf" (flags / defaults), then the NUAGE_* environment variables over the result. No configuration file if "ConfigFile" is empty
 func LoadAgentConfig(conf *AgentConfig) error {
-	data, err := ioutil.ReadFile(conf.ConfigFile)
-	if err != nil {
+	// Applied first as well, for NUAGE_CONFIG_FILE
+	if err := ApplyEnv(conf); err != nil {
 		return err
 	}
 
-	if err := yaml.Unmarshal(data, conf); err != nil {
-		return err
+	if conf.ConfigFile != "" {
+		data, err := ioutil.ReadFile(conf.ConfigFile)
+		if err != nil {
+			return err
+		}
+
+		if err := unmarshalStrict(data, conf); err != nil {
+			return err
+		}
+	}
+
+	return ApplyEnv(conf)
+}
+
+func LoadAuthzConfig(fname string) (*AuthzConfig, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	authz := new(AuthzConfig)
+	if err := unmarshalStrict(data, authz); err != nil {
+		return nil, err
+	}
+
+	return authz, nil
+}
+
+func LoadTenantsConfig(fname string) (*TenantsConfig, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	tenants := new(TenantsConfig)
+	if err := unmarshalStrict(data, tenants); err != nil {
+		return nil, err
+	}
+
+	return tenants, nil
+}
+
+func LoadMasterConfig(fname string) (*MasterConfig, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	master := new(MasterConfig)
+	if err := yaml.Unmarshal(data, master); err != nil {
+		return nil, err
+	}
+
+	return master, nil
+}
+
+// K8S ConfigMap ("k8s-master-configmap") keys of the network config. Same names as in the K8S master configuration file, e.g.:
+//
+//	data:
+//	  clusterNetworkCIDR: 70.70.0.0/16
+//	  hostSubnetLength: "8"
+//	  serviceNetworkCIDR: 192.168.0.0/16
+//
+// Set over the network config of "master" -- e.g. from the K8S master configuration file, still used for the etcd client info
+func ApplyMasterConfigMap(master *MasterConfig, data map[string]string) error {
+	for k, v := range data {
+		switch k {
+		case "clusterNetworkCIDR":
+			master.NetworkConfig.ClusterCIDR = v
+		case "serviceNetworkCIDR":
+			master.NetworkConfig.ServiceCIDR = v
+		case "hostSubnetLength":
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("hostSubnetLength: Not an integer: %q", v)
+			}
+			master.NetworkConfig.SubnetLength = n
+		default:
+			return fmt.Errorf("Unknown setting: %s", k)
+		}
 	}
 
 	return nil
 }
+
+// The configuration file settings that differ between two configurations, as YAML paths (e.g. "vsd-config.domain")
+func Changes(old, new *AgentConfig) []string {
+	return changes("", reflect.ValueOf(*old), reflect.ValueOf(*new))
+}
+
+func changes(prefix string, old, new reflect.Value) []string {
+	var resp []string
+
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		tag := field.Tag.Get("yaml")
+		if tag == "" || tag == "-" { // Not a configuration file setting
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			resp = append(resp, changes(prefix+tag+".", old.Field(i), new.Field(i))...)
+		} else if !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			resp = append(resp, prefix+tag)
+		}
+	}
+
+	return resp
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestApplyMasterConfigMap(t *testing.T) {
+	tests := []struct {
+		data    map[string]string
+		network networkConfig // Expected, over the network config of the master configuration file below
+		err     string
+	}{
+		{map[string]string{}, networkConfig{ClusterCIDR: "10.128.0.0/14", SubnetLength: 9, ServiceCIDR: "172.30.0.0/16"}, ""},
+		{map[string]string{"clusterNetworkCIDR": "70.70.0.0/16", "hostSubnetLength": " 8 "},
+			networkConfig{ClusterCIDR: "70.70.0.0/16", SubnetLength: 8, ServiceCIDR: "172.30.0.0/16"}, ""},
+		{map[string]string{"hostSubnetLength": "8bits"}, networkConfig{}, `hostSubnetLength: Not an integer: "8bits"`},
+		{map[string]string{"clusterNetworkCidr": "70.70.0.0/16"}, networkConfig{}, "Unknown setting: clusterNetworkCidr"},
+		// Not a network setting
+		{map[string]string{"urls": "https://etcd1:2379"}, networkConfig{}, "Unknown setting: urls"},
+	}
+
+	for _, test := range tests {
+		master := MasterConfig{
+			NetworkConfig:  networkConfig{ClusterCIDR: "10.128.0.0/14", SubnetLength: 9, ServiceCIDR: "172.30.0.0/16"},
+			EtcdClientInfo: etcdClientInfo{EtcdServerUrls: []string{"https://etcd0:2379"}},
+		}
+		err := ApplyMasterConfigMap(&master, test.data)
+		if errString(err) != test.err {
+			t.Errorf("ApplyMasterConfigMap(%v) = %v, expected: %q", test.data, err, test.err)
+		} else if err == nil && (master.NetworkConfig != test.network || len(master.EtcdClientInfo.EtcdServerUrls) != 1) {
+			t.Errorf("ApplyMasterConfigMap(%v) = %+v, expected: %+v", test.data, master, test.network)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	base := AgentConfig{LogLevel: "info", ShutdownTimeout: time.Minute, VsdConfig: vsdConfig{Domain: "k8s"}}
+
+	tests := []struct {
+		change  func(*AgentConfig)
+		changes []string
+	}{
+		{func(c *AgentConfig) {}, nil},
+		{func(c *AgentConfig) { c.LogLevel = "debug" }, []string{"log-level"}},
+		{func(c *AgentConfig) { c.ShutdownTimeout = time.Second; c.VsdConfig.Domain = "other" }, []string{"shutdown-timeout", "vsd-config.domain"}},
+		{func(c *AgentConfig) { c.VsdConfig.DomainSettings.PAT = "ENABLED" }, []string{"vsd-config.domain-settings.pat"}},
+		// Not configuration file settings
+		{func(c *AgentConfig) {
+			c.EtcdServerUrl = "https://etcd1:2379"
+			c.ConfigFile = "agent.yaml"
+			c.Audit = true
+			c.MasterConfig.NetworkConfig.SubnetLength = 8
+		}, nil},
+	}
+
+	for i, test := range tests {
+		conf := base
+		test.change(&conf)
+		if changes := Changes(&base, &conf); !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("Changes (test %d) = %q, expected: %q", i, changes, test.changes)
+		}
+	}
+}
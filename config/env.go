@@ -0,0 +1,103 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+////////
+//////// NUAGE_* environment variables: Settings of the agent / K8S master configuration, e.g. from a K8S Deployment
+////////
+
+//// XXX - Notes:
+//// - Precedence, lowest first: Defaults / command line flags, configuration file, K8S master configuration (file or ConfigMap), environment variables
+//// - The variable of each setting is given by its "env" struct tag (see config.go)
+//// - Lists (e.g. NUAGE_ETCD_URLS) are comma separated. Durations use the Go syntax, e.g. "5m"
+//// - A variable set to the empty string is applied as well, e.g. to clear a setting from the configuration file
+
+const envPrefix = "NUAGE_"
+
+// Set the fields of the struct pointed to by "v" from their NUAGE_* environment variables. Reports all the invalid values
+func ApplyEnv(v interface{}) error {
+	var errs []string
+
+	applyEnv(reflect.ValueOf(v).Elem(), &errs)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Invalid environment variable(s): %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+func applyEnv(v reflect.Value, errs *[]string) {
+	for i := 0; i < v.NumField(); i++ {
+		field, fv := v.Type().Field(i), v.Field(i)
+
+		name := field.Tag.Get("env")
+		if name == "" {
+			if field.Type.Kind() == reflect.Struct {
+				applyEnv(fv, errs)
+			}
+			continue
+		}
+
+		value, set := os.LookupEnv(name)
+		if !set {
+			continue
+		}
+
+		if err := setValue(fv, value); err != nil {
+			*errs = append(*errs, fmt.Sprintf("%s=%q (%s)", name, value, err))
+		}
+	}
+}
+
+func setValue(fv reflect.Value, value string) error {
+	switch {
+	case fv.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("not a duration")
+		}
+		fv.SetInt(int64(d))
+	case fv.Kind() == reflect.String:
+		fv.SetString(value)
+	case fv.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		fv.SetBool(b)
+	case fv.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		fv.SetInt(int64(n))
+	case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+		var l []string
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				l = append(l, s)
+			}
+		}
+		fv.Set(reflect.ValueOf(l))
+	default:
+		return fmt.Errorf("unsupported setting type: %s", fv.Type())
+	}
+	return nil
+}
+
+// Whether any NUAGE_* environment variable is set, i.e. the agent may be configured without command line arguments
+func EnvConfigured() bool {
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envPrefix) {
+			return true
+		}
+	}
+	return false
+}
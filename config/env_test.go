@@ -0,0 +1,127 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		env  map[string]string
+		conf AgentConfig // Expected, from a configuration with the "base" settings below
+		err  string
+	}{
+		{map[string]string{"NUAGE_LOG_LEVEL": "debug", "NUAGE_VSD_DOMAIN": "k8s-env"},
+			AgentConfig{LogLevel: "debug", ShutdownTimeout: time.Minute, VsdConfig: vsdConfig{Domain: "k8s-env", Enterprise: "k8s"}}, ""},
+		// The empty string clears a setting
+		{map[string]string{"NUAGE_VSD_ENTERPRISE": ""},
+			AgentConfig{LogLevel: "info", ShutdownTimeout: time.Minute, VsdConfig: vsdConfig{Domain: "k8s"}}, ""},
+		{map[string]string{"NUAGE_SHUTDOWN_TIMEOUT": "90s", "NUAGE_AUDIT": "true"},
+			AgentConfig{LogLevel: "info", ShutdownTimeout: 90 * time.Second, Audit: true, VsdConfig: vsdConfig{Domain: "k8s", Enterprise: "k8s"}}, ""},
+		// All the invalid values are reported
+		{map[string]string{"NUAGE_SHUTDOWN_TIMEOUT": "90", "NUAGE_AUDIT": "yes please"},
+			AgentConfig{}, `Invalid environment variable(s): NUAGE_AUDIT="yes please" (not a boolean), NUAGE_SHUTDOWN_TIMEOUT="90" (not a duration)`},
+	}
+
+	for _, test := range tests {
+		withEnv(t, test.env, func() {
+			conf := AgentConfig{LogLevel: "info", ShutdownTimeout: time.Minute, VsdConfig: vsdConfig{Domain: "k8s", Enterprise: "k8s"}}
+			err := ApplyEnv(&conf)
+			if errString(err) != test.err {
+				t.Errorf("ApplyEnv(%v) = %v, expected: %q", test.env, err, test.err)
+			} else if err == nil && !reflect.DeepEqual(conf, test.conf) {
+				t.Errorf("ApplyEnv(%v) = %+v, expected: %+v", test.env, conf, test.conf)
+			}
+		})
+	}
+}
+
+func TestApplyEnvLists(t *testing.T) {
+	tests := []struct {
+		value string
+		urls  []string
+	}{
+		{"https://etcd1:2379", []string{"https://etcd1:2379"}},
+		{" https://etcd1:2379, https://etcd2:2379 ,", []string{"https://etcd1:2379", "https://etcd2:2379"}},
+		{",", nil},
+		{"", nil},
+	}
+
+	for _, test := range tests {
+		withEnv(t, map[string]string{"NUAGE_ETCD_URLS": test.value}, func() {
+			master := MasterConfig{EtcdClientInfo: etcdClientInfo{EtcdServerUrls: []string{"https://etcd0:2379"}}}
+			if err := ApplyEnv(&master); err != nil {
+				t.Errorf("ApplyEnv(NUAGE_ETCD_URLS=%q): %s", test.value, err)
+			} else if urls := master.EtcdClientInfo.EtcdServerUrls; !reflect.DeepEqual(urls, test.urls) {
+				t.Errorf("ApplyEnv(NUAGE_ETCD_URLS=%q) = %q, expected: %q", test.value, urls, test.urls)
+			}
+		})
+	}
+}
+
+func TestLoadAgentConfigPrecedence(t *testing.T) {
+	f, err := ioutil.TempFile("", "nuage-k8s-master-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString("log-level: warning\nvsd-config:\n  domain: k8s-file\n  enterprise: k8s-file\n  username: admin\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	env := map[string]string{
+		"NUAGE_CONFIG_FILE":     f.Name(),
+		"NUAGE_VSD_DOMAIN":      "k8s-env",
+		"NUAGE_VSD_USERNAME":    "",
+		"NUAGE_VSD_API_VERSION": "v5_0",
+	}
+	withEnv(t, env, func() {
+		conf := AgentConfig{LogLevel: "info", VsdConfig: vsdConfig{APIVersion: "v4_0", Enterprise: "k8s"}}
+		if err := LoadAgentConfig(&conf); err != nil {
+			t.Fatalf("LoadAgentConfig: %s", err)
+		}
+
+		expected := AgentConfig{
+			ConfigFile: f.Name(),
+			LogLevel:   "warning",
+			VsdConfig:  vsdConfig{APIVersion: "v5_0", Enterprise: "k8s-file", Domain: "k8s-env"},
+		}
+		if !reflect.DeepEqual(conf, expected) {
+			t.Errorf("LoadAgentConfig = %+v, expected: %+v", conf, expected)
+		}
+	})
+}
+
+// Run "f" with the given NUAGE_* environment variables only. Restores the environment afterwards
+func withEnv(t *testing.T, env map[string]string, f func()) {
+	saved := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, envPrefix) {
+			nv := strings.SplitN(kv, "=", 2)
+			saved[nv[0]] = nv[1]
+			os.Unsetenv(nv[0])
+		}
+	}
+	defer func() {
+		for k := range env {
+			os.Unsetenv(k)
+		}
+		for k, v := range saved {
+			os.Setenv(k, v)
+		}
+	}()
+
+	for k, v := range env {
+		if err := os.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f()
+}
@@ -0,0 +1,320 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+////////
+//////// Configuration validation: Strict YAML decoding (unknown settings are errors) and semantic checks
+////////
+
+//// XXX - Notes:
+//// - "Validate" reports all the problems found, not only the first one
+//// - The K8S master configuration file is not decoded strictly: We only use parts of it (see "MasterConfig")
+//// - "Validate" checks the resolved K8S master configuration ("AgentConfig.MasterConfig"), not the file / ConfigMap themselves
+//// - The VSD name templates are checked by the VSD client (see vsd-client/naming.go)
+
+// Service account token of the in-cluster K8S config (see k8s-client: RestConfig)
+const inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// Unmarshal YAML data, rejecting the settings that do not map to a field of "out"
+func unmarshalStrict(data []byte, out interface{}) error {
+	if err := yaml.Unmarshal(data, out); err != nil {
+		return err
+	}
+
+	var generic interface{}
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+
+	if unknown := unknownSettings("", generic, reflect.TypeOf(out).Elem()); len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("Unknown setting(s): %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// The settings in the decoded YAML node that do not map to a field of the given type, as YAML paths
+func unknownSettings(prefix string, node interface{}, t reflect.Type) []string {
+	var resp []string
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := node.(map[interface{}]interface{})
+		if !ok { // Type mismatches are reported by "yaml.Unmarshal"
+			return nil
+		}
+
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]; tag != "" && tag != "-" {
+				fields[tag] = t.Field(i).Type
+			}
+		}
+
+		for k, v := range m {
+			key := fmt.Sprintf("%v", k)
+			if ft, known := fields[key]; !known {
+				resp = append(resp, prefix+key)
+			} else {
+				resp = append(resp, unknownSettings(prefix+key+".", v, ft)...)
+			}
+		}
+
+	case reflect.Slice:
+		if l, ok := node.([]interface{}); ok {
+			for i, v := range l {
+				resp = append(resp, unknownSettings(fmt.Sprintf("%s[%d].", strings.TrimSuffix(prefix, "."), i), v, t.Elem())...)
+			}
+		}
+	}
+
+	return resp
+}
+
+// Semantic checks of the configuration, incl. the files it references. Returns all the problems found
+func (conf *AgentConfig) Validate() []error {
+	var errs []error
+	problem := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	fileExists := func(setting, fname string) {
+		if fname == "" {
+			problem("%s: No file given", setting)
+		} else if _, err := os.Stat(fname); err != nil {
+			problem("%s: %s", setting, err)
+		}
+	}
+
+	//// VSD
+	vsd := conf.VsdConfig
+	if u, err := url.Parse(vsd.VsdUrl); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		problem("vsd-config.vsd-url: Invalid VSD URL: %q", vsd.VsdUrl)
+	}
+	if vsd.Enterprise == "" {
+		problem("vsd-config.enterprise: No VSD Enterprise given")
+	}
+	if vsd.Domain == "" {
+		problem("vsd-config.domain: No VSD Domain given")
+	}
+
+	if vsd.Username == "" && vsd.UsernameFile == "" { // X509 certificate based authentication
+		fileExists("vsd-config.certFile", vsd.CertFile)
+		fileExists("vsd-config.keyFile", vsd.KeyFile)
+	} else {
+		if vsd.UsernameFile != "" {
+			fileExists("vsd-config.username-file", vsd.UsernameFile)
+		}
+		if vsd.PasswordFile != "" {
+			fileExists("vsd-config.password-file", vsd.PasswordFile)
+		} else if vsd.Password == "" {
+			problem("vsd-config.password: No VSD password / API key given for user: %s", vsd.Username)
+		}
+	}
+
+	for _, s := range []struct{ setting, value string }{
+		{"underlay", vsd.DomainSettings.Underlay},
+		{"pat", vsd.DomainSettings.PAT},
+	} {
+		if !oneOf(s.value, "", "ENABLED", "DISABLED", "INHERITED") {
+			problem("vsd-config.domain-settings.%s: Invalid value: %q", s.setting, s.value)
+		}
+	}
+	if !oneOf(vsd.DomainSettings.DHCPBehavior, "", "CONSUME", "FLOOD", "OVERLAY_RELAY", "UNDERLAY_RESOLVE") {
+		problem("vsd-config.domain-settings.dhcp-behavior: Invalid value: %q", vsd.DomainSettings.DHCPBehavior)
+	}
+	if !oneOf(vsd.DomainSettings.Encryption, "", "ENABLED", "DISABLED") {
+		problem("vsd-config.domain-settings.encryption: Invalid value: %q", vsd.DomainSettings.Encryption)
+	}
+
+	if vsd.TenantsConfigFile != "" {
+		if tenants, err := LoadTenantsConfig(vsd.TenantsConfigFile); err != nil {
+			problem("vsd-config.tenants-config: %s", err)
+		} else {
+			for _, err := range tenants.Validate() {
+				problem("vsd-config.tenants-config: %s", err)
+			}
+		}
+	}
+
+	//// K8S
+	if conf.KubeConfigFile != "" {
+		fileExists("nuage-k8s-master-agent-kubeconfig", conf.KubeConfigFile)
+	} else if os.Getenv("KUBERNETES_SERVICE_HOST") == "" || os.Getenv("KUBERNETES_SERVICE_PORT") == "" {
+		problem("nuage-k8s-master-agent-kubeconfig: No kubeconfig given and not running in a K8S pod (no in-cluster config)")
+	} else {
+		fileExists("nuage-k8s-master-agent-kubeconfig: In-cluster service account token", inClusterTokenFile)
+	}
+
+	// Resolved by the caller: K8S master configuration file / ConfigMap, then environment variables
+	for _, err := range conf.MasterConfig.NetworkConfig.Validate() {
+		problem("k8s-master-config: %s", err)
+	}
+
+	//// etcd: The URLs of the K8S master configuration etcd client info, if any, else "etcd-server"
+	etcdURL := func(setting, value string) {
+		if u, err := url.Parse(value); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			problem("%s: Invalid etcd URL: %q", setting, value)
+		}
+	}
+	etcd := conf.MasterConfig.EtcdClientInfo
+	if len(etcd.EtcdServerUrls) == 0 || conf.EtcdServerUrl != "" {
+		etcdURL("etcd-server", conf.EtcdServerUrl)
+	}
+	for i, u := range etcd.EtcdServerUrls {
+		etcdURL(fmt.Sprintf("k8s-master-config: etcdClientInfo.urls[%d]", i), u)
+	}
+	for _, f := range []struct{ setting, fname string }{
+		{"ca", etcd.EtcdCA},
+		{"certFile", etcd.EtcdCertFile},
+		{"keyFile", etcd.EtcdKeyFile},
+	} {
+		if f.fname != "" {
+			fileExists("k8s-master-config: etcdClientInfo."+f.setting, f.fname)
+		}
+	}
+	if (etcd.EtcdCertFile == "") != (etcd.EtcdKeyFile == "") {
+		problem("k8s-master-config: etcdClientInfo: certFile and keyFile must be given together")
+	}
+
+	//// CNI
+	if port, err := strconv.Atoi(conf.CniConfig.ServerPort); err != nil || port < 1 || port > 65535 {
+		problem("cni-config.server-port: Invalid port: %q", conf.CniConfig.ServerPort)
+	}
+	fileExists("cni-config.caFile", conf.CniConfig.CaFile)
+
+	//// IPAM / Policies
+	for _, d := range []struct {
+		setting string
+		value   int64
+	}{
+		{"ipam-config.quarantine-period", int64(conf.IpamConfig.QuarantinePeriod)},
+		{"ipam-config.check-interval", int64(conf.IpamConfig.CheckInterval)},
+		{"policy-config.audit-interval", int64(conf.PolicyConfig.AuditInterval)},
+		{"shutdown-timeout", int64(conf.ShutdownTimeout)},
+	} {
+		if d.value < 0 {
+			problem("%s: Negative duration", d.setting)
+		}
+	}
+
+	if !oneOf(conf.LogLevel, "debug", "info", "warn", "warning", "error", "fatal", "panic") {
+		problem("log-level: Invalid value: %q", conf.LogLevel)
+	}
+
+	if conf.AdminAddress != "" {
+		if _, port, err := net.SplitHostPort(conf.AdminAddress); err != nil {
+			problem("admin-address: Invalid address: %q: %s", conf.AdminAddress, err)
+		} else if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			problem("admin-address: Invalid port: %q", port)
+		}
+	}
+
+	if !oneOf(conf.PolicyConfig.NamespaceIsolation, "", "open", "isolated", "deny") {
+		problem("policy-config.default-namespace-isolation: Invalid value: %q", conf.PolicyConfig.NamespaceIsolation)
+	}
+
+	if conf.PolicyConfig.AuthzConfigFile != "" {
+		if authz, err := LoadAuthzConfig(conf.PolicyConfig.AuthzConfigFile); err != nil {
+			problem("policy-config.authorization-config: %s", err)
+		} else {
+			for _, err := range authz.Validate() {
+				problem("policy-config.authorization-config: %s", err)
+			}
+		}
+	}
+
+	return errs
+}
+
+// Pod / service networks: Valid, non overlapping CIDRs and a per namespace subnet length leaving room for pods
+func (nc *networkConfig) Validate() []error {
+	var errs []error
+
+	_, ccidr, err := net.ParseCIDR(nc.ClusterCIDR)
+	if err != nil || ccidr.IP.To4() == nil {
+		errs = append(errs, fmt.Errorf("networkConfig.clusterNetworkCIDR: Invalid IPv4 CIDR: %q", nc.ClusterCIDR))
+	}
+
+	_, scidr, serr := net.ParseCIDR(nc.ServiceCIDR)
+	if serr != nil {
+		errs = append(errs, fmt.Errorf("networkConfig.serviceNetworkCIDR: Invalid CIDR: %q", nc.ServiceCIDR))
+	}
+
+	if err == nil && serr == nil && (ccidr.Contains(scidr.IP) || scidr.Contains(ccidr.IP)) {
+		errs = append(errs, fmt.Errorf("networkConfig: Cluster network: %s and service network: %s overlap", ccidr, scidr))
+	}
+
+	if nc.SubnetLength < 0 {
+		errs = append(errs, fmt.Errorf("networkConfig.hostSubnetLength: Negative length: %d", nc.SubnetLength))
+	} else if err == nil {
+		// The resulting mask length of the per namespace subnets must leave room for at least 2 pod IP addresses
+		if cmask, _ := ccidr.Mask.Size(); cmask+nc.SubnetLength > 30 {
+			errs = append(errs, fmt.Errorf("networkConfig.hostSubnetLength: %d yields /%d subnets of cluster network: %s . Must be /30 or larger", nc.SubnetLength, cmask+nc.SubnetLength, ccidr))
+		}
+	}
+
+	return errs
+}
+
+// Tenants with a VSD Domain, each namespace mapped to one tenant only
+func (tc *TenantsConfig) Validate() []error {
+	var errs []error
+
+	domains := make(map[string]string) // Key: K8S namespace
+	for i, tenant := range tc.Tenants {
+		if tenant.Domain == "" {
+			errs = append(errs, fmt.Errorf("tenants[%d]: Tenant without a VSD Domain", i))
+			continue
+		}
+		for _, ns := range tenant.Namespaces {
+			if prev, exists := domains[ns]; exists {
+				errs = append(errs, fmt.Errorf("K8S namespace: %s is mapped to both VSD Domain: %s and: %s", ns, prev, tenant.Domain))
+			}
+			domains[ns] = tenant.Domain
+		}
+	}
+
+	return errs
+}
+
+// Valid CIDRs in the IP ranges of the rules. Nuage policies allowed for all the service accounts of the namespace only
+func (ac *AuthzConfig) Validate() []error {
+	var errs []error
+
+	for i, rule := range ac.Rules {
+		if rule.Policies && !(len(rule.ServiceAccounts) == 1 && rule.ServiceAccounts[0] == "*") {
+			errs = append(errs, fmt.Errorf("rules[%d].policies: Nuage policies are allowed per namespace, not per service account. Use service-accounts: [\"*\"] and K8S RBAC on \"nuagenetworkpolicies\"", i))
+		}
+		if len(rule.PolicyNamespaces) > 0 && !rule.Policies {
+			errs = append(errs, fmt.Errorf("rules[%d].policy-namespaces: Only valid for rules allowing Nuage policies (\"policies: true\")", i))
+		}
+		for _, r := range rule.IPRanges {
+			if _, _, err := net.ParseCIDR(r); err != nil {
+				errs = append(errs, fmt.Errorf("rules[%d].ip-ranges: Invalid CIDR: %q", i, r))
+			}
+		}
+	}
+
+	return errs
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if strings.EqualFold(value, a) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUnmarshalStrict(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string // Empty: No error expected
+	}{
+		{"log-level: info\nvsd-config:\n  domain: k8s\n", ""},
+		{"log-levle: info\n", "Unknown setting(s): log-levle"},
+		// Nested
+		{"vsd-config:\n  domian: k8s\n  domain-settings:\n    foo: bar\n", "Unknown setting(s): vsd-config.domain-settings.foo, vsd-config.domian"},
+		// Settings tagged "-" are not in the configuration file
+		{"MasterConfig: {}\nconfig-file: agent.yaml\n", "Unknown setting(s): MasterConfig, config-file"},
+	}
+
+	for _, test := range tests {
+		conf := new(AgentConfig)
+		if err := unmarshalStrict([]byte(test.data), conf); errString(err) != test.err {
+			t.Errorf("unmarshalStrict(%q) = %v, expected: %q", test.data, err, test.err)
+		}
+	}
+}
+
+func TestUnmarshalStrictLists(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{"rules:\n- namespace: db\n  service-accounts: [dbadmin]\n  policies: true\n", ""},
+		{"rules:\n- namespace: db\n- namespace: web\n  policy: true\n", "Unknown setting(s): rules[1].policy"},
+		{"rules:\n- namespce: db\n- subnet: [web]\n", "Unknown setting(s): rules[0].namespce, rules[1].subnet"},
+	}
+
+	for _, test := range tests {
+		authz := new(AuthzConfig)
+		if err := unmarshalStrict([]byte(test.data), authz); errString(err) != test.err {
+			t.Errorf("unmarshalStrict(%q) = %v, expected: %q", test.data, err, test.err)
+		}
+	}
+}
+
+func TestUnmarshalStrictValues(t *testing.T) {
+	conf := new(AgentConfig)
+	data := "shutdown-timeout: 45s\nvsd-config:\n  domain: k8s\n  domain-settings:\n    underlay: ENABLED\n"
+	if err := unmarshalStrict([]byte(data), conf); err != nil {
+		t.Fatalf("unmarshalStrict(%q): %s", data, err)
+	}
+
+	if conf.ShutdownTimeout != 45*time.Second || conf.VsdConfig.Domain != "k8s" || conf.VsdConfig.DomainSettings.Underlay != "ENABLED" {
+		t.Errorf("unmarshalStrict(%q) = %+v", data, conf)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -2,11 +2,8 @@ package etcdelection
 
 import (
 	"context"
-	"io/ioutil"
 	"os"
 
-	yaml "gopkg.in/yaml.v1"
-
 	"time"
 
 	"github.com/FlorianOtel/go-bambou/bambou"
@@ -41,6 +38,9 @@ const (
 	// the top etcd directory under which all keys will be created
 	Topdir = "/nuageK8Sagent"
 
+	// the etcd directory for persistent agent state (no TTL). Shared by all the agents in the cluster, so it survives leader fail-over
+	Statedir = Topdir + "/state"
+
 	// Nr clients in the cluster
 	NrClients = 3
 
@@ -51,23 +51,54 @@ const (
 var (
 	// K8S Master config -- includes network information and etcd client details
 	k8sMasterConfig config.MasterConfig
+
+	// etcd client used for leader election. Also used for storing persistent agent state (valid once "InitClient" has been called)
+	etcdc *Myetcdclient
+
+	// Closed on "Resign": Stops renewing the host / leader keys
+	renewStop = make(chan struct{})
+
+	// The registered host key / whether we hold the leader key. Set by "LeaderElection"
+	hostname string
+	leader   bool
 )
 
-////  Load K8S Master configuration file -- check if any EtcdClientInfo is there. If there isn't any server added, just add the one passed by the CLI (or the default one)
+////  K8S Master configuration (as resolved at startup, see config.AgentConfig) -- check if any EtcdClientInfo is there. If there isn't any server added, just add the one passed by the CLI (or the default one)
+// Creates the etcd client, used for the agent state (e.g. by one-shot checks) and for "LeaderElection"
 func InitClient(conf *config.AgentConfig) error {
-	if data, err := ioutil.ReadFile(conf.MasterConfigFile); err != nil {
-		return bambou.NewBambouError("Cannot read K8S Master configuration file: "+conf.MasterConfigFile, err.Error())
-	} else {
-		if err := yaml.Unmarshal(data, &k8sMasterConfig); err != nil {
-			return bambou.NewBambouError("Cannot parse K8S Master configuration file: "+conf.MasterConfigFile, err.Error())
-		}
-	}
+	k8sMasterConfig = conf.MasterConfig
 
 	if len(k8sMasterConfig.EtcdClientInfo.EtcdServerUrls) == 0 {
 		// If no etcd servers were present in the K8S Master configuration file, use the CLI flag
 		k8sMasterConfig.EtcdClientInfo.EtcdServerUrls = append(k8sMasterConfig.EtcdClientInfo.EtcdServerUrls, conf.EtcdServerUrl)
 	}
 
+	glog.Infof("The etcd server URLs are: %v", k8sMasterConfig.EtcdClientInfo.EtcdServerUrls)
+
+	// create etcd client
+	myc := &Myetcdclient{
+	// cancel: make(chan struct{}),
+	}
+
+	// build an etcd KeysAPI for interacting with the etcd server
+
+	// XXX - Still TODO: Use X509 certificates, if any were given
+
+	myc.Config = client.Config{
+		Endpoints:               k8sMasterConfig.EtcdClientInfo.EtcdServerUrls,
+		Transport:               client.DefaultTransport,
+		HeaderTimeoutPerRequest: time.Second,
+	}
+
+	conn, err := client.New(myc.Config)
+	if err != nil {
+		return bambou.NewBambouError("Error creating etcd client", err.Error())
+	}
+
+	myc.kapi = client.NewKeysAPI(conn)
+
+	etcdc = myc
+
 	return nil
 }
 
@@ -204,12 +235,16 @@ func (c *Myetcdclient) RenewKey(dir, key, value string) error {
 
 		// Sleep for min (1, ServiceTTL/NrClients) seconds
 
-		if time.Second > (ServiceTTL / NrClients) {
+		interval := ServiceTTL / NrClients
+		if time.Second > interval {
 			// glog.Info("Loooping...Waking up again in 1 second")
-			time.Sleep(time.Second)
-		} else {
-			// glog.Infof("Loooping...Waking up again in %v seconds ", time.Duration(ServiceTTL/NrClients))
-			time.Sleep(ServiceTTL / NrClients)
+			interval = time.Second
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-renewStop:
+			return nil
 		}
 
 	}
@@ -234,36 +269,51 @@ func (c *Myetcdclient) GetKey(key string) error {
 
 }
 
-////////////////////////////////////////////////////////////////////////////////
-////////////////////////////////////////////////////////////////////////////////
-////////////////////////////////////////////////////////////////////////////////
+// Persistently store "value" under "key" in the agent state directory ("Statedir"). Unlike the leader / host keys, those keys do not expire.
+func SetState(key, value string) error {
+	if etcdc == nil {
+		return bambou.NewBambouError("Cannot store agent state: "+key, "etcd client not initialized")
+	}
 
-func LeaderElection() {
+	resp, err := etcdc.kapi.Set(context.Background(), Statedir+"/"+key, value, nil)
 
-	glog.Infof("The etcd server URLs are: %v", k8sMasterConfig.EtcdClientInfo.EtcdServerUrls)
-
-	// create etcd client
-	myc := &Myetcdclient{
-	// cancel: make(chan struct{}),
+	// Store the server answer
+	if resp != nil {
+		etcdc.Resp = *resp
 	}
 
-	// build an etcd KeysAPI for interacting with the etcd server
-
-	// XXX - Still TODO: Use X509 certificates, if any were given
+	return err
+}
 
-	myc.Config = client.Config{
-		Endpoints:               k8sMasterConfig.EtcdClientInfo.EtcdServerUrls,
-		Transport:               client.DefaultTransport,
-		HeaderTimeoutPerRequest: time.Second,
+// Get the persistent agent state stored under "key". Returns an empty string (and no error) if the key does not exist.
+func GetState(key string) (string, error) {
+	if etcdc == nil {
+		return "", bambou.NewBambouError("Cannot fetch agent state: "+key, "etcd client not initialized")
 	}
 
-	conn, err := client.New(myc.Config)
+	resp, err := etcdc.kapi.Get(context.Background(), Statedir+"/"+key, nil)
 
 	if err != nil {
-		glog.Fatalf("Error creating etcd client. Error: %s", err)
+		if cerr, ok := err.(client.Error); ok && cerr.Code == etcderr.EcodeKeyNotFound {
+			return "", nil
+		}
+		return "", err
 	}
 
-	myc.kapi = client.NewKeysAPI(conn)
+	// Store the server answer
+	etcdc.Resp = *resp
+
+	return resp.Node.Value, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////
+////////////////////////////////////////////////////////////////////////////////
+
+// Register this host and block until we get the leader lock. Requires "InitClient"
+func LeaderElection() {
+
+	myc := etcdc
 
 	// XXX -- create a key for this host with a lifetime of "ServiceTTL"  under the "/hosts/<hostname>" subdir of the given directory (which is created if doesn't exist).
 
@@ -289,20 +339,50 @@ func LeaderElection() {
 
 	} else { // Keep renewing the key for this node
 		glog.Infof("Successfully registered node \"%s\" on etcd servers: %v", hname, k8sMasterConfig.EtcdClientInfo.EtcdServerUrls)
+		hostname = hname
 		go myc.RenewKey(dir, hname, hname)
 	}
 
 	// Try to get a leader lease by creating ".../leader" key on etcd server. The value of the key is the local hostname.
 
-	err = myc.BlockforKey(Topdir, "leader", hname)
+	err := myc.BlockforKey(Topdir, "leader", hname)
 
 	if err != nil {
 		glog.Fatalf("===> Fatal error in trying to get leader lease Error: %s", err)
 		//....
 	}
 
+	leader = true
 	go myc.RenewKey(Topdir, "leader", hname)
 
 	glog.Info(" ######## Successfully got a leader lock ######## ")
 
 }
+
+// Stop renewing the host / leader keys and delete them, on shutdown: Another agent takes over right away instead of after the key TTL
+// XXX - The keys are deleted only if they still hold our hostname, i.e. they did not expire and got re-created by another agent meanwhile
+func Resign() error {
+	close(renewStop)
+
+	if etcdc == nil || hostname == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ServiceTTL)
+	defer cancel()
+
+	var resp error
+	if leader {
+		if _, err := etcdc.kapi.Delete(ctx, Topdir+"/leader", &client.DeleteOptions{PrevValue: hostname}); err != nil {
+			resp = bambou.NewBambouError("Cannot release the leader lock", err.Error())
+		} else {
+			glog.Info(" ######## Released the leader lock ######## ")
+		}
+	}
+
+	if _, err := etcdc.kapi.Delete(ctx, Topdir+"/hosts/"+hostname, &client.DeleteOptions{PrevValue: hostname}); err != nil {
+		glog.Warningf("Cannot deregister node \"%s\" from the etcd servers: %s", hostname, err)
+	}
+
+	return resp
+}
@@ -0,0 +1,357 @@
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/OpenPlatformSDN/client-go/pkg/api/errors"
+	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	metav1 "github.com/OpenPlatformSDN/client-go/pkg/apis/meta/v1"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
+)
+
+////
+//// Policy audit: Live VSD Policy Elements vs. the ones the agent would apply for the current K8S state
+////
+//// The desired Policy Elements of the Ingress / Egress Policies are computed from K8S (not from local agent state):
+//// - Domain defaults (see vsd-client/policies.go)
+//// - Namespace isolation modes and egress rules (see isolation.go, egress.go)
+//// - K8S services (see service.go)
+////
+//// Drift is reported as:
+//// - Missing: Desired Policy Elements not applied
+//// - Extra: Applied Policy Elements not desired -- e.g. added from the VSD GUI, or left over for deleted K8S objects
+//// - Modified: Applied Policy Elements with a different scope, traffic, action, or a priority outside their band
+////
+//// XXX - Notes:
+//// - Policy Elements are matched by Name (i.e. the VSD ACL entry "Description")
+//// - The Policies of each tenant Domain are audited separately (see vsd-client/tenants.go). Entries for tenants other than the default one are tagged with the tenant (<Enterprise>/<Domain>)
+//// - NuageNetworkPolicy resources are separate VSD Policies (see nuagepolicy.go). Those are not audited
+//// - Egress Policy Elements of namespaces with invalid egress annotations are left out of the audit (the agent leaves those unchanged as well)
+//// - K8S changes processed while an audit runs may show up as transient drift
+
+// Periodic audit settings. From the agent configuration
+var (
+	auditInterval time.Duration
+	auditCorrect  = false
+)
+
+// Drift found by an audit. Entries are "<Policy Type>: <PE name>" (plus details for "Modified")
+type AuditReport struct {
+	Missing  []string
+	Extra    []string
+	Modified []string
+}
+
+func (r *AuditReport) Drift() bool {
+	return len(r.Missing)+len(r.Extra)+len(r.Modified) > 0
+}
+
+func (r *AuditReport) String() string {
+	if !r.Drift() {
+		return "No policy drift found\n"
+	}
+
+	var report string
+	for _, section := range []struct {
+		title   string
+		entries []string
+	}{{"Missing", r.Missing}, {"Extra", r.Extra}, {"Modified", r.Modified}} {
+		if len(section.entries) == 0 {
+			continue
+		}
+		report += fmt.Sprintf("%s Policy Elements (%d):\n", section.title, len(section.entries))
+		for _, entry := range section.entries {
+			report += "  " + entry + "\n"
+		}
+	}
+
+	return report
+}
+
+// Periodic audit. Runs until the agent exits
+func PolicyAuditor(interval time.Duration, correct bool) {
+	tick(interval, func() {
+		report, err := Audit(correct)
+		if err != nil {
+			log.Errorf("Policy audit failed: %s", err)
+			return
+		}
+		if report.Drift() {
+			log.Warningf("Policy audit found drift (corrected: %t):\n%s", correct, report)
+		} else {
+			log.Info("Policy audit found no drift")
+		}
+	})
+}
+
+// Compare the live Ingress / Egress Policy Elements with the desired ones, for all tenants. If "correct" is set, the drift is corrected
+func Audit(correct bool) (*AuditReport, error) {
+	desired, skipped, err := auditDesiredPEs()
+	if err != nil {
+		return nil, err
+	}
+
+	tenants, err := vsdclient.MappedTenants()
+	if err != nil {
+		return nil, err
+	}
+
+	report := new(AuditReport)
+
+	for _, tenant := range tenants {
+		if desired[tenant] == nil { // No namespaces (yet). Domain defaults only
+			desired[tenant] = newAuditPolicies()
+		}
+		if err := auditTenant(tenant, desired[tenant], skipped, correct, report); err != nil {
+			return report, err
+		}
+	}
+
+	sort.Strings(report.Modified)
+
+	return report, nil
+}
+
+///// Auxilary functions
+
+// The desired Policy Elements of the Ingress / Egress Policies of a tenant. Key: PE name
+type auditPolicies struct {
+	ingress map[string]bandedPE
+	egress  map[string]bandedPE
+}
+
+// Incl. the Domain defaults (see vsd-client/policies.go)
+func newAuditPolicies() *auditPolicies {
+	policies := &auditPolicies{ingress: make(map[string]bandedPE), egress: make(map[string]bandedPE)}
+
+	for _, pe := range vsdclient.DefaultPEs(netpolicy.Ingress) {
+		policies.ingress[pe.Name] = bandedPE{pe: pe, band: vsdclient.DefaultBand}
+	}
+	for _, pe := range vsdclient.DefaultPEs(netpolicy.Egress) {
+		policies.egress[pe.Name] = bandedPE{pe: pe, band: vsdclient.DefaultBand}
+	}
+
+	return policies
+}
+
+// Audit the Policies of one tenant, adding the drift to the report
+func auditTenant(tenant *vsdclient.Tenant, desired *auditPolicies, skipped []string, correct bool, report *AuditReport) error {
+	// Drift corrections, for both Policies, are committed in one policy transaction
+	t := tenant.NewPolicyTransaction()
+
+	for _, policy := range []struct {
+		ptype   netpolicy.PolicyType
+		desired map[string]bandedPE
+		apply   func(*netpolicy.PolicyElement, vsdclient.PriorityBand)
+		remove  func(string)
+	}{
+		{netpolicy.Ingress, desired.ingress, t.ApplyIngressPE, t.DeleteIngressPE},
+		{netpolicy.Egress, desired.egress, t.ApplyEgressPE, t.DeleteEgressPE},
+	} {
+		live, err := tenant.LivePolicyElements(policy.ptype)
+		if err != nil {
+			return err
+		}
+
+		label := string(policy.ptype)
+		if tenant != vsdclient.DefaultTenant {
+			label += " [" + tenant.String() + "]"
+		}
+
+		livepes := make(map[string]netpolicy.PolicyElement)
+		for _, pe := range live {
+			livepes[pe.Name] = pe
+		}
+
+		var missing, extra, modified []string
+
+		for name, desired := range policy.desired {
+			livepe, exists := livepes[name]
+			if !exists {
+				missing = append(missing, name)
+				continue
+			}
+			if diffs := auditDiff(&livepe, desired); len(diffs) > 0 {
+				modified = append(modified, name)
+				report.Modified = append(report.Modified, fmt.Sprintf("%s: %s (%s)", label, name, strings.Join(diffs, ", ")))
+			}
+		}
+
+		for name := range livepes {
+			if _, exists := policy.desired[name]; exists || auditSkipped(name, skipped) {
+				continue
+			}
+			extra = append(extra, name)
+		}
+
+		sort.Strings(missing)
+		sort.Strings(extra)
+		for _, name := range missing {
+			report.Missing = append(report.Missing, fmt.Sprintf("%s: %s", label, name))
+		}
+		for _, name := range extra {
+			report.Extra = append(report.Extra, fmt.Sprintf("%s: %s", label, name))
+		}
+
+		if !correct {
+			continue
+		}
+
+		// Modified Policy Elements are deleted and re-applied
+		for _, name := range append(extra, modified...) {
+			policy.remove(name)
+		}
+		for _, name := range append(missing, modified...) {
+			policy.apply(policy.desired[name].pe, policy.desired[name].band)
+		}
+	}
+
+	if err := t.Commit(); err != nil {
+		return bambou.NewBambouError("Cannot correct policy drift in Domain: "+tenant.Domain.Name, err.Error())
+	}
+
+	return nil
+}
+
+// The desired Ingress / Egress Policy Elements for the current K8S state, by tenant. Also returns the PE name prefixes left out of the audit
+func auditDesiredPEs() (desired map[*vsdclient.Tenant]*auditPolicies, skipped []string, err error) {
+	desired = make(map[*vsdclient.Tenant]*auditPolicies)
+
+	nslist, err := clientset.Core().Namespaces().List(apiv1.ListOptions{})
+	if err != nil {
+		return nil, nil, bambou.NewBambouError("Error fetching the list of K8S namespaces", err.Error())
+	}
+
+	zones := make(map[string]*vsdclient.Zone)
+	modes := make(map[string]string)
+	nstenants := make(map[string]*vsdclient.Tenant)
+
+	for i := range nslist.Items {
+		ns := &nslist.Items[i]
+
+		tenant, err := vsdclient.NamespaceTenant(ns.ObjectMeta.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if desired[tenant] == nil {
+			desired[tenant] = newAuditPolicies()
+		}
+		ingress, egress := desired[tenant].ingress, desired[tenant].egress
+		nstenants[ns.ObjectMeta.Name] = tenant
+
+		zone := new(vsdclient.Zone)
+		zone.Name = vsdclient.ZoneName(ns.ObjectMeta.Name)
+		zones[ns.ObjectMeta.Name] = zone
+		modes[ns.ObjectMeta.Name] = namespaceIsolation(ns)
+
+		for name, nspe := range namespacePEs(ns.ObjectMeta.Name, zone, modes[ns.ObjectMeta.Name]) {
+			ingress[name] = nspe
+		}
+
+		egresspes, _, err := egressPEs(ns, zone, nil)
+		if err != nil {
+			log.Warningf("Policy audit: K8S namespace: %s has invalid egress rules: %s . Skipping its egress Policy Elements", ns.ObjectMeta.Name, err)
+			skipped = append(skipped, egressPEPrefix(ns.ObjectMeta.Name))
+			continue
+		}
+		for name, nspe := range egresspes {
+			egress[name] = nspe
+		}
+	}
+
+	svclist, err := clientset.Core().Services(apiv1.NamespaceAll).List(apiv1.ListOptions{})
+	if err != nil {
+		return nil, nil, bambou.NewBambouError("Error fetching the list of K8S services", err.Error())
+	}
+
+	for i := range svclist.Items {
+		svc := &svclist.Items[i]
+
+		zone, exists := zones[svc.ObjectMeta.Namespace]
+		if !exists || modes[svc.ObjectMeta.Namespace] == isolationDeny {
+			continue
+		}
+
+		var ep *apiv1.Endpoints
+		if serviceNamedPorts(svc) {
+			if ep, err = clientset.Core().Endpoints(svc.ObjectMeta.Namespace).Get(svc.ObjectMeta.Name, metav1.GetOptions{}); err != nil {
+				if !errors.IsNotFound(err) {
+					return nil, nil, bambou.NewBambouError("Error fetching the endpoints of K8S service: "+svc.ObjectMeta.Name, err.Error())
+				}
+				ep = nil
+			}
+		}
+
+		srczones := map[string]*vsdclient.Zone{svc.ObjectMeta.Namespace: zone}
+		if serviceCrossNS(svc) {
+			for nsname, nszone := range zones {
+				if nstenants[nsname] == nstenants[svc.ObjectMeta.Namespace] {
+					srczones[nsname] = nszone
+				}
+			}
+		}
+
+		for name, pe := range servicePEs(svc, ep, srczones) {
+			desired[nstenants[svc.ObjectMeta.Namespace]].ingress[name] = bandedPE{pe: pe, band: vsdclient.ServicesBand}
+		}
+	}
+
+	return desired, skipped, nil
+}
+
+func auditSkipped(name string, skipped []string) bool {
+	for _, prefix := range skipped {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The differences between a live Policy Element and the desired one
+func auditDiff(live *netpolicy.PolicyElement, desired bandedPE) []string {
+	var diffs []string
+
+	scope := func(stype string, name *string) string {
+		if name == nil {
+			return stype
+		}
+		return stype + " " + *name
+	}
+
+	ports := func(prange *string) string {
+		if prange == nil {
+			return "*"
+		}
+		return *prange
+	}
+
+	pe := desired.pe
+
+	if from, want := scope(live.From.Type, live.From.Name), scope(pe.From.Type, pe.From.Name); from != want {
+		diffs = append(diffs, fmt.Sprintf("from: %q, expected: %q", from, want))
+	}
+	if to, want := scope(live.To.Type, live.To.Name), scope(pe.To.Type, pe.To.Name); to != want {
+		diffs = append(diffs, fmt.Sprintf("to: %q, expected: %q", to, want))
+	}
+	if live.TrafficSpec.Protocol != pe.TrafficSpec.Protocol ||
+		ports(live.TrafficSpec.SrcPortRange) != ports(pe.TrafficSpec.SrcPortRange) ||
+		ports(live.TrafficSpec.DstPortRange) != ports(pe.TrafficSpec.DstPortRange) {
+		diffs = append(diffs, fmt.Sprintf("traffic: %s %s->%s, expected: %s %s->%s",
+			live.TrafficSpec.Protocol, ports(live.TrafficSpec.SrcPortRange), ports(live.TrafficSpec.DstPortRange),
+			pe.TrafficSpec.Protocol, ports(pe.TrafficSpec.SrcPortRange), ports(pe.TrafficSpec.DstPortRange)))
+	}
+	if live.Action != pe.Action {
+		diffs = append(diffs, fmt.Sprintf("action: %s, expected: %s", live.Action, pe.Action))
+	}
+	if !desired.band.Contains(live.Priority) {
+		diffs = append(diffs, fmt.Sprintf("priority: %d, outside the %s band", live.Priority, desired.band.Name))
+	}
+
+	return diffs
+}
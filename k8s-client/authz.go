@@ -0,0 +1,185 @@
+package k8s
+
+import (
+	"net"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
+)
+
+////
+//// Service account based authorization for custom network settings ("nuage.io" pod labels) and Nuage policies (NuageNetworkPolicy resources)
+////
+//// XXX - Notes:
+//// - Without an authorization file everything is allowed
+//// - Pods are authorized by "pod.Spec.ServiceAccountName"
+//// - NuageNetworkPolicy resources are authorized by namespace only: The agent does not know who created a resource, and any field of the resource is set by its creator.
+////   Who may create NuageNetworkPolicy resources in a namespace is controlled by K8S RBAC on the "nuagenetworkpolicies" resource (see samples/nuage-network-policy-rbac.yaml)
+//// - NuageNetworkPolicy resources apply to their own namespace only, unless the rules allowing them list other namespaces ("policy-namespaces"). See nuagepolicy.go: "nnpCheckScopes"
+//// - Disallowed requests are rejected, with a K8S Event on the requesting object
+
+// Reason for the K8S Events on rejected requests
+const authzEventReason = "NuageAuthorizationFailed"
+
+// An authorization rule, with the IP ranges parsed
+type authzRule struct {
+	config.AuthzRule
+	ipnets []*net.IPNet
+}
+
+var (
+	// "nil" if no authorization file is configured, i.e. everything is allowed
+	authzRules []authzRule
+	useAuthz   = false
+)
+
+func initAuthz(conf *config.AgentConfig) error {
+	if conf.PolicyConfig.AuthzConfigFile == "" {
+		log.Info("No service account authorization file configured. Custom network settings and Nuage policies are allowed for all service accounts")
+		return nil
+	}
+
+	authz, err := config.LoadAuthzConfig(conf.PolicyConfig.AuthzConfigFile)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range authz.Rules {
+		r := authzRule{AuthzRule: rule}
+		for _, iprange := range rule.IPRanges {
+			_, ipnet, err := net.ParseCIDR(iprange)
+			if err != nil {
+				return bambou.NewBambouError("Invalid IP range in authorization file: "+iprange, err.Error())
+			}
+			r.ipnets = append(r.ipnets, ipnet)
+		}
+		authzRules = append(authzRules, r)
+	}
+
+	useAuthz = true
+	log.Infof("Loaded %d service account authorization rules from: %s", len(authzRules), conf.PolicyConfig.AuthzConfigFile)
+	return nil
+}
+
+// Whether "value" is in "list". "*" in the list matches any value
+func authzMatch(list []string, value string) bool {
+	for _, item := range list {
+		if item == "*" || item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// The authorization rules applying to a service account
+func authzRulesFor(namespace, serviceaccount string) []authzRule {
+	if serviceaccount == "" {
+		serviceaccount = "default"
+	}
+
+	var rules []authzRule
+	for _, rule := range authzRules {
+		if rule.Namespace != "" && rule.Namespace != "*" && rule.Namespace != namespace {
+			continue
+		}
+		if authzMatch(rule.ServiceAccounts, serviceaccount) {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// Authorize the custom network settings of a pod ("nuage.io" labels, see pod.go)
+func authorizePod(pod *apiv1.Pod, nuageio map[string]string) error {
+	if !useAuthz || len(nuageio) == 0 {
+		return nil
+	}
+
+	rules := authzRulesFor(pod.ObjectMeta.Namespace, pod.Spec.ServiceAccountName)
+
+	allowed := func(check func(rule authzRule) bool) bool {
+		for _, rule := range rules {
+			if check(rule) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var denied string
+
+	if subnet, exists := nuageio["Subnet"]; exists && !allowed(func(rule authzRule) bool { return authzMatch(rule.Subnets, subnet) }) {
+		denied = "custom Subnet: " + subnet
+	}
+
+	if ipaddr, exists := nuageio["IPAddress"]; exists && denied == "" {
+		ip := net.ParseIP(ipaddr)
+		if !allowed(func(rule authzRule) bool {
+			for _, ipnet := range rule.ipnets {
+				if ip != nil && ipnet.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}) {
+			denied = "custom IP address: " + ipaddr
+		}
+	}
+
+	if pg, exists := nuageio["PolicyGroup"]; exists && denied == "" && !allowed(func(rule authzRule) bool { return authzMatch(rule.PolicyGroups, pg) }) {
+		denied = "Policy Group: " + pg
+	}
+
+	if denied == "" {
+		return nil
+	}
+
+	msg := "Service account: " + pod.Spec.ServiceAccountName + " is not allowed to use " + denied
+	recordEvent(&apiv1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  pod.ObjectMeta.Namespace,
+		Name:       pod.ObjectMeta.Name,
+		UID:        pod.ObjectMeta.UID,
+	}, authzEventReason, msg)
+
+	return bambou.NewBambouError("Error creating K8S Pod: "+pod.ObjectMeta.Name, msg)
+}
+
+// The other namespaces the Nuage policies in a namespace may apply to, as per the rules allowing them. "*" for all the namespaces
+func authzPolicyNamespaces(namespace string) []string {
+	var resp []string
+	for _, rule := range authzRulesFor(namespace, "*") {
+		if rule.Policies {
+			resp = append(resp, rule.PolicyNamespaces...)
+		}
+	}
+	return resp
+}
+
+// Authorize the creation of a Nuage policy in the namespace of the resource
+func authorizeNuageNetworkPolicy(nnp *NuageNetworkPolicy) error {
+	if !useAuthz {
+		return nil
+	}
+
+	for _, rule := range authzRulesFor(nnp.Metadata.Namespace, "*") {
+		if rule.Policies {
+			return nil
+		}
+	}
+
+	msg := "Nuage policies are not allowed in namespace: " + nnp.Metadata.Namespace
+	recordEvent(&apiv1.ObjectReference{
+		Kind:       nnpKind,
+		APIVersion: nnpGroup + "/" + nnpVersion,
+		Namespace:  nnp.Metadata.Namespace,
+		Name:       nnp.Metadata.Name,
+		UID:        nnp.Metadata.UID,
+	}, authzEventReason, msg)
+
+	return bambou.NewBambouError("Error applying NuageNetworkPolicy: "+nnp.Metadata.Name, msg)
+}
@@ -10,19 +10,20 @@ package k8s
 import (
 	"time"
 
-	"github.com/golang/glog"
 	//
 	"github.com/OpenPlatformSDN/client-go/kubernetes"
 	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
 	apiv1beta1 "github.com/OpenPlatformSDN/client-go/pkg/apis/extensions/v1beta1"
 	"github.com/OpenPlatformSDN/client-go/pkg/fields"
 	"github.com/OpenPlatformSDN/client-go/pkg/runtime"
+	"github.com/OpenPlatformSDN/client-go/rest"
 	"github.com/OpenPlatformSDN/client-go/tools/cache"
 	// "github.com/OpenPlatformSDN/client-go/pkg/util/wait"
 )
 
 // CreateResourceController creates a controller for a specific ressource and namespace.
 // The parameter function will be called on Add/Delete/Update events
+// XXX - The resource specific controllers below queue the events to a work queue per resource (see workqueue.go) instead of handling them in the informer
 func CreateResourceController(client cache.Getter, resource string, namespace string, obj runtime.Object, selector fields.Selector,
 	addFunc func(addedObj interface{}), deleteFunc func(deletedObj interface{}), updateFunc func(oldObj, updatedObj interface{})) (cache.Store, *cache.Controller) {
 
@@ -52,42 +53,68 @@ func CreatePodController(c *kubernetes.Clientset, hostname string, namespace str
 		}).AsSelector()
 	}
 
+	queue := newWorkQueue("Pods")
+
 	return CreateResourceController(c.Core().RESTClient(), "pods", namespace, &apiv1.Pod{}, filter,
 		func(addedObj interface{}) {
-			if err := addFunc(addedObj.(*apiv1.Pod)); err != nil {
-				glog.Infof("Error while handling Add Pod: %s ", err)
-			}
+			queue.Add("Add Pod", func() error { return addFunc(addedObj.(*apiv1.Pod)) })
 		},
 		func(deletedObj interface{}) {
-			if err := deleteFunc(deletedObj.(*apiv1.Pod)); err != nil {
-				glog.Infof("Error while handling Delete Pod: %s ", err)
-			}
+			queue.Add("Delete Pod", func() error { return deleteFunc(deletedObj.(*apiv1.Pod)) })
 		},
 		func(oldObj, updatedObj interface{}) {
-			if err := updateFunc(oldObj.(*apiv1.Pod), updatedObj.(*apiv1.Pod)); err != nil {
-				glog.Infof("Error while handling Update Pod: %s ", err)
-			}
+			queue.Add("Update Pod", func() error { return updateFunc(oldObj.(*apiv1.Pod), updatedObj.(*apiv1.Pod)) })
 		})
 }
 
 // CreateServiceController creates a controller specifically for Services.
 func CreateServiceController(c *kubernetes.Clientset, namespace string,
 	addFunc func(addedObj *apiv1.Service) error, deleteFunc func(deletedObj *apiv1.Service) error, updateFunc func(oldObj, updatedObj *apiv1.Service) error) (cache.Store, *cache.Controller) {
+	queue := newWorkQueue("Services")
+
 	return CreateResourceController(c.Core().RESTClient(), "services", namespace, &apiv1.Service{}, fields.Everything(),
 		func(addedObj interface{}) {
-			if err := addFunc(addedObj.(*apiv1.Service)); err != nil {
-				glog.Infof("Error while handling Add service: %s ", err)
-			}
+			queue.Add("Add service", func() error { return addFunc(addedObj.(*apiv1.Service)) })
+		},
+		func(deletedObj interface{}) {
+			queue.Add("Delete service", func() error { return deleteFunc(deletedObj.(*apiv1.Service)) })
+		},
+		func(oldObj, updatedObj interface{}) {
+			queue.Add("Update service", func() error { return updateFunc(oldObj.(*apiv1.Service), updatedObj.(*apiv1.Service)) })
+		})
+}
+
+// CreateEndpointsController creates a controller specifically for Endpoints.
+func CreateEndpointsController(c *kubernetes.Clientset, namespace string,
+	addFunc func(addedObj *apiv1.Endpoints) error, deleteFunc func(deletedObj *apiv1.Endpoints) error, updateFunc func(oldObj, updatedObj *apiv1.Endpoints) error) (cache.Store, *cache.Controller) {
+	queue := newWorkQueue("Endpoints")
+
+	return CreateResourceController(c.Core().RESTClient(), "endpoints", namespace, &apiv1.Endpoints{}, fields.Everything(),
+		func(addedObj interface{}) {
+			queue.Add("Add Endpoints", func() error { return addFunc(addedObj.(*apiv1.Endpoints)) })
 		},
 		func(deletedObj interface{}) {
-			if err := deleteFunc(deletedObj.(*apiv1.Service)); err != nil {
-				glog.Infof("Error while handling Delete service: %s ", err)
-			}
+			queue.Add("Delete Endpoints", func() error { return deleteFunc(deletedObj.(*apiv1.Endpoints)) })
 		},
 		func(oldObj, updatedObj interface{}) {
-			if err := updateFunc(oldObj.(*apiv1.Service), updatedObj.(*apiv1.Service)); err != nil {
-				glog.Infof("Error while handling Update service: %s ", err)
-			}
+			queue.Add("Update Endpoints", func() error { return updateFunc(oldObj.(*apiv1.Endpoints), updatedObj.(*apiv1.Endpoints)) })
+		})
+}
+
+// CreateConfigMapController creates a controller specifically for ConfigMaps.
+func CreateConfigMapController(c *kubernetes.Clientset, namespace string,
+	addFunc func(addedObj *apiv1.ConfigMap) error, deleteFunc func(deletedObj *apiv1.ConfigMap) error, updateFunc func(oldObj, updatedObj *apiv1.ConfigMap) error) (cache.Store, *cache.Controller) {
+	queue := newWorkQueue("ConfigMaps")
+
+	return CreateResourceController(c.Core().RESTClient(), "configmaps", namespace, &apiv1.ConfigMap{}, fields.Everything(),
+		func(addedObj interface{}) {
+			queue.Add("Add ConfigMap", func() error { return addFunc(addedObj.(*apiv1.ConfigMap)) })
+		},
+		func(deletedObj interface{}) {
+			queue.Add("Delete ConfigMap", func() error { return deleteFunc(deletedObj.(*apiv1.ConfigMap)) })
+		},
+		func(oldObj, updatedObj interface{}) {
+			queue.Add("Update ConfigMap", func() error { return updateFunc(oldObj.(*apiv1.ConfigMap), updatedObj.(*apiv1.ConfigMap)) })
 		})
 }
 
@@ -95,21 +122,37 @@ func CreateServiceController(c *kubernetes.Clientset, namespace string,
 func CreateNetworkPolicyController(c *kubernetes.Clientset, namespace string,
 	addFunc func(addedObj *apiv1beta1.NetworkPolicy) error, deleteFunc func(deletedObj *apiv1beta1.NetworkPolicy) error, updateFunc func(oldObj, updatedObj *apiv1beta1.NetworkPolicy) error) (cache.Store, *cache.Controller) {
 
+	queue := newWorkQueue("NetworkPolicies")
+
 	return CreateResourceController(c.Extensions().RESTClient(), "networkpolicies", namespace, &apiv1beta1.NetworkPolicy{}, fields.Everything(),
 		func(addedObj interface{}) {
-			if err := addFunc(addedObj.(*apiv1beta1.NetworkPolicy)); err != nil {
-				glog.Infof("Error while handling Add NetworkPolicy: %s ", err)
-			}
+			queue.Add("Add NetworkPolicy", func() error { return addFunc(addedObj.(*apiv1beta1.NetworkPolicy)) })
 		},
 		func(deletedObj interface{}) {
-			if err := deleteFunc(deletedObj.(*apiv1beta1.NetworkPolicy)); err != nil {
-				glog.Infof("Error while handling Delete NetworkPolicy: %s ", err)
-			}
+			queue.Add("Delete NetworkPolicy", func() error { return deleteFunc(deletedObj.(*apiv1beta1.NetworkPolicy)) })
 		},
 		func(oldObj, updatedObj interface{}) {
-			if err := updateFunc(oldObj.(*apiv1beta1.NetworkPolicy), updatedObj.(*apiv1beta1.NetworkPolicy)); err != nil {
-				glog.Infof("Error while handling Update NetworkPolicy: %s ", err)
-			}
+			queue.Add("Update NetworkPolicy", func() error {
+				return updateFunc(oldObj.(*apiv1beta1.NetworkPolicy), updatedObj.(*apiv1beta1.NetworkPolicy))
+			})
+		})
+}
+
+// CreateNuageNetworkPolicyController creates a controller specifically for NuageNetworkPolicies (ThirdPartyResource). Requires a REST client configured for the ThirdPartyResource API group
+func CreateNuageNetworkPolicyController(c *rest.RESTClient, namespace string,
+	addFunc func(addedObj *NuageNetworkPolicy) error, deleteFunc func(deletedObj *NuageNetworkPolicy) error, updateFunc func(oldObj, updatedObj *NuageNetworkPolicy) error) (cache.Store, *cache.Controller) {
+
+	queue := newWorkQueue("NuageNetworkPolicies")
+
+	return CreateResourceController(c, nnpResource, namespace, &NuageNetworkPolicy{}, fields.Everything(),
+		func(addedObj interface{}) {
+			queue.Add("Add NuageNetworkPolicy", func() error { return addFunc(addedObj.(*NuageNetworkPolicy)) })
+		},
+		func(deletedObj interface{}) {
+			queue.Add("Delete NuageNetworkPolicy", func() error { return deleteFunc(deletedObj.(*NuageNetworkPolicy)) })
+		},
+		func(oldObj, updatedObj interface{}) {
+			queue.Add("Update NuageNetworkPolicy", func() error { return updateFunc(oldObj.(*NuageNetworkPolicy), updatedObj.(*NuageNetworkPolicy)) })
 		})
 }
 
@@ -134,43 +177,33 @@ func CreateNamespaceController(c *kubernetes.Clientset, nsname string,
 
 	filter = fields.Everything()
 
+	queue := newWorkQueue("Namespaces")
+
 	return CreateResourceController(c.Core().RESTClient(), "namespaces", "", &apiv1.Namespace{}, filter,
 		func(addedObj interface{}) {
-			if err := addFunc(addedObj.(*apiv1.Namespace)); err != nil {
-				glog.Infof("Error while handling Add NameSpace: %s ", err)
-			}
+			queue.Add("Add NameSpace", func() error { return addFunc(addedObj.(*apiv1.Namespace)) })
 		},
 		func(deletedObj interface{}) {
-			if err := deleteFunc(deletedObj.(*apiv1.Namespace)); err != nil {
-				glog.Infof("Error while handling Delete NameSpace: %s ", err)
-
-			}
+			queue.Add("Delete NameSpace", func() error { return deleteFunc(deletedObj.(*apiv1.Namespace)) })
 		},
 		func(oldObj, updatedObj interface{}) {
-			if err := updateFunc(oldObj.(*apiv1.Namespace), updatedObj.(*apiv1.Namespace)); err != nil {
-				glog.Infof("Error while handling Update NameSpace: %s ", err)
-
-			}
+			queue.Add("Update NameSpace", func() error { return updateFunc(oldObj.(*apiv1.Namespace), updatedObj.(*apiv1.Namespace)) })
 		})
 }
 
 // CreateNodeController creates a controller specifically for Nodes.
 func CreateNodeController(c *kubernetes.Clientset,
 	addFunc func(addedObj *apiv1.Node) error, deleteFunc func(deletedObj *apiv1.Node) error, updateFunc func(oldObj, updatedObj *apiv1.Node) error) (cache.Store, *cache.Controller) {
+	queue := newWorkQueue("Nodes")
+
 	return CreateResourceController(c.Core().RESTClient(), "nodes", "", &apiv1.Node{}, fields.Everything(),
 		func(addedObj interface{}) {
-			if err := addFunc(addedObj.(*apiv1.Node)); err != nil {
-				glog.Infof("Error while handling Add Node: %s ", err)
-			}
+			queue.Add("Add Node", func() error { return addFunc(addedObj.(*apiv1.Node)) })
 		},
 		func(deletedObj interface{}) {
-			if err := deleteFunc(deletedObj.(*apiv1.Node)); err != nil {
-				glog.Infof("Error while handling Delete Node: %s ", err)
-			}
+			queue.Add("Delete Node", func() error { return deleteFunc(deletedObj.(*apiv1.Node)) })
 		},
 		func(oldObj, updatedObj interface{}) {
-			if err := updateFunc(oldObj.(*apiv1.Node), updatedObj.(*apiv1.Node)); err != nil {
-				glog.Infof("Error while handling Update Node: %s ", err)
-			}
+			queue.Add("Update Node", func() error { return updateFunc(oldObj.(*apiv1.Node), updatedObj.(*apiv1.Node)) })
 		})
 }
@@ -0,0 +1,311 @@
+package k8s
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
+)
+
+////
+//// K8S namespace egress rules
+////
+//// Egress restrictions for a namespace are set by namespace annotations:
+//// - "nuage.io/egress-default": "allow" (default) or "deny". With "deny", all egress traffic not allowed by an explicit rule is dropped
+//// - "nuage.io/egress-allow": JSON list of allowed destinations, e.g.:
+////    [{"type": "NetworkMacro", "name": "Oracle DB", "protocol": "TCP", "ports": "1521"}, {"type": "NetworkMacroGroup", "name": "External APIs"}]
+////   "type" is one of: Any, NetworkMacro, NetworkMacroGroup, Zone, Subnet, PolicyGroup, IPBlock. "protocol" is one of TCP, UDP, Any (default). "ports" is "<port>" or "<start port>-<end port>" (default: all ports)
+//// - "IPBlock" rules give a "cidr" instead of a "name", e.g. {"type": "IPBlock", "cidr": "172.16.20.0/24", "protocol": "TCP", "ports": "1521"}.
+////   The CIDR must be declared as an external network (see extnetworks.go) in a namespace of the same tenant. The rule refers to the NetworkMacro of that external network
+////
+//// Each rule maps to an Egress Policy Element (netpolicy.Egress, i.e. VSD EgressACLEntryTemplate) with the destination as "from" (Network scope) and the namespace VSD Zone as "to" (Location scope)
+////
+//// Convention: PE name = vsdclient.NamespacePEPrefix(<namespace>) + "egress " + <rule description>
+////
+//// XXX - Notes:
+//// - More complex egress rules (e.g. per Policy Group) can be expressed as NuageNetworkPolicy resources with "policy-type: Egress" (see nuagepolicy.go)
+//// - With "deny", cluster services used by the pods (e.g. DNS) have to be allowed explicitly
+//// - Invalid annotations are reported as K8S Events on the namespace. The egress Policy Elements already applied are left unchanged
+//// - "IPBlock" rules are re-resolved when external networks are declared, changed or removed. Rules with CIDRs not (or no longer) declared have no Policy Element, and are reported as K8S Events on the namespace
+
+const (
+	egressAllowAnnotation   = "nuage.io/egress-allow"
+	egressDefaultAnnotation = "nuage.io/egress-default"
+
+	egressDefaultAllow = "allow"
+	egressDefaultDeny  = "deny"
+
+	// Reason for the K8S Events on invalid egress annotations
+	egressEventReason = "NuageInvalidEgressRules"
+
+	// Egress rule type for external CIDRs (as K8S NetworkPolicy "ipBlock"), resolved to the NetworkMacros of external networks
+	egressIPBlock = "IPBlock"
+)
+
+// Allowed destination types for egress rules
+var egressScopes = map[string]netpolicy.NScope{
+	"Any":               netpolicy.NAny,
+	"NetworkMacro":      netpolicy.NetworkMacro,
+	"NetworkMacroGroup": netpolicy.NetworkMacroGroup,
+	"Zone":              netpolicy.NZone,
+	"Subnet":            netpolicy.NSubnet,
+	"PolicyGroup":       netpolicy.NPolicyGroup,
+}
+
+// An entry of the "egressAllowAnnotation" list
+type egressRule struct {
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	CIDR     string `json:"cidr"` // "IPBlock" rules only
+	Protocol string `json:"protocol"`
+	Ports    string `json:"ports"`
+}
+
+// Common prefix for the names of the namespace egress Policy Elements
+func egressPEPrefix(nsname string) string {
+	return namespacePEPrefix(nsname) + "egress "
+}
+
+// The egress Policy Elements for a namespace, as per its annotations. Key: PE name.
+// Also returns the CIDRs of the "IPBlock" rules not resolved to external networks, skipping the NetworkMacros in "exclude"
+func egressPEs(ns *apiv1.Namespace, zone *vsdclient.Zone, exclude map[string]bool) (map[string]bandedPE, []string, error) {
+	pes := make(map[string]bandedPE)
+
+	zonedst := netpolicy.PolicyDstScope{Type: string(netpolicy.LZone), Name: &zone.Name}
+
+	def := egressDefaultAllow
+	if value, exists := ns.ObjectMeta.Annotations[egressDefaultAnnotation]; exists {
+		def = strings.ToLower(value)
+	}
+	if def != egressDefaultAllow && def != egressDefaultDeny {
+		return nil, nil, fmt.Errorf("Invalid %s annotation: %q . Expected %q or %q", egressDefaultAnnotation, def, egressDefaultAllow, egressDefaultDeny)
+	}
+
+	rules, err := egressRules(ns)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unresolved []string
+
+	for i, rule := range rules {
+		pe, err := egressRulePE(ns.ObjectMeta.Name, rule, exclude)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid %s annotation, rule %d: %s", egressAllowAnnotation, i, err)
+		}
+		if pe == nil {
+			unresolved = append(unresolved, rule.CIDR)
+			continue
+		}
+		pe.Name = egressPEPrefix(ns.ObjectMeta.Name) + pe.Name
+		pe.To = zonedst
+		pes[pe.Name] = bandedPE{pe: pe, band: vsdclient.NamespaceAllowBand}
+	}
+
+	if def == egressDefaultDeny {
+		name := egressPEPrefix(ns.ObjectMeta.Name) + "deny -- drop all other traffic"
+		pes[name] = bandedPE{
+			pe: &netpolicy.PolicyElement{
+				Name:        name,
+				From:        netpolicy.AllSrcsEgress,
+				To:          zonedst,
+				TrafficSpec: netpolicy.MatchAllTraffic,
+				Action:      netpolicy.Deny,
+			},
+			band: vsdclient.NamespaceDropBand,
+		}
+	}
+
+	return pes, unresolved, nil
+}
+
+// The "egressAllowAnnotation" rules of a namespace
+func egressRules(ns *apiv1.Namespace) ([]egressRule, error) {
+	var rules []egressRule
+	if value, exists := ns.ObjectMeta.Annotations[egressAllowAnnotation]; exists {
+		if err := json.Unmarshal([]byte(value), &rules); err != nil {
+			return nil, fmt.Errorf("Invalid %s annotation: %s", egressAllowAnnotation, err)
+		}
+	}
+
+	return rules, nil
+}
+
+// The (allow) Policy Element for an egress rule of a namespace. Only the "from" field is set, with the PE name holding the rule description.
+// Nil for "IPBlock" rules with CIDRs not declared as external networks, other than the NetworkMacros in "exclude"
+func egressRulePE(nsname string, rule egressRule, exclude map[string]bool) (*netpolicy.PolicyElement, error) {
+	if rule.Type == egressIPBlock {
+		if rule.CIDR == "" {
+			return nil, fmt.Errorf("missing cidr for destination type: %s", rule.Type)
+		}
+		nmname, err := extNetworkNM(nsname, rule.CIDR, exclude)
+		if err != nil || nmname == "" {
+			return nil, err
+		}
+		pe, err := egressRulePE(nsname, egressRule{Type: "NetworkMacro", Name: nmname, Protocol: rule.Protocol, Ports: rule.Ports}, nil)
+		if err != nil {
+			return nil, err
+		}
+		pe.Name = "allow to " + egressIPBlock + " " + rule.CIDR + " (" + strings.TrimPrefix(pe.Name, "allow to ") + ")"
+		return pe, nil
+	}
+
+	scope, valid := egressScopes[rule.Type]
+	if !valid {
+		return nil, fmt.Errorf("unknown destination type: %q", rule.Type)
+	}
+
+	pe := &netpolicy.PolicyElement{
+		From:        netpolicy.PolicySrcScope{Type: string(scope)},
+		TrafficSpec: netpolicy.MatchAllTraffic,
+		Action:      netpolicy.Allow,
+	}
+
+	desc := "allow to " + rule.Type
+	if scope != netpolicy.NAny {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("missing name for destination type: %s", rule.Type)
+		}
+		name := rule.Name
+		pe.From.Name = &name
+		desc += " " + rule.Name
+	}
+
+	switch strings.ToUpper(rule.Protocol) {
+	case "", strings.ToUpper(string(netpolicy.ProtoAny)):
+		if rule.Ports != "" {
+			return nil, fmt.Errorf("ports require protocol TCP or UDP")
+		}
+	case string(netpolicy.TCP), string(netpolicy.UDP):
+		ports := "*"
+		if rule.Ports != "" {
+			if !egressValidPorts(rule.Ports) {
+				return nil, fmt.Errorf("invalid ports: %q", rule.Ports)
+			}
+			ports = rule.Ports
+		}
+		srcports := "*"
+		pe.TrafficSpec = netpolicy.TrafficSpec{
+			Protocol:     netpolicy.Protocol(strings.ToUpper(rule.Protocol)),
+			SrcPortRange: &srcports,
+			DstPortRange: &ports,
+		}
+		desc += " " + strings.ToUpper(rule.Protocol) + "/" + ports
+	default:
+		return nil, fmt.Errorf("unknown protocol: %q", rule.Protocol)
+	}
+
+	pe.Name = desc
+	return pe, nil
+}
+
+// Port range: "<port>" or "<start port>-<end port>"
+func egressValidPorts(ports string) bool {
+	bounds := strings.SplitN(ports, "-", 2)
+	var prev int
+	for i, bound := range bounds {
+		port, err := strconv.Atoi(bound)
+		if err != nil || port < 1 || port > 65535 || (i > 0 && port < prev) {
+			return false
+		}
+		prev = port
+	}
+	return true
+}
+
+// Whether the egress annotations differ between two versions of a namespace
+func egressChanged(old, updated *apiv1.Namespace) bool {
+	return old.ObjectMeta.Annotations[egressAllowAnnotation] != updated.ObjectMeta.Annotations[egressAllowAnnotation] ||
+		old.ObjectMeta.Annotations[egressDefaultAnnotation] != updated.ObjectMeta.Annotations[egressDefaultAnnotation]
+}
+
+// Apply the egress Policy Elements of a namespace, and remove the stale ones. "IPBlock" rules do not resolve to the NetworkMacros in "exclude"
+func namespaceSyncEgressPEs(ns *apiv1.Namespace, zone *vsdclient.Zone, exclude map[string]bool) error {
+	nsref := &apiv1.ObjectReference{
+		Kind:       "Namespace",
+		APIVersion: "v1",
+		Name:       ns.ObjectMeta.Name,
+		UID:        ns.ObjectMeta.UID,
+	}
+
+	pes, unresolved, err := egressPEs(ns, zone, exclude)
+	if err != nil {
+		log.Warningf("K8S namespace: %s has invalid egress rules: %s . Egress Policy Elements left unchanged", ns.ObjectMeta.Name, err)
+		recordEvent(nsref, egressEventReason, err.Error())
+		return nil
+	}
+
+	if len(unresolved) > 0 {
+		msg := "No external network declared for " + egressIPBlock + " CIDRs: " + strings.Join(unresolved, ", ") + " . Declare those in ConfigMaps labelled " + extNetworksLabel
+		log.Warningf("K8S namespace: %s egress rules: %s . Skipping their Policy Elements", ns.ObjectMeta.Name, msg)
+		recordEvent(nsref, egressEventReason, msg)
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(ns.ObjectMeta.Name)
+	if err != nil {
+		return bambou.NewBambouError("Error setting egress rules for K8S namespace: "+ns.ObjectMeta.Name, err.Error())
+	}
+
+	t := tenant.NewPolicyTransaction()
+
+	for _, nspe := range pes {
+		t.ApplyEgressPE(nspe.pe, nspe.band)
+	}
+
+	for _, pename := range tenant.EgressPENames(egressPEPrefix(ns.ObjectMeta.Name)) {
+		if _, kept := pes[pename]; !kept {
+			t.DeleteEgressPE(pename)
+		}
+	}
+
+	if err := t.Commit(); err != nil {
+		return bambou.NewBambouError("Error setting egress rules for K8S namespace: "+ns.ObjectMeta.Name, err.Error())
+	}
+
+	if len(pes) > 0 {
+		log.Infof("K8S namespace: %s has %d egress Policy Elements", ns.ObjectMeta.Name, len(pes))
+	}
+	return nil
+}
+
+// Re-sync the egress Policy Elements of the namespaces of a tenant with "IPBlock" rules, e.g. after external networks changes.
+// Those rules do not resolve to the NetworkMacros in "exclude", e.g. about to be changed
+func tenantSyncIPBlockEgress(tenant *vsdclient.Tenant, exclude map[string]bool) error {
+	nslist, err := clientset.Core().Namespaces().List(apiv1.ListOptions{})
+	if err != nil {
+		return bambou.NewBambouError("Error fetching the list of K8S namespaces", err.Error())
+	}
+
+	for i := range nslist.Items {
+		ns := &nslist.Items[i]
+
+		known, exists := lookupNamespace(ns.ObjectMeta.Name)
+		if !exists { // Synced when the namespace is created
+			continue
+		}
+
+		if nstenant, err := vsdclient.NamespaceTenant(ns.ObjectMeta.Name); err != nil || nstenant != tenant {
+			continue
+		}
+
+		rules, err := egressRules(ns)
+		if err != nil {
+			continue
+		}
+		for _, rule := range rules {
+			if rule.Type == egressIPBlock {
+				if err := namespaceSyncEgressPEs(ns, known.Zone, exclude); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	return nil
+}
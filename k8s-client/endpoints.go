@@ -0,0 +1,288 @@
+package k8s
+
+import (
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/OpenPlatformSDN/client-go/pkg/api/errors"
+	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	metav1 "github.com/OpenPlatformSDN/client-go/pkg/apis/meta/v1"
+	"github.com/Sirupsen/logrus"
+)
+
+/////
+///// K8S Endpoints <-> VSD NetworkMacroGroup of the Service backend pods
+///// VSD hierarcy: Endpoint address == VSD NetworkMacro (vspk.EnterpriseNetwork) -> NetworkMacroGroup (one per Service) -> Enterprise
+/////
+///// Nuage ACLs evaluate traffic after kube-proxy DNAT, i.e. with the backend pod as destination. As such Service level policy rules have to match the Service backends.
+///// Conventions:
+///// - NMG name = vsdclient.EndpointsNMGName(<namespace>, <service name>) ("endpoints-nmg" name template)
+///// - NM name = vsdclient.EndpointNMName(<namespace>, <endpoint IP address>) ("endpoint-nm" name template). The same NM may be part of several NMGs (pods backing several Services)
+/////
+///// XXX - Notes:
+///// - Only "ready" endpoint addresses are mapped
+///// - The NetworkMacroGroup is referred to by the Policy Elements of the Service (see service.go). As such it is deleted together with the Service, not the Endpoints
+
+func EndpointsCreated(ep *apiv1.Endpoints) error {
+	addrs := endpointAddresses(ep)
+
+	// XXX - Endpoints without any addresses (e.g. leader election locks for kube-system components) are frequent. Nothing to do for those
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	if !waitForNamespace(ep.ObjectMeta.Namespace) {
+		return bambou.NewBambouError("Error creating K8S endpoints: "+ep.ObjectMeta.Name, "Timeout waiting for namespace "+ep.ObjectMeta.Namespace+" to be created")
+	}
+
+	nmg, err := serviceEndpointsNMG(ep.ObjectMeta.Namespace, ep.ObjectMeta.Name, true)
+	if err != nil {
+		return err
+	}
+
+	for ip := range addrs {
+		if err := endpointAdd(ep, nmg, ip); err != nil {
+			return err
+		}
+	}
+
+	return endpointsSyncServicePEs(ep)
+}
+
+func EndpointsDeleted(ep *apiv1.Endpoints) error {
+	nmg, err := serviceEndpointsNMG(ep.ObjectMeta.Namespace, ep.ObjectMeta.Name, false)
+	if err != nil {
+		return err
+	}
+
+	if nmg == nil { // Nothing was mapped for this Service, or the Service was already deleted
+		return nil
+	}
+
+	for ip := range endpointAddresses(ep) {
+		if err := endpointRemove(ep, nmg, ip); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func EndpointsUpdated(old, updated *apiv1.Endpoints) error {
+	oldaddrs := endpointAddresses(old)
+	newaddrs := endpointAddresses(updated)
+
+	var added, removed []string
+
+	for ip := range newaddrs {
+		if !oldaddrs[ip] {
+			added = append(added, ip)
+		}
+	}
+
+	for ip := range oldaddrs {
+		if !newaddrs[ip] {
+			removed = append(removed, ip)
+		}
+	}
+
+	// XXX - The vast majority of Endpoints updates (e.g. leader election locks renewals) do not change the addresses
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	if !waitForNamespace(updated.ObjectMeta.Namespace) {
+		return bambou.NewBambouError("Error updating K8S endpoints: "+updated.ObjectMeta.Name, "Timeout waiting for namespace "+updated.ObjectMeta.Namespace+" to be created")
+	}
+
+	nmg, err := serviceEndpointsNMG(updated.ObjectMeta.Namespace, updated.ObjectMeta.Name, true)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range removed {
+		if err := endpointRemove(updated, nmg, ip); err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range added {
+		if err := endpointAdd(updated, nmg, ip); err != nil {
+			return err
+		}
+	}
+
+	return endpointsSyncServicePEs(updated)
+}
+
+///// Auxilary functions
+
+// The set of ready endpoint IP addresses
+func endpointAddresses(ep *apiv1.Endpoints) map[string]bool {
+	addrs := make(map[string]bool)
+
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			addrs[addr.IP] = true
+		}
+	}
+
+	return addrs
+}
+
+// Find the NetworkMacroGroup for the backends of a Service. If "create" is set, the NetworkMacroGroup is created if it doesn't exist (otherwise "nil" is returned)
+func serviceEndpointsNMG(namespace, name string, create bool) (*vsdclient.NetworkMacroGroup, error) {
+	log := logging.With(log, logrus.Fields{
+		logging.FieldOp:        "sync",
+		logging.FieldKind:      "endpoints",
+		logging.FieldNamespace: namespace,
+		logging.FieldName:      name,
+	})
+
+	tenant, err := vsdclient.NamespaceTenant(namespace)
+	if err != nil {
+		return nil, bambou.NewBambouError("Error processing K8S endpoints: "+name, err.Error())
+	}
+
+	nmg := new(vsdclient.NetworkMacroGroup)
+	nmg.Name = vsdclient.EndpointsNMGName(namespace, name)
+
+	if err := nmg.FetchByName(tenant); err != nil {
+		return nil, bambou.NewBambouError("Error processing K8S endpoints: "+name, err.Error())
+	}
+
+	if nmg.ID == "" {
+		if !create {
+			return nil, nil
+		}
+
+		log.Infof("Cannot find a VSD Network Macro Group with name: %s, creating...", nmg.Name)
+		if err := nmg.Create(tenant); err != nil {
+			return nil, bambou.NewBambouError("Error creating K8S endpoints: "+name, err.Error())
+		}
+	}
+
+	// Remove any "allow all" Policy Element left over by earlier versions
+	if err := nmg.DeletePESvcsAllow(); err != nil {
+		log.Errorf("Cannot delete legacy network Policy Element for the Service backends. Error: %s", err)
+	}
+
+	return nmg, nil
+}
+
+// Re-sync the Policy Elements of the Service if they depend on the Endpoints, i.e. the Service has named target ports
+func endpointsSyncServicePEs(ep *apiv1.Endpoints) error {
+	svc, err := clientset.Core().Services(ep.ObjectMeta.Namespace).Get(ep.ObjectMeta.Name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) { // Endpoints not managed by a Service
+			return nil
+		}
+		return bambou.NewBambouError("Error processing K8S endpoints: "+ep.ObjectMeta.Name, err.Error())
+	}
+
+	if !serviceNamedPorts(svc) {
+		return nil
+	}
+
+	return serviceSyncPEs(svc, ep)
+}
+
+// Add a "/32" NetworkMacro for an endpoint address to the NetworkMacroGroup of the Service backends. The NetworkMacro is created if needed
+func endpointAdd(ep *apiv1.Endpoints, nmg *vsdclient.NetworkMacroGroup, ip string) error {
+	tenant, err := vsdclient.NamespaceTenant(ep.ObjectMeta.Namespace)
+	if err != nil {
+		return bambou.NewBambouError("Error processing K8S endpoints: "+ep.ObjectMeta.Name, err.Error())
+	}
+
+	nm := new(vsdclient.NetworkMacro)
+	nm.Name = vsdclient.EndpointNMName(ep.ObjectMeta.Namespace, ip)
+
+	if err := nm.FetchByName(tenant); err != nil {
+		return bambou.NewBambouError("Error processing K8S endpoints: "+ep.ObjectMeta.Name, err.Error())
+	}
+
+	if nm.ID == "" {
+		objLog("sync", "endpoints", ep.ObjectMeta).Infof("Cannot find VSD Network Macro with name: %s, creating...", nm.Name)
+		nm.Address = ip
+		nm.Netmask = "255.255.255.255"
+		if err := nm.Create(tenant); err != nil {
+			return bambou.NewBambouError("Error processing K8S endpoints: "+ep.ObjectMeta.Name, err.Error())
+		}
+	}
+
+	if err := nmg.AddNM(nm); err != nil {
+		return bambou.NewBambouError("Error processing K8S endpoints: "+ep.ObjectMeta.Name, err.Error())
+	}
+
+	return nil
+}
+
+// Remove the NetworkMacro for an endpoint address from the NetworkMacroGroup of the Service backends. The NetworkMacro is deleted once it is no longer part of any NetworkMacroGroup
+func endpointRemove(ep *apiv1.Endpoints, nmg *vsdclient.NetworkMacroGroup, ip string) error {
+	tenant, err := vsdclient.NamespaceTenant(ep.ObjectMeta.Namespace)
+	if err != nil {
+		return bambou.NewBambouError("Error processing K8S endpoints: "+ep.ObjectMeta.Name, err.Error())
+	}
+
+	nm := new(vsdclient.NetworkMacro)
+	nm.Name = vsdclient.EndpointNMName(ep.ObjectMeta.Namespace, ip)
+
+	if err := nm.FetchByName(tenant); err != nil {
+		return bambou.NewBambouError("Error processing K8S endpoints: "+ep.ObjectMeta.Name, err.Error())
+	}
+
+	if nm.ID == "" { // Nothing to remove
+		return nil
+	}
+
+	if err := nmRelease(nmg, nm); err != nil {
+		return bambou.NewBambouError("Error processing K8S endpoints: "+ep.ObjectMeta.Name, err.Error())
+	}
+
+	return nil
+}
+
+// Delete a NetworkMacroGroup named by earlier versions (see vsdclient.Legacy*Name), if it exists, releasing its NetworkMacros first
+func nmgLegacyDelete(tenant *vsdclient.Tenant, nmg *vsdclient.NetworkMacroGroup) error {
+	if err := nmg.FetchByName(tenant); err != nil {
+		return err
+	}
+
+	if nmg.ID == "" { // Nothing to migrate
+		return nil
+	}
+
+	members, err := nmg.Members()
+	if err != nil {
+		return err
+	}
+
+	for _, nm := range members {
+		if err := nmRelease(nmg, nm); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Deleting legacy VSD Network Macro Group: %s", nmg.Name)
+	return nmg.Delete()
+}
+
+// Remove a NetworkMacro (endpoint or external network) from a NetworkMacroGroup, deleting it if it is no longer part of any NetworkMacroGroup
+func nmRelease(nmg *vsdclient.NetworkMacroGroup, nm *vsdclient.NetworkMacro) error {
+	remaining, err := nmg.RemoveNM(nm)
+	if err != nil {
+		return err
+	}
+
+	if remaining == 0 {
+		// XXX - NetworkMacros not owned by this cluster (e.g. shared Enterprise) are left in place
+		if !vsdclient.Owned(nm.ExternalID) {
+			log.Infof("VSD Network Macro: %s is not owned by K8S cluster: %s (externalID: %s). Not deleting", nm.Name, vsdclient.ClusterID, nm.ExternalID)
+			return nil
+		}
+		return nm.Delete()
+	}
+
+	return nil
+}
@@ -0,0 +1,319 @@
+package k8s
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+)
+
+////
+//// External networks declared in K8S ConfigMaps <-> VSD NetworkMacros (vspk.EnterpriseNetwork) / NetworkMacroGroup
+////
+//// ConfigMaps labelled "nuage.io/external-networks: true" declare named external CIDRs, e.g.:
+////
+////    apiVersion: v1
+////    kind: ConfigMap
+////    metadata:
+////      name: corporate
+////      namespace: default
+////      labels:
+////        nuage.io/external-networks: "true"
+////    data:
+////      dns: 10.10.0.53/32
+////      oracle: 172.16.20.0/24
+////
+//// Conventions:
+//// - NMG name = vsdclient.ExternalNMGName(<namespace>, <ConfigMap name>) ("external-nmg" name template)
+//// - NM name = vsdclient.ExternalNMName(<namespace>, <ConfigMap name>, <key>) ("external-nm" name template)
+////
+//// Those can be referred to as "NetworkMacro" resp. "NetworkMacroGroup" scopes by Nuage policies (see nuagepolicy.go) and namespace egress rules (see egress.go).
+//// Namespace egress "IPBlock" rules refer to external networks by CIDR instead, as K8S NetworkPolicy "ipBlock" rules do
+////
+//// XXX - Notes:
+//// - The NetworkMacros and NetworkMacroGroup are garbage collected when entries are removed from the ConfigMap, the label is removed, or the ConfigMap is deleted.
+////   The namespace egress "IPBlock" Policy Elements referring to those are re-synced (i.e. removed) first
+//// - When the CIDR of an entry changes, the egress "IPBlock" Policy Elements referring to its NetworkMacro are removed before the NetworkMacro is updated, then re-synced
+//// - Invalid CIDRs are skipped and reported as K8S Events on the ConfigMap
+//// - The NetworkMacros / Group named by earlier versions (see vsdclient.LegacyExternalNMGName) are removed once the egress "IPBlock" Policy Elements are re-synced. Nuage policies have to refer to the current names
+//// - A CIDR declared more than once for a tenant resolves to the entry in the namespace of the rule, if any, then to the first by <namespace>/<ConfigMap name>/<key>
+
+const (
+	extNetworksLabel = "nuage.io/external-networks"
+
+	// Reason for the K8S Events on invalid external network declarations
+	extNetworksEventReason = "NuageInvalidExternalNetwork"
+)
+
+func ConfigMapCreated(cm *apiv1.ConfigMap) error {
+	if !extNetworksDeclared(cm) {
+		return nil
+	}
+
+	return extNetworksSync(cm)
+}
+
+func ConfigMapDeleted(cm *apiv1.ConfigMap) error {
+	if !extNetworksDeclared(cm) {
+		return nil
+	}
+
+	return extNetworksDelete(cm)
+}
+
+func ConfigMapUpdated(old, updated *apiv1.ConfigMap) error {
+	switch {
+	case extNetworksDeclared(updated):
+		return extNetworksSync(updated)
+	case extNetworksDeclared(old): // Label removed
+		return extNetworksDelete(updated)
+	}
+
+	return nil
+}
+
+///// Auxilary functions
+
+func extNetworksDeclared(cm *apiv1.ConfigMap) bool {
+	return cm.ObjectMeta.Labels[extNetworksLabel] == "true"
+}
+
+func extNMGName(cm *apiv1.ConfigMap) string {
+	return vsdclient.ExternalNMGName(cm.ObjectMeta.Namespace, cm.ObjectMeta.Name)
+}
+
+func extNMName(cm *apiv1.ConfigMap, key string) string {
+	return vsdclient.ExternalNMName(cm.ObjectMeta.Namespace, cm.ObjectMeta.Name, key)
+}
+
+// Map the ConfigMap entries to NetworkMacros in the ConfigMap NetworkMacroGroup, and remove the NetworkMacros of entries no longer there
+func extNetworksSync(cm *apiv1.ConfigMap) error {
+	log := objLog("sync", "configmap", cm.ObjectMeta)
+
+	tenant, err := vsdclient.NamespaceTenant(cm.ObjectMeta.Namespace)
+	if err != nil {
+		return bambou.NewBambouError("Error processing external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+	}
+
+	nmg := new(vsdclient.NetworkMacroGroup)
+	nmg.Name = extNMGName(cm)
+
+	if err := nmg.FetchByName(tenant); err != nil {
+		return bambou.NewBambouError("Error processing external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+	}
+
+	if nmg.ID == "" {
+		log.Infof("Cannot find a VSD Network Macro Group with name: %s, creating...", nmg.Name)
+		if err := nmg.Create(tenant); err != nil {
+			return bambou.NewBambouError("Error processing external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+		}
+	}
+
+	// NetworkMacro names of the valid entries
+	valid := make(map[string]bool)
+	// NetworkMacros of the valid entries, with their new address / netmask
+	var nms []*vsdclient.NetworkMacro
+	// Names of the existing NetworkMacros with a changed CIDR
+	changed := make(map[string]bool)
+
+	for key, cidr := range cm.Data {
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil || ipnet.IP.To4() == nil {
+			msg := "Invalid IPv4 CIDR for external network: " + key + " : " + cidr
+			log.Warn(msg)
+			recordEvent(&apiv1.ObjectReference{
+				Kind:       "ConfigMap",
+				APIVersion: "v1",
+				Namespace:  cm.ObjectMeta.Namespace,
+				Name:       cm.ObjectMeta.Name,
+				UID:        cm.ObjectMeta.UID,
+			}, extNetworksEventReason, msg)
+			continue
+		}
+
+		nm := new(vsdclient.NetworkMacro)
+		nm.Name = extNMName(cm, key)
+
+		if err := nm.FetchByName(tenant); err != nil {
+			return bambou.NewBambouError("Error processing external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+		}
+
+		address := ipnet.IP.String()
+		netmask := net.IP(ipnet.Mask).String()
+
+		if nm.ID != "" && (nm.Address != address || nm.Netmask != netmask) {
+			changed[nm.Name] = true
+		}
+		nm.Address = address
+		nm.Netmask = netmask
+
+		nms = append(nms, nm)
+		valid[nm.Name] = true
+	}
+
+	// Egress "IPBlock" Policy Elements must not allow the new CIDRs before being re-synced: Remove those referring to the changed NetworkMacros first
+	if len(changed) > 0 {
+		if err := tenantSyncIPBlockEgress(tenant, changed); err != nil {
+			return err
+		}
+	}
+
+	for _, nm := range nms {
+		switch {
+		case nm.ID == "":
+			log.Infof("Cannot find VSD Network Macro with name: %s, creating...", nm.Name)
+			if err := nm.Create(tenant); err != nil {
+				return bambou.NewBambouError("Error processing external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+			}
+		case changed[nm.Name]:
+			log.Infof("Updating VSD Network Macro: %s to: %s/%s", nm.Name, nm.Address, nm.Netmask)
+			if err := nm.Update(); err != nil {
+				return bambou.NewBambouError("Error processing external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+			}
+		}
+
+		if err := nmg.AddNM(nm); err != nil {
+			return bambou.NewBambouError("Error processing external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+		}
+	}
+
+	// Namespace egress "IPBlock" rules may refer to those. Rules referring to removed entries no longer resolve: Their Policy Elements are removed before the NetworkMacros
+	if err := tenantSyncIPBlockEgress(tenant, nil); err != nil {
+		return err
+	}
+
+	members, err := nmg.Members()
+	if err != nil {
+		return bambou.NewBambouError("Error processing external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+	}
+
+	for _, nm := range members {
+		if valid[nm.Name] {
+			continue
+		}
+		if err := nmRelease(nmg, nm); err != nil {
+			return bambou.NewBambouError("Error processing external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+		}
+	}
+
+	log.Infof("ConfigMap declares %d external networks", len(valid))
+
+	extNetworksLegacyDelete(cm)
+	return nil
+}
+
+// Delete the NetworkMacros and the NetworkMacroGroup for the external networks in a ConfigMap
+func extNetworksDelete(cm *apiv1.ConfigMap) error {
+	tenant, err := vsdclient.NamespaceTenant(cm.ObjectMeta.Namespace)
+	if err != nil {
+		return bambou.NewBambouError("Error deleting external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+	}
+
+	// Namespace egress "IPBlock" rules referring to those no longer resolve (the ConfigMap is not listed any more): Remove their Policy Elements first
+	if err := tenantSyncIPBlockEgress(tenant, nil); err != nil {
+		return err
+	}
+
+	nmg := new(vsdclient.NetworkMacroGroup)
+	nmg.Name = extNMGName(cm)
+
+	if err := nmg.FetchByName(tenant); err != nil {
+		return bambou.NewBambouError("Error deleting external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+	}
+
+	extNetworksLegacyDelete(cm)
+
+	if nmg.ID == "" { // Nothing was mapped
+		return nil
+	}
+
+	members, err := nmg.Members()
+	if err != nil {
+		return bambou.NewBambouError("Error deleting external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+	}
+
+	for _, nm := range members {
+		if err := nmRelease(nmg, nm); err != nil {
+			return bambou.NewBambouError("Error deleting external networks in K8S ConfigMap: "+cm.ObjectMeta.Name, err.Error())
+		}
+	}
+
+	return nmg.Delete()
+}
+
+// Delete the NetworkMacroGroup -- and its NetworkMacros -- named by earlier versions for the ConfigMap. Errors are only logged
+func extNetworksLegacyDelete(cm *apiv1.ConfigMap) {
+	log := objLog("sync", "configmap", cm.ObjectMeta)
+
+	tenant, err := vsdclient.NamespaceTenant(cm.ObjectMeta.Namespace)
+	if err != nil {
+		log.Warningf("Cannot check the legacy VSD Network Macro Group of the external networks. Error: %s", err)
+		return
+	}
+
+	nmg := new(vsdclient.NetworkMacroGroup)
+	nmg.Name = vsdclient.LegacyExternalNMGName(cm.ObjectMeta.Namespace, cm.ObjectMeta.Name)
+	if nmg.Name == extNMGName(cm) { // Name templates producing the legacy names
+		return
+	}
+
+	if err := nmgLegacyDelete(tenant, nmg); err != nil {
+		log.Warningf("Cannot delete legacy VSD Network Macro Group: %s . Error: %s", nmg.Name, err)
+	}
+}
+
+// The name of the NetworkMacro of the external network declared with the given CIDR, for the tenant of a namespace, other than those in "exclude". Empty if none
+func extNetworkNM(nsname, cidr string, exclude map[string]bool) (string, error) {
+	_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil || ipnet.IP.To4() == nil {
+		return "", bambou.NewBambouError("Invalid IPv4 CIDR: "+cidr, "")
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(nsname)
+	if err != nil {
+		return "", err
+	}
+
+	cmlist, err := clientset.Core().ConfigMaps(apiv1.NamespaceAll).List(apiv1.ListOptions{LabelSelector: extNetworksLabel + "=true"})
+	if err != nil {
+		return "", bambou.NewBambouError("Error fetching the list of K8S ConfigMaps with external networks", err.Error())
+	}
+
+	// Candidate NetworkMacro names. Key: <namespace>/<ConfigMap name>/<key>
+	found := make(map[string]string)
+	var keys []string
+
+	for i := range cmlist.Items {
+		cm := &cmlist.Items[i]
+		if cmtenant, err := vsdclient.NamespaceTenant(cm.ObjectMeta.Namespace); err != nil || cmtenant != tenant {
+			continue
+		}
+		for key, value := range cm.Data {
+			if _, declared, err := net.ParseCIDR(strings.TrimSpace(value)); err != nil || declared.String() != ipnet.String() {
+				continue
+			}
+			if exclude[extNMName(cm, key)] {
+				continue
+			}
+			k := cm.ObjectMeta.Namespace + "/" + cm.ObjectMeta.Name + "/" + key
+			found[k] = extNMName(cm, key)
+			keys = append(keys, k)
+		}
+	}
+
+	if len(keys) == 0 {
+		return "", nil
+	}
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if strings.HasPrefix(k, nsname+"/") {
+			return found[k], nil
+		}
+	}
+
+	return found[keys[0]], nil
+}
@@ -0,0 +1,425 @@
+package k8s
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+)
+
+////
+//// IPAM consistency check: K8S pod IP addresses vs. VSD Container interfaces vs. the subnet IP allocators ("ipallocator.Range", see namespace.go)
+////
+//// Inconsistencies are reported as:
+//// - Duplicates: IP addresses held by more than one VSD Container, or by more than one K8S pod
+//// - Leaks: IP addresses held by a VSD Container with no K8S pod, or allocated in a subnet allocator with no VSD Container / K8S pod. Quarantined IP addresses (see quarantine.go) are not leaks
+//// - Outside: K8S pods with an IP address outside the Subnets of their namespace
+//// - Mismatches: K8S pods with an IP address different from the one of their VSD Container
+//// - Unallocated: IP addresses held by a VSD Container, not allocated in the subnet allocator -- i.e. may be handed out again (duplicates)
+////
+//// Repairs:
+//// - Leaks: The VSD Container is deleted, resp. the IP address is released from the subnet allocator (after the quarantine period, if any)
+//// - Unallocated: The IP address is allocated in the subnet allocator
+//// Duplicates, pods outside their Subnets and mismatches require the pods to be re-created. Those are only reported
+//// Repaired inconsistencies are listed as "Repaired" only, i.e. a check that repaired all the inconsistencies found is consistent (exit status 0 for "-ipamcheck")
+////
+//// XXX - Notes:
+//// - Pods being created / deleted while the check runs show up as transient leaks. Only leaks found by two consecutive checks are repaired
+//// - Host network pods and terminated pods (whose IP addresses may be re-used already) are not checked for duplicates / mismatches / Subnets
+//// - Namespaces not processed by the agent (yet) are skipped
+//// - The CNI agent caches on the nodes are not checked
+//// - VSD Containers of all the tenant Domains are checked. Custom subnets with overlapping address ranges in different tenants show up as duplicates
+
+// Periodic IPAM check settings. From the agent configuration
+var (
+	ipamCheckInterval time.Duration
+	ipamCheckRepair   = false
+)
+
+var (
+	// Leaks found by the previous check. Key: see "ipamLeak.key"
+	ipamLeaks      = make(map[string]ipamLeak)
+	ipamLeaksMutex sync.Mutex
+)
+
+// Inconsistencies found by an IPAM check
+type IPAMReport struct {
+	Duplicates  []string
+	Leaks       []string
+	Outside     []string
+	Mismatches  []string
+	Unallocated []string
+	Repaired    []string
+}
+
+// Whether inconsistencies are left, i.e. not repaired
+func (r *IPAMReport) Inconsistent() bool {
+	return len(r.Duplicates)+len(r.Leaks)+len(r.Outside)+len(r.Mismatches)+len(r.Unallocated) > 0
+}
+
+func (r *IPAMReport) String() string {
+	if !r.Inconsistent() && len(r.Repaired) == 0 {
+		return "No IPAM inconsistencies found\n"
+	}
+
+	var report string
+	for _, section := range []struct {
+		title   string
+		entries []string
+	}{
+		{"Duplicate IP addresses", r.Duplicates},
+		{"Leaked IP addresses", r.Leaks},
+		{"Pods outside their namespace Subnets", r.Outside},
+		{"Pod / VSD Container IP address mismatches", r.Mismatches},
+		{"Unallocated IP addresses", r.Unallocated},
+		{"Repaired", r.Repaired},
+	} {
+		if len(section.entries) == 0 {
+			continue
+		}
+		report += fmt.Sprintf("%s (%d):\n", section.title, len(section.entries))
+		for _, entry := range section.entries {
+			report += "  " + entry + "\n"
+		}
+	}
+
+	return report
+}
+
+// A leaked IP address: Either held by a VSD Container with no K8S pod, or allocated in a subnet allocator only
+type ipamLeak struct {
+	container *vsdclient.Container // nil for subnet allocator leaks
+	subnet    *vsdclient.Subnet    // nil if the Subnet of a VSD Container is not known
+	ip        net.IP
+}
+
+func (l ipamLeak) key() string {
+	if l.container != nil {
+		return "container " + l.container.Name + " " + l.ip.String()
+	}
+	return "subnet " + l.subnet.Subnet.Address + " " + l.ip.String()
+}
+
+func (l ipamLeak) String() string {
+	if l.container != nil {
+		return fmt.Sprintf("IP address: %s held by VSD Container: %s with no K8S pod", l.ip, l.container.Name)
+	}
+	return fmt.Sprintf("IP address: %s allocated on Subnet: %s with no VSD Container or K8S pod", l.ip, l.subnet.Subnet.Name)
+}
+
+// Periodic IPAM check. Runs until the agent exits
+func IPAMChecker(interval time.Duration, repair bool) {
+	tick(interval, func() {
+		report, err := IPAMCheck(repair)
+		if err != nil {
+			log.Errorf("IPAM check failed: %s", err)
+			return
+		}
+		switch {
+		case report.Inconsistent():
+			log.Warningf("IPAM check found inconsistencies (repair: %t):\n%s", repair, report)
+		case len(report.Repaired) > 0:
+			log.Infof("IPAM check repaired all the inconsistencies found:\n%s", report)
+		default:
+			log.Info("IPAM check found no inconsistencies")
+		}
+	})
+}
+
+// Compare the K8S pod IP addresses with the VSD Container interfaces and the subnet allocators. If "repair" is set, leaks found by the previous check as well are repaired
+func IPAMCheck(repair bool) (*IPAMReport, error) {
+	// The Subnets (and allocators) of the namespaces processed so far
+	subnets := make(map[string][]vsdclient.Subnet) // Key: K8S namespace name
+	namespacesMutex.RLock()
+	for name, ns := range Namespaces {
+		subnets[name] = ns.Subnets
+	}
+	namespacesMutex.RUnlock()
+
+	byID := make(map[string]*vsdclient.Subnet) // Key: VSD Subnet ID
+	for _, nssubnets := range subnets {
+		for i := range nssubnets {
+			byID[nssubnets[i].Subnet.ID] = &nssubnets[i]
+		}
+	}
+
+	quarantined := make(map[string]bool)
+	quarantineMutex.Lock()
+	for _, qip := range quarantine {
+		quarantined[qip.Address] = true
+	}
+	quarantineMutex.Unlock()
+
+	////
+	//// K8S pods
+	////
+
+	podlist, err := clientset.Core().Pods(apiv1.NamespaceAll).List(apiv1.ListOptions{})
+	if err != nil {
+		return nil, bambou.NewBambouError("Error fetching the list of K8S pods", err.Error())
+	}
+
+	pods := make(map[string]*apiv1.Pod) // Key: VSD Container name
+	podIPs := make(map[string][]string) // Key: IP address. Value: "<namespace>/<pod>"
+
+	for i := range podlist.Items {
+		pod := &podlist.Items[i]
+		pods[vsdclient.ContainerName(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)] = pod
+		if ipamPodActive(pod) && pod.Status.PodIP != "" {
+			podIPs[pod.Status.PodIP] = append(podIPs[pod.Status.PodIP], pod.ObjectMeta.Namespace+"/"+pod.ObjectMeta.Name)
+		}
+	}
+
+	////
+	//// VSD Containers
+	////
+
+	// The Containers of all the tenant Domains (see vsd-client/tenants.go)
+	tenants, err := vsdclient.MappedTenants()
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []*vsdclient.Container
+	for _, tenant := range tenants {
+		tcontainers, err := tenant.Containers()
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, tcontainers...)
+	}
+
+	report := new(IPAMReport)
+
+	var leaks []ipamLeak
+	var unallocated []ipamLeak
+
+	holders := make(map[string][]string)    // Key: IP address. Value: VSD Container names
+	containerIPs := make(map[string]string) // Key: VSD Container name
+
+	for _, container := range containers {
+		if container.OrchestrationID != "" && container.OrchestrationID != k8sOrchestrationID {
+			continue
+		}
+
+		ciface, err := container.Interface()
+		if err != nil { // E.g. leftover Containers w/o interface information. No IPAM involved
+			log.Infof("IPAM check: Skipping VSD Container: %s . %s", container.Name, err)
+			continue
+		}
+
+		ip := net.ParseIP(ciface.IPAddress).To4()
+		if ip == nil {
+			continue
+		}
+
+		holders[ip.String()] = append(holders[ip.String()], container.Name)
+		containerIPs[container.Name] = ip.String()
+
+		subnetID := ciface.NetworkID
+		if subnetID == "" {
+			subnetID = ciface.AttachedNetworkID
+		}
+		subnet := byID[subnetID]
+
+		pod, exists := pods[container.Name]
+		switch {
+		case !exists:
+			leaks = append(leaks, ipamLeak{container: container, subnet: subnet, ip: ip})
+		case ipamPodActive(pod) && pod.Status.PodIP != "" && pod.Status.PodIP != ip.String():
+			report.Mismatches = append(report.Mismatches, fmt.Sprintf("K8S pod: %s/%s has IP address: %s, VSD Container: %s has IP address: %s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, pod.Status.PodIP, container.Name, ip))
+		}
+
+		if subnet != nil && !subnet.Range.Has(ip) && !quarantined[ip.String()] {
+			unallocated = append(unallocated, ipamLeak{container: container, subnet: subnet, ip: ip})
+		}
+	}
+
+	////
+	//// Duplicates
+	////
+
+	for ip, names := range holders {
+		if len(names) > 1 {
+			sort.Strings(names)
+			report.Duplicates = append(report.Duplicates, fmt.Sprintf("IP address: %s held by VSD Containers: %s", ip, strings.Join(names, ", ")))
+		}
+	}
+
+	for ip, names := range podIPs {
+		if len(names) > 1 {
+			sort.Strings(names)
+			report.Duplicates = append(report.Duplicates, fmt.Sprintf("IP address: %s of K8S pods: %s", ip, strings.Join(names, ", ")))
+		}
+	}
+
+	////
+	//// Pods outside their namespace Subnets
+	////
+
+	for name, pod := range pods {
+		nssubnets, known := subnets[pod.ObjectMeta.Namespace]
+		if !known || !ipamPodActive(pod) {
+			continue
+		}
+
+		address := pod.Status.PodIP
+		if address == "" {
+			address = containerIPs[name]
+		}
+		ip := net.ParseIP(address).To4()
+		if ip == nil {
+			continue
+		}
+
+		inside := false
+		for _, subnet := range nssubnets {
+			cidr := net.IPNet{IP: net.ParseIP(subnet.Subnet.Address).To4(), Mask: net.IPMask(net.ParseIP(subnet.Subnet.Netmask).To4())}
+			if cidr.Contains(ip) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			report.Outside = append(report.Outside, fmt.Sprintf("K8S pod: %s/%s has IP address: %s outside the Subnets of namespace: %s", pod.ObjectMeta.Namespace, pod.ObjectMeta.Name, ip, pod.ObjectMeta.Namespace))
+		}
+	}
+
+	////
+	//// Subnet allocator leaks
+	////
+
+	for _, subnet := range byID {
+		var allocated []net.IP
+		subnet.Range.ForEach(func(ip net.IP) {
+			allocated = append(allocated, ip)
+		})
+
+		for _, ip := range allocated {
+			if len(holders[ip.String()]) > 0 || len(podIPs[ip.String()]) > 0 || quarantined[ip.String()] {
+				continue
+			}
+			leaks = append(leaks, ipamLeak{subnet: subnet, ip: ip})
+		}
+	}
+
+	////
+	//// Repairs
+	////
+
+	ipamLeaksMutex.Lock()
+	defer ipamLeaksMutex.Unlock()
+
+	current := make(map[string]ipamLeak)
+
+	for _, leak := range leaks {
+		current[leak.key()] = leak
+	}
+
+	if repair {
+		for key, leak := range current {
+			if _, seen := ipamLeaks[key]; !seen {
+				continue
+			}
+			if err := ipamRepairLeak(leak); err != nil {
+				log.Errorf("IPAM check: Cannot repair leak: %s . Error: %s", leak, err)
+				continue
+			}
+			report.Repaired = append(report.Repaired, leak.String())
+			delete(current, key)
+		}
+
+		var remaining []ipamLeak
+		for _, entry := range unallocated {
+			if err := entry.subnet.Range.Allocate(entry.ip); err != nil {
+				log.Errorf("IPAM check: Cannot allocate IP address: %s on Subnet: %s . Error: %s", entry.ip, entry.subnet.Subnet.Name, err)
+				remaining = append(remaining, entry)
+				continue
+			}
+			report.Repaired = append(report.Repaired, fmt.Sprintf("IP address: %s held by VSD Container: %s allocated on Subnet: %s", entry.ip, entry.container.Name, entry.subnet.Subnet.Name))
+		}
+		unallocated = remaining
+	}
+
+	ipamLeaks = current
+
+	// Repaired inconsistencies are reported as such only
+	for _, leak := range current {
+		report.Leaks = append(report.Leaks, leak.String())
+	}
+
+	for _, entry := range unallocated {
+		report.Unallocated = append(report.Unallocated, fmt.Sprintf("IP address: %s held by VSD Container: %s not allocated on Subnet: %s", entry.ip, entry.container.Name, entry.subnet.Subnet.Name))
+	}
+
+	for _, entries := range [][]string{report.Duplicates, report.Leaks, report.Outside, report.Mismatches, report.Unallocated, report.Repaired} {
+		sort.Strings(entries)
+	}
+
+	return report, nil
+}
+
+// Build the namespace Subnets (and their allocators) from the VSD, without applying any policies. For the one-shot IPAM check, where no K8S events are processed
+func LoadNamespaces() error {
+	nslist, err := clientset.Core().Namespaces().List(apiv1.ListOptions{})
+	if err != nil {
+		return bambou.NewBambouError("Error fetching the list of K8S namespaces", err.Error())
+	}
+
+	for i := range nslist.Items {
+		ns := &nslist.Items[i]
+
+		tenant, err := vsdclient.NamespaceTenant(ns.ObjectMeta.Name)
+		if err != nil {
+			return err
+		}
+
+		zone := new(vsdclient.Zone)
+		zone.Name = vsdclient.ZoneName(ns.ObjectMeta.Name)
+		if err := zone.FetchByName(tenant); err != nil {
+			return err
+		}
+		if zone.ID == "" { // Not processed by the agent (yet)
+			continue
+		}
+
+		nssubnets, err := zone.Subnets()
+		if err != nil {
+			return err
+		}
+		reserveQuarantined(nssubnets)
+
+		namespacesMutex.Lock()
+		Namespaces[ns.ObjectMeta.Name] = namespace{zone, nssubnets, namespaceIsolation(ns)}
+		namespacesMutex.Unlock()
+	}
+
+	return nil
+}
+
+///// Auxilary functions
+
+// Whether the pod holds a pod network IP address, i.e. is not terminated and not using the host network (node IP address)
+func ipamPodActive(pod *apiv1.Pod) bool {
+	return !pod.Spec.HostNetwork && pod.Status.Phase != apiv1.PodSucceeded && pod.Status.Phase != apiv1.PodFailed
+}
+
+func ipamRepairLeak(leak ipamLeak) error {
+	if leak.container != nil {
+		if err := leak.container.Delete(); err != nil {
+			return err
+		}
+		// XXX - Containers on Subnets not known to the agent have nothing to release locally
+		if leak.subnet == nil {
+			return nil
+		}
+	}
+
+	return quarantineIP(*leak.subnet, leak.ip)
+}
@@ -0,0 +1,169 @@
+package k8s
+
+import (
+	"encoding/json"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
+)
+
+////
+//// K8S namespace isolation modes
+////
+//// The isolation mode of a namespace is set by the annotation K8S uses for "DefaultDeny" (v1beta1 NetworkPolicy API), e.g.:
+////    net.beta.kubernetes.io/network-policy: {"ingress": {"isolation": "DefaultDeny"}}
+//// Nuage extension: Besides "DefaultDeny", the "isolation" field may also be "Open" or "Isolated". Namespaces without the annotation use the agent configured default.
+////
+//// Each mode maps to Ingress Policy Elements scoped to the namespace VSD Zone:
+//// - "open": Allow all traffic to the namespace
+//// - "isolated": Allow traffic from the namespace itself, drop traffic from any other source
+//// - "deny": Drop all traffic to the namespace. K8S services in the namespace do not get any "allow" Policy Elements either (see service.go)
+////
+//// Convention: PE name = vsdclient.NamespacePEPrefix(<namespace>) + <mode description>
+////
+//// XXX - Notes:
+//// - The Domain wide "Allow intra-namespace traffic" Policy Element (see vsd-client/policies.go) still applies to traffic not matched by the namespace Policy Elements
+//// - When the mode changes, the Policy Elements for the new mode are applied and the ones for the previous mode are removed in one policy transaction (see vsd-client/transactions.go)
+
+const (
+	isolationOpen     = "open"
+	isolationIsolated = "isolated"
+	isolationDeny     = "deny"
+
+	// K8S annotation for namespace ingress isolation
+	isolationAnnotation = "net.beta.kubernetes.io/network-policy"
+)
+
+// Mapping of the "isolation" field of the K8S annotation to isolation modes
+var isolationModes = map[string]string{
+	"DefaultDeny": isolationDeny,
+	"Open":        isolationOpen,
+	"Isolated":    isolationIsolated,
+}
+
+// Default for namespaces without the "isolationAnnotation". From the agent configuration
+var defaultIsolation = isolationIsolated
+
+// The format of the "isolationAnnotation" value
+type isolationSpec struct {
+	Ingress struct {
+		Isolation string `json:"isolation"`
+	} `json:"ingress"`
+}
+
+// The isolation mode of a namespace
+func namespaceIsolation(ns *apiv1.Namespace) string {
+	annotation, exists := ns.ObjectMeta.Annotations[isolationAnnotation]
+	if !exists {
+		return defaultIsolation
+	}
+
+	var spec isolationSpec
+	if err := json.Unmarshal([]byte(annotation), &spec); err != nil {
+		log.Warningf("K8S namespace: %s has invalid %s annotation: %s . Using default isolation: %s", ns.ObjectMeta.Name, isolationAnnotation, annotation, defaultIsolation)
+		return defaultIsolation
+	}
+
+	mode, valid := isolationModes[spec.Ingress.Isolation]
+	if !valid {
+		log.Warningf("K8S namespace: %s has unknown isolation: %s . Using default isolation: %s", ns.ObjectMeta.Name, spec.Ingress.Isolation, defaultIsolation)
+		return defaultIsolation
+	}
+
+	return mode
+}
+
+// Common prefix for the names of the namespace Policy Elements
+func namespacePEPrefix(nsname string) string {
+	return vsdclient.NamespacePEPrefix(nsname)
+}
+
+// A Policy Element and the priority band it is applied in
+type bandedPE struct {
+	pe   *netpolicy.PolicyElement
+	band vsdclient.PriorityBand
+}
+
+// The Policy Elements for the isolation mode of a namespace. Key: PE name
+func namespacePEs(nsname string, zone *vsdclient.Zone, mode string) map[string]bandedPE {
+	pes := make(map[string]bandedPE)
+
+	zonedst := netpolicy.PolicyDstScope{Type: string(netpolicy.NZone), Name: &zone.Name}
+
+	add := func(desc string, from netpolicy.PolicySrcScope, action netpolicy.Action) {
+		name := namespacePEPrefix(nsname) + desc
+		band := vsdclient.NamespaceAllowBand
+		if action == netpolicy.Deny {
+			band = vsdclient.NamespaceDropBand
+		}
+		pes[name] = bandedPE{
+			pe: &netpolicy.PolicyElement{
+				Name:        name,
+				From:        from,
+				To:          zonedst,
+				TrafficSpec: netpolicy.MatchAllTraffic,
+				Action:      action,
+			},
+			band: band,
+		}
+	}
+
+	switch mode {
+	case isolationOpen:
+		add("open -- allow all traffic", netpolicy.AllSrcsIngress, netpolicy.Allow)
+	case isolationIsolated:
+		add("isolated -- allow intra-namespace traffic", netpolicy.PolicySrcScope{Type: string(netpolicy.LZone), Name: &zone.Name}, netpolicy.Allow)
+		add("isolated -- drop traffic from other sources", netpolicy.AllSrcsIngress, netpolicy.Deny)
+	case isolationDeny:
+		add("deny -- drop all traffic", netpolicy.AllSrcsIngress, netpolicy.Deny)
+	}
+
+	return pes
+}
+
+// Apply the Policy Elements for the isolation mode of a namespace, and remove the ones of any other mode
+func namespaceSyncPEs(nsname string, zone *vsdclient.Zone, mode string) error {
+	tenant, err := vsdclient.NamespaceTenant(nsname)
+	if err != nil {
+		return bambou.NewBambouError("Error setting isolation for K8S namespace: "+nsname, err.Error())
+	}
+
+	pes := namespacePEs(nsname, zone, mode)
+
+	t := tenant.NewPolicyTransaction()
+
+	for _, nspe := range pes {
+		t.ApplyIngressPE(nspe.pe, nspe.band)
+	}
+
+	for _, pename := range tenant.IngressPENames(namespacePEPrefix(nsname)) {
+		if _, kept := pes[pename]; !kept {
+			t.DeleteIngressPE(pename)
+		}
+	}
+
+	if err := t.Commit(); err != nil {
+		return bambou.NewBambouError("Error setting isolation for K8S namespace: "+nsname, err.Error())
+	}
+
+	log.Infof("K8S namespace: %s has isolation: %s", nsname, mode)
+	return nil
+}
+
+// Re-sync the Policy Elements of the K8S services in a namespace, e.g. after an isolation mode change
+func namespaceSyncServices(nsname string) error {
+	svcs, err := clientset.Core().Services(nsname).List(apiv1.ListOptions{})
+	if err != nil {
+		return bambou.NewBambouError("Error fetching the list of K8S services in namespace: "+nsname, err.Error())
+	}
+
+	for i := range svcs.Items {
+		if err := serviceSyncPEs(&svcs.Items[i], nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,15 +2,16 @@ package k8s
 
 import (
 	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
 	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
 
-	"net/http"
-
-	"github.com/golang/glog"
+	"strings"
+	"sync"
 
 	"github.com/FlorianOtel/go-bambou/bambou"
 	"github.com/OpenPlatformSDN/client-go/kubernetes"
-	"github.com/OpenPlatformSDN/client-go/pkg/util/wait"
+	metav1 "github.com/OpenPlatformSDN/client-go/pkg/apis/meta/v1"
+	"github.com/OpenPlatformSDN/client-go/rest"
 	"github.com/OpenPlatformSDN/client-go/tools/clientcmd"
 )
 
@@ -26,6 +27,7 @@ import (
 type namespace struct {
 	*vsdclient.Zone                    // The VSD Zone. 1-1 mapping (transparent)
 	Subnets         []vsdclient.Subnet // List of subnets associated with this namespace
+	Isolation       string             // Isolation mode: "open", "isolated" or "deny"
 }
 
 // The Orchestration ID used by the CNI Plugin to identify the platform (slightly different clients for different platforms)
@@ -33,7 +35,13 @@ const (
 	k8sOrchestrationID = "Kubernetes"
 )
 
+// The component name for the K8S Events recorded by the agent
+const agentComponent = "nuage-k8s-master-agent"
+
 var (
+	// Structured logger. The event handlers use one with the context of the K8S object (see util.go)
+	log = logging.Log.WithField(logging.FieldComponent, "k8s-client")
+
 	clientset      *kubernetes.Clientset
 	UseNetPolicies = false
 
@@ -41,6 +49,8 @@ var (
 	//// K8S namespaces
 	////
 	Namespaces map[string]namespace // Key: K8S Namespace Name
+	// Guards "Namespaces": Written by the namespace / pod handlers and the IPAM check, read by all the K8S event queues. Read through "lookupNamespace"
+	namespacesMutex sync.RWMutex
 
 	// Pre-defined namespaces
 	PrivilegedNS = "kube-system"
@@ -60,17 +70,12 @@ var (
 
 func InitClient(conf *config.AgentConfig) error {
 
-	kubeconfig := &conf.KubeConfigFile
-
-	// uses the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	kconfig, err := RestConfig(conf)
 	if err != nil {
-		return bambou.NewBambouError("Error parsing kubeconfig", err.Error())
+		return err
 	}
 
-	glog.Infof("Loaded Agent kubeconfig: %s ", *kubeconfig)
-
-	clientset, err = kubernetes.NewForConfig(config)
+	clientset, err = kubernetes.NewForConfig(kconfig)
 	if err != nil {
 		return bambou.NewBambouError("Error creating Kubernetes client", err.Error())
 	}
@@ -81,7 +86,7 @@ func InitClient(conf *config.AgentConfig) error {
 
 	sver, _ := clientset.ServerVersion()
 
-	glog.Infof("Successfully logged in Kuberentes server. Server details: %#v", *sver)
+	log.Infof("Successfully logged in Kuberentes server. Server details: %#v", *sver)
 
 	sres, _ := clientset.ServerResources()
 
@@ -89,48 +94,121 @@ func InitClient(conf *config.AgentConfig) error {
 		for _, apires := range res.APIResources {
 			switch apires.Name {
 			case "networkpolicies":
-				glog.Infof("Found Kubernetes API server support for %#v. Available under / GroupVersion is: %#v . APIResource details: %#v", apires.Name, res.GroupVersion, apires)
+				log.Infof("Found Kubernetes API server support for %#v. Available under / GroupVersion is: %#v . APIResource details: %#v", apires.Name, res.GroupVersion, apires)
 				UseNetPolicies = true
 			default:
-				// glog.Infof("Kubernetes API Server discovery: API Server Resource:\n%#v\n", apires)
+				// log.Infof("Kubernetes API Server discovery: API Server Resource:\n%#v\n", apires)
 			}
 		}
 	}
 
+	////
+	//// NuageNetworkPolicy custom resources
+	////
+	if err := initNuageNetworkPolicies(clientset, kconfig); err != nil {
+		log.Errorf("Cannot register NuageNetworkPolicy resources. Nuage network policies will not be processed. Error: %s", err)
+	}
+
 	////
 	//// Initialize local state
 	////
 	Namespaces = make(map[string]namespace)
 	Pods = make(map[string]*vsdclient.Container)
+
+	serviceCrossNamespace = conf.PolicyConfig.ServiceCrossNamespace
+	auditInterval = conf.PolicyConfig.AuditInterval
+	auditCorrect = conf.PolicyConfig.AuditCorrect
+	ipamCheckInterval = conf.IpamConfig.CheckInterval
+	ipamCheckRepair = conf.IpamConfig.CheckRepair
+
+	switch conf.PolicyConfig.NamespaceIsolation {
+	case isolationOpen, isolationIsolated, isolationDeny:
+		defaultIsolation = conf.PolicyConfig.NamespaceIsolation
+	case "":
+	default:
+		return bambou.NewBambouError("Invalid default namespace isolation: "+conf.PolicyConfig.NamespaceIsolation, "Valid values: \""+isolationOpen+"\", \""+isolationIsolated+"\", \""+isolationDeny+"\"")
+	}
+
+	if err := initAuthz(conf); err != nil {
+		return bambou.NewBambouError("Error loading service account authorization file", err.Error())
+	}
+
+	if err := initQuarantine(conf); err != nil {
+		return bambou.NewBambouError("Error loading the list of quarantined pod IP addresses", err.Error())
+	}
 	////
 	////
 	////
 
-	glog.Info("Kubernetes client initialization completed")
+	log.Info("Kubernetes client initialization completed")
 	return nil
 }
 
 func EventWatcher() {
+	shutdownMutex.Lock()
+	if stopping {
+		shutdownMutex.Unlock()
+		return
+	}
+	started = true
+	shutdownMutex.Unlock()
+
+	////////
+	//////// Release quarantined pod IP addresses
+	////////
+
+	go QuarantineReaper()
+
+	////////
+	//////// Periodic policy audit (if configured)
+	////////
+
+	if auditInterval > 0 {
+		go PolicyAuditor(auditInterval, auditCorrect)
+	}
+
+	////////
+	//////// Periodic IPAM consistency check (if configured)
+	////////
+
+	if ipamCheckInterval > 0 {
+		go IPAMChecker(ipamCheckInterval, ipamCheckRepair)
+	}
+
 	////////
 	//////// Watch Pods
 	////////
 
 	_, pController := CreatePodController(clientset, "", "", PodCreated, PodDeleted, PodUpdated)
-	go pController.Run(wait.NeverStop)
+	go pController.Run(stopCh)
 
 	////////
 	//////// Watch Services
 	////////
 
 	_, sController := CreateServiceController(clientset, "", ServiceCreated, ServiceDeleted, ServiceUpdated)
-	go sController.Run(wait.NeverStop)
+	go sController.Run(stopCh)
+
+	////////
+	//////// Watch Endpoints -- backend pods of Services
+	////////
+
+	_, epController := CreateEndpointsController(clientset, "", EndpointsCreated, EndpointsDeleted, EndpointsUpdated)
+	go epController.Run(stopCh)
+
+	////////
+	//////// Watch ConfigMaps -- external networks declarations
+	////////
+
+	_, cmController := CreateConfigMapController(clientset, "", ConfigMapCreated, ConfigMapDeleted, ConfigMapUpdated)
+	go cmController.Run(stopCh)
 
 	////////
 	//////// Watch Namespaces
 	////////
 
 	_, nsController := CreateNamespaceController(clientset, "", NamespaceCreated, NamespaceDeleted, NamespaceUpdated)
-	go nsController.Run(wait.NeverStop)
+	go nsController.Run(stopCh)
 
 	////////
 	//////// Watch NetworkPolicies (if supported)
@@ -139,9 +217,72 @@ func EventWatcher() {
 	if UseNetPolicies {
 
 		_, npController := CreateNetworkPolicyController(clientset, "", NetworkPolicyCreated, NetworkPolicyDeleted, NetworkPolicyUpdated)
-		go npController.Run(wait.NeverStop)
+		go npController.Run(stopCh)
+
+	}
+	////////
+	//////// Watch NuageNetworkPolicies (if available)
+	////////
+
+	if nnpclient != nil {
+		_, nnpController := CreateNuageNetworkPolicyController(nnpclient, "", NuageNetworkPolicyCreated, NuageNetworkPolicyDeleted, NuageNetworkPolicyUpdated)
+		go nnpController.Run(stopCh)
+	}
+}
+
+// The K8S API server connection settings of the agent: The kubeconfig file if given, otherwise the in-cluster config (the service account of the agent pod)
+func RestConfig(conf *config.AgentConfig) (*rest.Config, error) {
+	if conf.KubeConfigFile == "" {
+		kconfig, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, bambou.NewBambouError("No kubeconfig given and cannot load the in-cluster K8S config", err.Error())
+		}
+
+		log.Infof("Using the in-cluster K8S config. K8S API server: %s", kconfig.Host)
+		return kconfig, nil
+	}
+
+	// uses the current context in kubeconfig
+	kconfig, err := clientcmd.BuildConfigFromFlags("", conf.KubeConfigFile)
+	if err != nil {
+		return nil, bambou.NewBambouError("Error parsing kubeconfig", err.Error())
+	}
+
+	log.Infof("Loaded Agent kubeconfig: %s ", conf.KubeConfigFile)
+	return kconfig, nil
+}
+
+func newClientset(conf *config.AgentConfig) (*kubernetes.Clientset, error) {
+	kconfig, err := RestConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	cs, err := kubernetes.NewForConfig(kconfig)
+	if err != nil {
+		return nil, bambou.NewBambouError("Error creating Kubernetes client", err.Error())
+	}
 
+	return cs, nil
+}
+
+// Fetch the data of the K8S ConfigMap with the network config ("k8s-master-configmap"). Called before "InitClient", e.g. to validate the configuration
+func MasterConfigMap(conf *config.AgentConfig) (map[string]string, error) {
+	parts := strings.Split(conf.MasterConfigMap, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, bambou.NewBambouError("Invalid K8S master ConfigMap: "+conf.MasterConfigMap, "Expecting: \"namespace/name\"")
+	}
+
+	cs, err := newClientset(conf)
+	if err != nil {
+		return nil, err
 	}
-	//Keep alive
-	glog.Error(http.ListenAndServe(":8099", nil))
+
+	cm, err := cs.Core().ConfigMaps(parts[0]).Get(parts[1], metav1.GetOptions{})
+	if err != nil {
+		return nil, bambou.NewBambouError("Cannot fetch K8S master ConfigMap: "+conf.MasterConfigMap, err.Error())
+	}
+
+	log.Infof("Loaded K8S master ConfigMap: %s", conf.MasterConfigMap)
+	return cm.Data, nil
 }
@@ -1,34 +1,40 @@
 package k8s
 
 import (
-	"github.com/golang/glog"
-	//
-
 	"github.com/FlorianOtel/go-bambou/bambou"
 	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
 	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
 )
 
 ////
 //// K8S Namespace <-> VSD Zone
-//// VSD object hierarcy: Zone -> Domain <== Handled at startup
-////  Convention: VSD Zone name = vsdclient.ZONE_NAME + ns.ObjectMeta.Name
+//// VSD object hierarcy: Zone -> Domain <== Handled at startup, or on demand for the tenant Domains (see vsd-client/tenants.go)
+////  Convention: VSD Zone name = vsdclient.ZoneName(ns.ObjectMeta.Name) ("zone" name template)
 
 func NamespaceCreated(ns *apiv1.Namespace) error {
+	log := objLog("create", "namespace", ns.ObjectMeta)
+
+	// The VSD Domain of the namespace
+	tenant, err := vsdclient.NamespaceTenant(ns.ObjectMeta.Name)
+	if err != nil {
+		return bambou.NewBambouError("Error creating K8S namespace: "+ns.ObjectMeta.Name, err.Error())
+	}
 
 	zone := new(vsdclient.Zone)
-	zone.Name = vsdclient.ZONE_NAME + ns.ObjectMeta.Name
+	zone.Name = vsdclient.ZoneName(ns.ObjectMeta.Name)
 
 	// Chceck if we still have a VSD zone with this name (cached from previous instances of the agent )
-	if err := zone.FetchByName(); err != nil {
+	if err := zone.FetchByName(tenant); err != nil {
 		return bambou.NewBambouError("Error creating K8S namespace: "+ns.ObjectMeta.Name, err.Error())
 	}
 
 	if zone.ID == "" { // Zone does not exist, create it
-		glog.Infof("Cannot find VSD Zone with name: %s, creating...", zone.Name)
-		if err := zone.Create(); err != nil {
+		log.Infof("Cannot find VSD Zone with name: %s in Domain: %s, creating...", zone.Name, tenant.Domain.Name)
+		if err := zone.Create(tenant); err != nil {
 			return err
 		}
+		log.WithField(logging.FieldVSDID, zone.ID).Infof("Namespace mapped to VSD Zone: %s", zone.Name)
 
 		////
 		//// Still TBD -- Insert logic here if this K8S namespace is created with e.g. custom subnets
@@ -39,35 +45,113 @@ func NamespaceCreated(ns *apiv1.Namespace) error {
 	// Get the list of Subnets (ranges + ipallocator's) for this zone (if any)
 	nssubnets, _ := zone.Subnets()
 
+	// Keep the IP addresses still in quarantine reserved
+	reserveQuarantined(nssubnets)
+
+	mode := namespaceIsolation(ns)
+
 	// Add it to the list of K8S namespaces
-	Namespaces[ns.ObjectMeta.Name] = namespace{zone, nssubnets}
+	namespacesMutex.Lock()
+	Namespaces[ns.ObjectMeta.Name] = namespace{zone, nssubnets, mode}
+	namespacesMutex.Unlock()
+
+	if err := namespaceSyncPEs(ns.ObjectMeta.Name, zone, mode); err != nil {
+		return err
+	}
+
+	if err := namespaceSyncEgressPEs(ns, zone, nil); err != nil {
+		return err
+	}
+
+	// Cross-namespace K8S services of the tenant are reachable from the new namespace
+	if err := tenantSyncCrossNSServices(tenant); err != nil {
+		return err
+	}
 
-	// glog.Info("=====> A namespace got created")
-	// JsonPrettyPrint("namespace", ns)
+	// log.Info("=====> A namespace got created")
+	// logObject("namespace", ns)
 
 	return nil
 
 }
 
 func NamespaceDeleted(ns *apiv1.Namespace) error {
+	log := objLog("delete", "namespace", ns.ObjectMeta)
+
+	// Remove it from the list of K8S namespaces, e.g. no longer a source of the cross-namespace K8S services (see "serviceSrcZones")
+	namespacesMutex.Lock()
+	delete(Namespaces, ns.ObjectMeta.Name)
+	namespacesMutex.Unlock()
+
+	// Remove the Policy Elements for the namespace isolation mode and the namespace egress rules
+	if tenant, err := vsdclient.NamespaceTenant(ns.ObjectMeta.Name); err != nil {
+		log.Errorf("Cannot find the VSD Domain of the namespace. Error: %s", err)
+	} else {
+		t := tenant.NewPolicyTransaction()
+		for _, pename := range tenant.IngressPENames(namespacePEPrefix(ns.ObjectMeta.Name)) {
+			t.DeleteIngressPE(pename)
+		}
+		for _, pename := range tenant.EgressPENames(egressPEPrefix(ns.ObjectMeta.Name)) {
+			t.DeleteEgressPE(pename)
+		}
+		if err := t.Commit(); err != nil {
+			log.Errorf("Cannot delete network Policy Elements. Error: %s", err)
+		}
+
+		// Remove the Policy Elements allowing traffic from the namespace to the cross-namespace K8S services of the tenant
+		if err := tenantSyncCrossNSServices(tenant); err != nil {
+			return err
+		}
+	}
+
 	//
 	// Insert logic here
 	//
 
-	glog.Info("=====> A namespace got deleted")
-	JsonPrettyPrint("namespace", ns)
+	log.Info("Namespace deleted")
+	logObject("namespace", ns)
 	return nil
 }
 
-// Still TBD if / when / how to use  -- stub so far
+// Apply isolation mode and egress rules changes live
 func NamespaceUpdated(old, updated *apiv1.Namespace) error {
-	//
-	// Insert logic here
-	//
-	return nil
+	log := objLog("update", "namespace", updated.ObjectMeta)
+
+	ns, exists := lookupNamespace(updated.ObjectMeta.Name)
+	if !exists { // Not processed (yet)
+		return nil
+	}
+
+	if egressChanged(old, updated) {
+		log.Info("Namespace egress rules changed")
+		if err := namespaceSyncEgressPEs(updated, ns.Zone, nil); err != nil {
+			return err
+		}
+	}
+
+	mode := namespaceIsolation(updated)
+	if mode == ns.Isolation {
+		return nil
+	}
+
+	log.Infof("Namespace isolation changed from: %s to: %s", ns.Isolation, mode)
+
+	if err := namespaceSyncPEs(updated.ObjectMeta.Name, ns.Zone, mode); err != nil {
+		return err
+	}
+
+	// Re-read under the lock: Only the isolation mode changes, e.g. not the Subnets added meanwhile (see pod.go: case3create)
+	namespacesMutex.Lock()
+	if ns, exists := Namespaces[updated.ObjectMeta.Name]; exists {
+		ns.Isolation = mode
+		Namespaces[updated.ObjectMeta.Name] = ns
+	}
+	namespacesMutex.Unlock()
+
+	// K8S services Policy Elements depend on the isolation mode
+	return namespaceSyncServices(updated.ObjectMeta.Name)
 }
 
-//
 func NamespaceNOP(ns *apiv1.Namespace) error {
 	select {}
 }
@@ -2,20 +2,19 @@ package k8s
 
 import (
 	apiv1beta1 "github.com/OpenPlatformSDN/client-go/pkg/apis/extensions/v1beta1"
-	"github.com/golang/glog"
 )
 
 // "github.com/OpenPlatformSDN/client-go/pkg/util/wait"
 
 func NetworkPolicyCreated(networkpolicy *apiv1beta1.NetworkPolicy) error {
-	glog.Info("=====> A networkpolicy got created")
-	JsonPrettyPrint("networkpolicy", networkpolicy)
+	objLog("create", "networkpolicy", networkpolicy.ObjectMeta).Info("NetworkPolicy created")
+	logObject("networkpolicy", networkpolicy)
 	return nil
 }
 
 func NetworkPolicyDeleted(networkpolicy *apiv1beta1.NetworkPolicy) error {
-	glog.Info("=====> A networkpolicy got deleted")
-	JsonPrettyPrint("networkpolicy", networkpolicy)
+	objLog("delete", "networkpolicy", networkpolicy.ObjectMeta).Info("NetworkPolicy deleted")
+	logObject("networkpolicy", networkpolicy)
 	return nil
 }
 
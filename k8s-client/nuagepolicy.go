@@ -0,0 +1,486 @@
+package k8s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/OpenPlatformSDN/client-go/kubernetes"
+	"github.com/OpenPlatformSDN/client-go/pkg/api"
+	"github.com/OpenPlatformSDN/client-go/pkg/api/errors"
+	"github.com/OpenPlatformSDN/client-go/pkg/api/meta"
+	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	apiv1beta1 "github.com/OpenPlatformSDN/client-go/pkg/apis/extensions/v1beta1"
+	metav1 "github.com/OpenPlatformSDN/client-go/pkg/apis/meta/v1"
+	"github.com/OpenPlatformSDN/client-go/pkg/runtime"
+	"github.com/OpenPlatformSDN/client-go/pkg/runtime/schema"
+	"github.com/OpenPlatformSDN/client-go/pkg/runtime/serializer"
+	"github.com/OpenPlatformSDN/client-go/pkg/watch/versioned"
+	"github.com/OpenPlatformSDN/client-go/rest"
+	"github.com/Sirupsen/logrus"
+	ghyaml "github.com/ghodss/yaml"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
+)
+
+////
+//// NuageNetworkPolicy custom resource (ThirdPartyResource) <-> VSD Policy (nuage-policy-framework)
+////
+//// The resource "spec" is a Nuage policy framework Policy, with the same schema as the YAML policy files -- e.g.:
+////
+////    apiVersion: nuage.io/v1
+////    kind: NuageNetworkPolicy
+////    metadata:
+////      name: allow-web
+////      namespace: default
+////    spec:
+////      policy-type: Ingress
+////      priority: 100000
+////      policy-elements:
+////      - name: Allow HTTP to namespace default
+////        priority: 100
+////        from: { source-type: Any }
+////        to: { destination-type: Zone, name: "K8S namespace default" }
+////        traffic-spec: { protocol: TCP, source-port-range: "*", destination-port-range: "80" }
+////        action: Allow
+////
+//// Conventions / XXX - Notes:
+//// - VSD Policy name = vsdclient.NuagePolicyName(<namespace>, <name>) ("nuage-policy" name template). The "name" in the spec is ignored
+//// - Policy Element priorities are offsets in the Nuage custom priority band (see vsd-client/priorities.go), e.g. priority 100 is applied as 100000099. Conflicts with other Policies are reported before applying
+//// - Policy Elements apply to the namespace of the resource only, as the custom band takes precedence over the isolation of the other namespaces (see "nnpCheckScopes"):
+////   "to" must be "MyZone" / "MySubnet" or the Zone / a Subnet of the namespace. Zone / Subnet / Policy Group / VPort tag sources ("from") must be in the namespace as well.
+////   Policy Groups are Domain wide, i.e. never in a namespace. The authorization rules may allow other namespaces explicitly ("policy-namespaces", see authz.go)
+//// - "kind", "version", "enterprise" and "domain" in the spec are optional. If given, they must match the Enterprise and Domain of the namespace (see vsd-client/tenants.go)
+//// - Spec changes are applied by deleting and re-applying the VSD Policy. If the updated spec fails to apply, the VSD Policy for the previous spec is restored
+//// - The apply status and errors are written back to the resource "status"
+//// - Policies are subject to per namespace authorization (see authz.go). Who may create the resources is up to K8S RBAC on "nuagenetworkpolicies"
+
+const (
+	nnpTPRName  = "nuage-network-policy.nuage.io" // ThirdPartyResource name. Maps to kind "NuageNetworkPolicy" in API group "nuage.io"
+	nnpGroup    = "nuage.io"
+	nnpVersion  = "v1"
+	nnpKind     = "NuageNetworkPolicy"
+	nnpResource = "nuagenetworkpolicies"
+
+	// Values for NuageNetworkPolicyStatus.State
+	nnpApplied = "Applied"
+	nnpFailed  = "Failed"
+)
+
+type NuageNetworkPolicy struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        apiv1.ObjectMeta         `json:"metadata"`
+	Spec            json.RawMessage          `json:"spec"`
+	Status          NuageNetworkPolicyStatus `json:"status,omitempty"`
+}
+
+type NuageNetworkPolicyStatus struct {
+	State     string `json:"state,omitempty"`     // "Applied" or "Failed"
+	Message   string `json:"message,omitempty"`   // Error details, if any
+	VSDPolicy string `json:"vsdPolicy,omitempty"` // The name of the VSD Policy
+}
+
+type NuageNetworkPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        metav1.ListMeta      `json:"metadata"`
+	Items           []NuageNetworkPolicy `json:"items"`
+}
+
+func (nnp *NuageNetworkPolicy) GetObjectKind() schema.ObjectKind {
+	return &nnp.TypeMeta
+}
+
+func (nnp *NuageNetworkPolicy) GetObjectMeta() meta.Object {
+	return &nnp.Metadata
+}
+
+func (nnpl *NuageNetworkPolicyList) GetObjectKind() schema.ObjectKind {
+	return &nnpl.TypeMeta
+}
+
+func (nnpl *NuageNetworkPolicyList) GetListMeta() metav1.List {
+	return &nnpl.Metadata
+}
+
+// XXX - Work around known problems with ThirdPartyResources and the "ugorji" JSON decoder: Decode using "encoding/json" instead
+type nuageNetworkPolicyCopy NuageNetworkPolicy
+type nuageNetworkPolicyListCopy NuageNetworkPolicyList
+
+func (nnp *NuageNetworkPolicy) UnmarshalJSON(data []byte) error {
+	tmp := nuageNetworkPolicyCopy{}
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	*nnp = NuageNetworkPolicy(tmp)
+	return nil
+}
+
+func (nnpl *NuageNetworkPolicyList) UnmarshalJSON(data []byte) error {
+	tmp := nuageNetworkPolicyListCopy{}
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	*nnpl = NuageNetworkPolicyList(tmp)
+	return nil
+}
+
+var (
+	// REST client for NuageNetworkPolicy resources. "nil" if the ThirdPartyResource is not available
+	nnpclient *rest.RESTClient
+)
+
+// Register the ThirdPartyResource (if needed) and create a REST client for it
+func initNuageNetworkPolicies(c *kubernetes.Clientset, config *rest.Config) error {
+	if _, err := c.Extensions().ThirdPartyResources().Get(nnpTPRName, metav1.GetOptions{}); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		tpr := &apiv1beta1.ThirdPartyResource{
+			ObjectMeta:  apiv1.ObjectMeta{Name: nnpTPRName},
+			Description: "Nuage VSP network policy, as per Nuage policy framework",
+			Versions:    []apiv1beta1.APIVersion{{Name: nnpVersion}},
+		}
+
+		if _, err := c.Extensions().ThirdPartyResources().Create(tpr); err != nil {
+			return err
+		}
+		log.Infof("Successfully created ThirdPartyResource: %s", nnpTPRName)
+	}
+
+	groupversion := schema.GroupVersion{Group: nnpGroup, Version: nnpVersion}
+
+	tprconfig := *config
+	tprconfig.GroupVersion = &groupversion
+	tprconfig.APIPath = "/apis"
+	tprconfig.ContentType = runtime.ContentTypeJSON
+	tprconfig.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: api.Codecs}
+
+	schemeBuilder := runtime.NewSchemeBuilder(
+		func(scheme *runtime.Scheme) error {
+			scheme.AddKnownTypes(groupversion, &NuageNetworkPolicy{}, &NuageNetworkPolicyList{}, &apiv1.ListOptions{}, &apiv1.DeleteOptions{})
+			return nil
+		})
+	versioned.AddToGroupVersion(api.Scheme, groupversion)
+	if err := schemeBuilder.AddToScheme(api.Scheme); err != nil {
+		return err
+	}
+
+	client, err := rest.RESTClientFor(&tprconfig)
+	if err != nil {
+		return err
+	}
+
+	nnpclient = client
+	return nil
+}
+
+func NuageNetworkPolicyCreated(nnp *NuageNetworkPolicy) error {
+	// Ensure that the Namespace is already created -- due event processing race conditions at startup, the resource creation event may be processed before namespace creation
+	if !waitForNamespace(nnp.Metadata.Namespace) {
+		return bambou.NewBambouError("Error applying NuageNetworkPolicy: "+nnp.Metadata.Name, "Timeout waiting for namespace "+nnp.Metadata.Namespace+" to be created")
+	}
+
+	if err := authorizeNuageNetworkPolicy(nnp); err != nil {
+		nnpSetStatus(nnp, nnpFailed, err.Error())
+		return err
+	}
+
+	p, err := nnpPolicy(nnp)
+	if err != nil {
+		nnpSetStatus(nnp, nnpFailed, err.Error())
+		// XXX - After agent restarts, e.g. applied by an earlier version without the namespace checks (see "nnpCheckScopes"). Do not keep enforcing it
+		if derr := NuageNetworkPolicyDeleted(nnp); derr != nil {
+			objLog("create", "nuagenetworkpolicy", nnp.Metadata).Errorf("Cannot delete the VSD Policy of the invalid resource. Error: %s", derr)
+		}
+		return err
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(nnp.Metadata.Namespace)
+	if err != nil {
+		nnpSetStatus(nnp, nnpFailed, err.Error())
+		return bambou.NewBambouError("Error applying NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	// XXX - After agent restarts the Policy may be already applied
+	if nnp.Status.State == nnpApplied && tenant.HasPolicy(p) {
+		objLog("create", "nuagenetworkpolicy", nnp.Metadata).Infof("Already applied as VSD Policy: %s", p.Name)
+		return nil
+	}
+
+	return nnpApply(nnp, p)
+}
+
+func NuageNetworkPolicyDeleted(nnp *NuageNetworkPolicy) error {
+	p := new(netpolicy.Policy)
+
+	// Nothing was applied for an invalid Policy Type
+	if err := nnpSpec(nnp, p); err != nil {
+		return nil
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(nnp.Metadata.Namespace)
+	if err != nil {
+		return bambou.NewBambouError("Error deleting NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	// XXX - Only the Name and Type identify the VSD Policy. Discard the rest of the spec (may be invalid)
+	p.Kind = netpolicy.NuageACLPolicy
+	p.Version = netpolicy.CurrentVersion
+	p.Name = nnpPolicyName(nnp)
+	p.Enterprise = tenant.Enterprise.Name
+	p.Domain = tenant.Domain.Name
+	p.Priority = 1
+	p.PolicyElements = nil
+
+	if err := tenant.DeletePolicy(p); err != nil {
+		return bambou.NewBambouError("Error deleting NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	return nil
+}
+
+func NuageNetworkPolicyUpdated(old, updated *NuageNetworkPolicy) error {
+	// XXX - Status updates (incl. our own) and periodic re-syncs do not change the spec
+	if bytes.Equal(old.Spec, updated.Spec) {
+		return nil
+	}
+
+	if err := authorizeNuageNetworkPolicy(updated); err != nil {
+		nnpSetStatus(updated, nnpFailed, err.Error())
+		return err
+	}
+
+	p, err := nnpPolicy(updated)
+	if err != nil {
+		nnpSetStatus(updated, nnpFailed, err.Error())
+		return err
+	}
+
+	if err := NuageNetworkPolicyDeleted(old); err != nil {
+		nnpSetStatus(updated, nnpFailed, err.Error())
+		return err
+	}
+
+	if err := nnpApply(updated, p); err != nil {
+		// Keep enforcing the previous spec -- rather than no Policy at all -- until the updated one can be applied
+		if rerr := nnpRestore(old); rerr != nil {
+			objLog("update", "nuagenetworkpolicy", updated.Metadata).Errorf("Cannot restore the VSD Policy for the previous spec. Error: %s", rerr)
+		} else {
+			nnpSetStatus(updated, nnpFailed, err.Error()+" . The previous spec is still applied")
+		}
+		return err
+	}
+
+	return nil
+}
+
+///// Auxilary functions
+
+func nnpPolicyName(nnp *NuageNetworkPolicy) string {
+	return vsdclient.NuagePolicyName(nnp.Metadata.Namespace, nnp.Metadata.Name)
+}
+
+// Decode the resource spec (JSON) into a Policy, using the Policy YAML schema
+func nnpSpec(nnp *NuageNetworkPolicy, p *netpolicy.Policy) error {
+	data, err := ghyaml.JSONToYAML(nnp.Spec)
+	if err != nil {
+		return err
+	}
+
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return err
+	}
+
+	if _, valid := netpolicy.VSDPolicyTypes[p.Type]; !valid {
+		return bambou.NewBambouError(netpolicy.ErrorPolicyInvalid+p.Name, "Invalid Policy Type: "+string(p.Type))
+	}
+
+	return nil
+}
+
+// The VSD Policy for a NuageNetworkPolicy resource, in the Domain of the tenant of its namespace. The Policy and its Policy Elements are validated by the policy framework
+func nnpPolicy(nnp *NuageNetworkPolicy) (*netpolicy.Policy, error) {
+	tenant, err := vsdclient.NamespaceTenant(nnp.Metadata.Namespace)
+	if err != nil {
+		return nil, bambou.NewBambouError("Error processing NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	spec := new(netpolicy.Policy)
+
+	if err := nnpSpec(nnp, spec); err != nil {
+		return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	switch {
+	case spec.Kind != "" && spec.Kind != netpolicy.NuageACLPolicy:
+		return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, "Invalid Policy Kind: "+string(spec.Kind))
+	case spec.Version != "" && spec.Version != netpolicy.CurrentVersion:
+		return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, "Invalid Policy Version: "+string(spec.Version))
+	case spec.Enterprise != "" && spec.Enterprise != tenant.Enterprise.Name:
+		return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, "Policy Enterprise must be: "+tenant.Enterprise.Name)
+	case spec.Domain != "" && spec.Domain != tenant.Domain.Name:
+		return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, "Policy Domain must be: "+tenant.Domain.Name)
+	case len(spec.PolicyElements) == 0:
+		return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, "Policy does not have any Policy Elements")
+	}
+
+	p, err := netpolicy.NewPolicy(nnpPolicyName(nnp), spec.Type, tenant.Enterprise.Name, tenant.Domain.Name, spec.Priority)
+	if err != nil {
+		return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	if err := nnpCheckScopes(nnp, spec.PolicyElements); err != nil {
+		return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	for i := range spec.PolicyElements {
+		pe := spec.PolicyElements[i]
+		if pe.Priority, err = vsdclient.CustomBand.At(pe.Priority); err != nil {
+			return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, "Policy Element: "+pe.Name+" : "+err.Error())
+		}
+		if err := p.AttachPE(&pe); err != nil {
+			return nil, bambou.NewBambouError("Invalid NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+		}
+	}
+
+	return p, nil
+}
+
+// Check that the Policy Elements of a NuageNetworkPolicy resource only apply to the namespace of the resource: Traffic to ("to") the namespace, from Zone / Subnet sources ("from") in the namespace.
+// Or in the other namespaces allowed by the authorization rules
+func nnpCheckScopes(nnp *NuageNetworkPolicy, pes []netpolicy.PolicyElement) error {
+	if _, exists := lookupNamespace(nnp.Metadata.Namespace); !exists {
+		return fmt.Errorf("Cannot find namespace %s", nnp.Metadata.Namespace)
+	}
+
+	nsnames := append([]string{nnp.Metadata.Namespace}, authzPolicyNamespaces(nnp.Metadata.Namespace)...)
+
+	// Same names for the "L" and "N" scopes, e.g. "Zone"
+	inNamespace := func(stype string, name *string) bool {
+		if name == nil || (stype != string(netpolicy.NZone) && stype != string(netpolicy.NSubnet)) {
+			return false
+		}
+		for _, nsname := range nsnames {
+			if nsname == "*" {
+				return true
+			}
+			ns, exists := lookupNamespace(nsname)
+			if !exists {
+				continue
+			}
+			if stype == string(netpolicy.NZone) && *name == ns.Zone.Name {
+				return true
+			}
+			for _, subnet := range ns.Subnets {
+				if stype == string(netpolicy.NSubnet) && subnet.Subnet.Name == *name {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, pe := range pes {
+		switch pe.To.Type {
+		case string(netpolicy.MyZone), string(netpolicy.MySubnet):
+		default:
+			if !inNamespace(pe.To.Type, pe.To.Name) {
+				return fmt.Errorf("Policy Element: %s : \"to\" must be %s, %s or the Zone / a Subnet of namespace(s): %s", pe.Name, netpolicy.MyZone, netpolicy.MySubnet, strings.Join(nsnames, ", "))
+			}
+		}
+
+		switch pe.From.Type {
+		case string(netpolicy.LZone), string(netpolicy.LSubnet), string(netpolicy.LPolicyGroup), string(netpolicy.LVPortTag):
+			if !inNamespace(pe.From.Type, pe.From.Name) {
+				return fmt.Errorf("Policy Element: %s : %s source (\"from\") not in namespace(s): %s", pe.Name, pe.From.Type, strings.Join(nsnames, ", "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Apply the VSD Policy for a NuageNetworkPolicy resource, replacing any previous Policy with the same name
+func nnpApply(nnp *NuageNetworkPolicy, p *netpolicy.Policy) error {
+	log := logging.With(objLog("apply", "nuagenetworkpolicy", nnp.Metadata), logrus.Fields{logging.FieldVSDName: p.Name})
+
+	tenant, err := vsdclient.NamespaceTenant(nnp.Metadata.Namespace)
+	if err != nil {
+		nnpSetStatus(nnp, nnpFailed, err.Error())
+		return bambou.NewBambouError("Error applying NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	stale := *p
+	if err := tenant.DeletePolicy(&stale); err != nil {
+		nnpSetStatus(nnp, nnpFailed, err.Error())
+		return bambou.NewBambouError("Error applying NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	// Report shadowed / overlapping Policy Elements, within the Policy and with the other Policies of the Domain. Those are not fatal
+	conflicts, err := tenant.PolicyConflicts(p)
+	if err != nil {
+		log.Warningf("Cannot check the Policy Elements for conflicts. Error: %s", err)
+	}
+	for _, conflict := range conflicts {
+		log.Warningf("Conflict: %s", conflict)
+	}
+
+	if err := tenant.ApplyPolicy(p); err != nil {
+		nnpSetStatus(nnp, nnpFailed, err.Error())
+		return bambou.NewBambouError("Error applying NuageNetworkPolicy: "+nnp.Metadata.Name, err.Error())
+	}
+
+	log.Info("Applied as VSD Policy")
+	nnpSetStatus(nnp, nnpApplied, "")
+	return nil
+}
+
+// Re-apply the VSD Policy for the previous spec of a NuageNetworkPolicy resource, after the updated spec failed to apply
+func nnpRestore(old *NuageNetworkPolicy) error {
+	// Nothing was applied for an unauthorized or invalid previous spec
+	if err := authorizeNuageNetworkPolicy(old); err != nil {
+		return nil
+	}
+	p, err := nnpPolicy(old)
+	if err != nil {
+		return nil
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(old.Metadata.Namespace)
+	if err != nil {
+		return err
+	}
+
+	if err := tenant.ApplyPolicy(p); err != nil {
+		return err
+	}
+
+	objLog("restore", "nuagenetworkpolicy", old.Metadata).Infof("Restored VSD Policy: %s for the previous spec", p.Name)
+	return nil
+}
+
+// Write the apply status back to the resource. Errors are only logged
+func nnpSetStatus(nnp *NuageNetworkPolicy, state, message string) {
+	if nnpclient == nil {
+		return
+	}
+
+	updated := *nnp
+	updated.APIVersion = nnpGroup + "/" + nnpVersion
+	updated.Kind = nnpKind
+	updated.Status = NuageNetworkPolicyStatus{
+		State:     state,
+		Message:   message,
+		VSDPolicy: nnpPolicyName(nnp),
+	}
+
+	if err := nnpclient.Put().Namespace(nnp.Metadata.Namespace).Resource(nnpResource).Name(nnp.Metadata.Name).Body(&updated).Do().Error(); err != nil {
+		objLog("set-status", "nuagenetworkpolicy", nnp.Metadata).Errorf("Cannot update the status. Error: %s", err)
+	}
+}
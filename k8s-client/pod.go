@@ -4,13 +4,12 @@ import (
 	"fmt"
 	"net"
 	"strings"
-	"time"
 
 	cniagent "github.com/OpenPlatformSDN/cni-plugin/nuage-cni-agent/client"
 
 	cniclient "github.com/OpenPlatformSDN/nuage-k8s-cni/cni-agent-client"
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
 	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
-	"github.com/golang/glog"
 	"k8s.io/kubernetes/pkg/registry/core/service/ipallocator"
 
 	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
@@ -31,25 +30,11 @@ func PodCreated(pod *apiv1.Pod) error {
 
 	// Ensure that the pod Namespace is already created -- due event processing race conditions at startup, pod creation event may be processed before namespace creation
 	// XXX -- The name is the VSD Zone name (different from the K8s namespace name itself)
-	if _, exists := Namespaces[pod.ObjectMeta.Namespace]; !exists {
-		// Wait for a max 10 seconds, probing local cache
-		timeChan := time.NewTimer(time.Second * 10).C
-		tickChan := time.NewTicker(time.Millisecond * 100).C
-
-		for {
-			select {
-			case <-timeChan:
-				return bambou.NewBambouError("Error creating K8S Pod: "+pod.ObjectMeta.Name, "Timeout waiting for namespace "+pod.ObjectMeta.Namespace+" to be created")
-			case <-tickChan:
-				if _, found := Namespaces[pod.ObjectMeta.Namespace]; !found {
-					continue
-				}
-			}
-			break
-		}
+	if !waitForNamespace(pod.ObjectMeta.Namespace) {
+		return bambou.NewBambouError("Error creating K8S Pod: "+pod.ObjectMeta.Name, "Timeout waiting for namespace "+pod.ObjectMeta.Namespace+" to be created")
 	}
 
-	// XXX -- at this point "Namespaces[pod.ObjectMeta.Namespace]" points to a valid "namespace"
+	// XXX -- at this point "Namespaces[pod.ObjectMeta.Namespace]" points to a valid "namespace" (unless deleted meanwhile, see "lookupNamespace")
 
 	/////
 	///// Get pod networking details.
@@ -62,6 +47,11 @@ func PodCreated(pod *apiv1.Pod) error {
 		}
 	}
 
+	// Custom network settings are subject to service account based authorization. Reject the pod if not allowed
+	if err := authorizePod(pod, nuageLabels(pod)); err != nil {
+		return err
+	}
+
 	//
 	// Case 2: Custom settings pod -- custom network settings (custom subnet / ip addr) etc -- via "nuage.io" labels
 	//
@@ -84,25 +74,30 @@ func PodCreated(pod *apiv1.Pod) error {
 }
 
 func PodDeleted(pod *apiv1.Pod) error {
+	log := podLog("delete", pod)
+
 	// Do _NOT_ change those conventions -- the CNI agent relies on them.
 
 	container := new(vsdclient.Container)
 
 	// Container Name
-	container.Name = pod.ObjectMeta.Name + "_" + pod.ObjectMeta.Namespace
+	container.Name = vsdclient.ContainerName(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
 	// Container UUID
 	container.UUID = strings.Replace(string(pod.ObjectMeta.UID), "-", "", -1) + strings.Replace(string(pod.ObjectMeta.UID), "-", "", -1)
 
 	// XXX - Since the bottom part of the plugin removes the VRS entity, the container may or may not be in the VSD at this time
 	// As such we pick up the container from the CNI Agent server running on pod's node
 
-	if c, err := cniagent.ContainerGET(cniclient.AgentClient, pod.Spec.NodeName, cniclient.AgentServerPort, container.Name); err != nil {
-		glog.Errorf("Deleting K8S Pod: %s . Cannot fecth container: %s from CNI Agent server on host: %s. Error: %s", pod.ObjectMeta.Name, container.Name, pod.Spec.NodeName, err.Error())
+	agentclient, agentport := cniclient.Agent()
+	if c, err := cniagent.ContainerGET(agentclient, pod.Spec.NodeName, agentport, container.Name); err != nil {
+		log.Errorf("Cannot fetch VSD Container: %s from the CNI Agent server. Error: %s", container.Name, err.Error())
 		////
 		//// XXX -- Fail-back VSD state cleanup for the cases when the K8S node and/or CNI Agent server has gone MIA.
 
-		glog.Errorf("Deleting K8S Pod: %s . Attempting to clean up any VSD constructs left...", pod.ObjectMeta.Name)
-		container.FetchByName() // Ignore any errors
+		log.Error("Attempting to clean up any VSD constructs left...")
+		if tenant, err := vsdclient.NamespaceTenant(pod.ObjectMeta.Namespace); err == nil {
+			container.FetchByName(tenant) // Ignore any errors
+		}
 		if container.ID != "" { // Container was still in the VSD. Delete it, and handle local IPAM below
 			container.Delete()
 
@@ -124,15 +119,16 @@ func PodDeleted(pod *apiv1.Pod) error {
 	// Get the subnet address for this IP address, as a string
 	sprefix := cifaddr.Mask(net.IPMask(net.ParseIP(cIPv4Mask).To4())).String()
 
-	// Find the subnet in pod's Namespace where this pod was located, and release its IP address from that subnet
+	// Find the subnet in pod's Namespace where this pod was located, and release its IP address from that subnet (after the quarantine period, if any)
 
 	// found := false
-	for _, subnet := range Namespaces[pod.ObjectMeta.Namespace].Subnets {
+	podNs, _ := lookupNamespace(pod.ObjectMeta.Namespace) // No subnets left for a deleted namespace
+	for _, subnet := range podNs.Subnets {
 		if sprefix == subnet.Subnet.Address {
-			if err := subnet.Range.Release(cifaddr); err != nil {
-				glog.Errorf("Deleting K8S pod: %s. Failed to deallocate pod's IP address: %s from Subnet: %s . Error: %s", pod.ObjectMeta.Name, cIPv4Addr, subnet.Subnet.Name, err)
+			if err := quarantineIP(subnet, cifaddr); err != nil {
+				log.Errorf("Failed to deallocate the pod IP address: %s from Subnet: %s . Error: %s", cIPv4Addr, subnet.Subnet.Name, err)
 			} else {
-				glog.Infof("Deleting K8S pod: %s. Deallocated pod's IP address: %s from Subnet: %s", pod.ObjectMeta.Name, cIPv4Addr, subnet.Subnet.Name)
+				log.Infof("Deallocated the pod IP address: %s from Subnet: %s", cIPv4Addr, subnet.Subnet.Name)
 				// found = true
 				break
 			}
@@ -142,27 +138,28 @@ func PodDeleted(pod *apiv1.Pod) error {
 	// Uncomment this if ip address deallocation has issues
 	/*
 		if !found {
-			glog.Errorf("---> Error deleting K8S pod: %s. Failed to deallocate pod's IP address: %s from prefix: %s. Subnet not found..", pod.ObjectMeta.Name, cIPv4Addr, sprefix)
+			log.Errorf("---> Error deleting K8S pod: %s. Failed to deallocate pod's IP address: %s from prefix: %s. Subnet not found..", pod.ObjectMeta.Name, cIPv4Addr, sprefix)
 			for _, s := range Namespaces.nscache[pod.ObjectMeta.Namespace].Subnets {
-				glog.Errorf("---> Namespace subnet: Name: %s . Address: %s . Customed: %v", s.Subnet.Name, s.Subnet.Address, s.Customed)
+				log.Errorf("---> Namespace subnet: Name: %s . Address: %s . Customed: %v", s.Subnet.Name, s.Subnet.Address, s.Customed)
 			}
 		}
 	*/
 
 	// Remove Nuage container from agent server container cache -- ignore any errors
-	cniagent.ContainerDELETE(cniclient.AgentClient, pod.Spec.NodeName, cniclient.AgentServerPort, container.Name)
+	cniagent.ContainerDELETE(agentclient, pod.Spec.NodeName, agentport, container.Name)
 
 	// Container is deleted from the VSD by the CNI plugin on the node or the vsd cleanup logic
 	return nil
 }
 
 func PodUpdated(old, updated *apiv1.Pod) error {
+	log := podLog("update", updated)
 
 	// Do _NOT_ change those conventions -- the CNI agent relies on them.
 	// XXX  -- Use orginal (i.e. "old" pod) values
 
 	// Container Name
-	cName := old.ObjectMeta.Name + "_" + old.ObjectMeta.Namespace
+	cName := vsdclient.ContainerName(old.ObjectMeta.Namespace, old.ObjectMeta.Name)
 	// Container UUID
 	// cUUID = strings.Replace(string(old.ObjectMeta.UID), "-", "", -1) + strings.Replace(string(old.ObjectMeta.UID), "-", "", -1)
 
@@ -173,20 +170,22 @@ func PodUpdated(old, updated *apiv1.Pod) error {
 	if (old.Spec.NodeName == "") && (updated.Spec.NodeName != "") {
 		if container, exists := Pods[cName]; exists { // This pod is in the "Pods" cache, submitted at creation
 			// Post it to the CNI Agent server on the scheduled node and remove it from the cache
-			glog.Infof("K8S pod: %s. Scheduled to run on host: %s. Notifying CNI Agent server on that node...", old.ObjectMeta.Name, updated.Spec.NodeName)
-			if err := cniagent.ContainerPUT(cniclient.AgentClient, updated.Spec.NodeName, cniclient.AgentServerPort, (*vspk.Container)(container)); err != nil {
-				glog.Errorf("Updating K8S pod: %s. Failed to submit VSD container: %s to CNI Agent server on host: %s . Error: %s", old.ObjectMeta.Name, cName, updated.Spec.NodeName, err)
+			log = log.WithField(logging.FieldVSDID, container.ID)
+			log.Info("Pod scheduled. Notifying the CNI Agent server on its node...")
+			agentclient, agentport := cniclient.Agent()
+			if err := cniagent.ContainerPUT(agentclient, updated.Spec.NodeName, agentport, (*vspk.Container)(container)); err != nil {
+				log.Errorf("Failed to submit VSD Container: %s to the CNI Agent server. Error: %s", cName, err)
 				return err
 			}
 			delete(Pods, cName)
 		}
 	}
 
-	// glog.Info("=====> A pod got UPDATED")
-	// glog.Info("=====> Old pod:")
-	// JsonPrettyPrint("pod", old)
-	// glog.Info("=====> Updated pod:")
-	// JsonPrettyPrint("pod", updated)
+	// log.Info("=====> A pod got UPDATED")
+	// log.Info("=====> Old pod:")
+	// logObject("pod", old)
+	// log.Info("=====> Updated pod:")
+	// logObject("pod", updated)
 	return nil
 }
 
@@ -196,15 +195,21 @@ func PodUpdated(old, updated *apiv1.Pod) error {
 
 // Case 1: Pod already has a VSD container associated with it (agent startup, previously existing pod)
 func case1create(pod *apiv1.Pod) (*vsdclient.Container, error) {
+	log := podLog("create", pod)
 	container := new(vsdclient.Container)
 
 	// Do _NOT_ change those conventions -- the CNI agent relies on them.
 	// Container Name
-	container.Name = pod.ObjectMeta.Name + "_" + pod.ObjectMeta.Namespace
+	container.Name = vsdclient.ContainerName(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
 	// Container UUID
 	container.UUID = strings.Replace(string(pod.ObjectMeta.UID), "-", "", -1) + strings.Replace(string(pod.ObjectMeta.UID), "-", "", -1)
 
-	if err := container.FetchByName(); err != nil {
+	tenant, err := vsdclient.NamespaceTenant(pod.ObjectMeta.Namespace)
+	if err != nil {
+		return nil, bambou.NewBambouError("Error creating K8S Pod: "+pod.ObjectMeta.Name, err.Error())
+	}
+
+	if err := container.FetchByName(tenant); err != nil {
 		return nil, bambou.NewBambouError("Error creating K8S Pod: "+pod.ObjectMeta.Name, err.Error())
 	}
 
@@ -212,11 +217,13 @@ func case1create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 		cIPv4Addr, cIPv4Mask := container.IPandMask()
 		// XXX - No need to handle IPAM here. The container interface was allocated when we parsed the corresponding Subnet
 		cifaddr := net.IPNet{net.ParseIP(cIPv4Addr).To4(), net.IPMask(net.ParseIP(cIPv4Mask).To4())}
-		glog.Infof("Creating K8S pod: %s already created. VSD container details: Name: %s . UUID: %s . IP address: %s", pod.ObjectMeta.Name, container.Name, container.UUID, cifaddr.String())
+		log = log.WithField(logging.FieldVSDID, container.ID)
+		log.Infof("Pod already created. VSD Container: %s . UUID: %s . IP address: %s", container.Name, container.UUID, cifaddr.String())
 
 		// XXX - At startup previously existing pods have a valid "pod.Spec.NodeName", so this error checking is a bit overkill
-		if err := cniagent.ContainerPUT(cniclient.AgentClient, pod.Spec.NodeName, cniclient.AgentServerPort, (*vspk.Container)(container)); err == nil {
-			glog.Infof("Creating K8S pod: %s . Successfully submitted VSD container: %s to CNI Agent server on host: %s", pod.ObjectMeta.Name, container.Name, pod.Spec.NodeName)
+		agentclient, agentport := cniclient.Agent()
+		if err := cniagent.ContainerPUT(agentclient, pod.Spec.NodeName, agentport, (*vspk.Container)(container)); err == nil {
+			log.Infof("Successfully submitted VSD Container: %s to the CNI Agent server", container.Name)
 		}
 
 		return container, nil
@@ -225,7 +232,6 @@ func case1create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 	return nil, nil
 }
 
-//
 // Case 2: Custom settings pod -- custom network settings (custom subnet / ip addr) etc -- via "nuage.io" labels
 //
 // Examples:
@@ -234,38 +240,28 @@ func case1create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 // "nuage.io/PolicyGroup=<pg>"
 // .....
 func case2create(pod *apiv1.Pod) (*vsdclient.Container, error) {
+	log := podLog("create", pod)
 	container := new(vsdclient.Container)
 	// Do _NOT_ change those conventions -- the CNI agent relies on them.
 	// Container Name
-	container.Name = pod.ObjectMeta.Name + "_" + pod.ObjectMeta.Namespace
+	container.Name = vsdclient.ContainerName(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
 	// Container UUID
 	container.UUID = strings.Replace(string(pod.ObjectMeta.UID), "-", "", -1) + strings.Replace(string(pod.ObjectMeta.UID), "-", "", -1)
 	// XXX - Above we made sure this is not nil (VSD Zone is created)
-	podNsZone := Namespaces[pod.ObjectMeta.Namespace]
-
-	// Check if we got any custom labels.
-
-	if len(pod.ObjectMeta.Labels) == 0 {
-		return nil, nil
+	podNsZone, exists := lookupNamespace(pod.ObjectMeta.Namespace)
+	if !exists {
+		return nil, bambou.NewBambouError("Error creating K8S Pod: "+pod.ObjectMeta.Name, "Cannot find namespace "+pod.ObjectMeta.Namespace)
 	}
 
 	// K-V pairs of of "nuage.io" settings
-	nuageio := make(map[string]string)
-
-	for label, value := range pod.ObjectMeta.Labels {
-		key := strings.SplitAfterN(label, "nuage.io/", 2) // e.g. "nuage.io/Subnet"
-		if (len(key) == 2) && (key[1] != "") {
-			nuageio[key[1]] = value // nuageio["Subnet"] = <value>
-		}
-
-	}
+	nuageio := nuageLabels(pod)
 
-	// We got custom labels but none was of interest
+	// We got no custom labels, or none was of interest
 	if len(nuageio) == 0 {
 		return nil, nil
 	}
 
-	glog.Infof("Creating K8S pod: %s . Custom Nuage labels identified: %v", pod.ObjectMeta.Name, nuageio)
+	log.Infof("Custom Nuage labels identified: %v", nuageio)
 
 	// Label parsing logic
 
@@ -301,7 +297,7 @@ func case2create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 	// Sanity checking
 	if csubnet == nil { // Custom address given but no subnet information
 		err := fmt.Errorf("Creating K8S pod: %s . No matching custom subnet name found", pod.ObjectMeta.Name)
-		glog.Error(err)
+		log.Error(err)
 		return nil, err
 	}
 
@@ -309,7 +305,7 @@ func case2create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 	if cifaddr == nil {
 		if allocd, err := csubnet.Range.AllocateNext(); err != nil { // Cannot allocate an IP address on this subnet
 			err = fmt.Errorf("Creating K8S pod: %s . Cannot allocate an IPv4 Address on Subnet: %s . Error: %s", pod.ObjectMeta.Name, csubnet.Subnet.Name, err)
-			glog.Error(err)
+			log.Error(err)
 			return nil, err
 		} else {
 			// Successfully allocated an ip adress on this subnet. Save it.
@@ -318,12 +314,12 @@ func case2create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 	} else { // Custom IP address given, try to allocate it.
 		if err := csubnet.Range.Allocate(*cifaddr); err != nil { // Cannot allocate this IP address
 			err = fmt.Errorf("Creating K8S pod: %s . Cannot allocate given IPv4 Address: %s on Subnet: %s . Error: %s", pod.ObjectMeta.Name, cifaddr.String(), csubnet.Subnet.Name, err)
-			glog.Error(err)
+			log.Error(err)
 			return nil, err
 		}
 	}
 
-	glog.Infof("Creating K8S pod: %s . Successfully allocated IP address: %s on custom Subnet: %s", pod.ObjectMeta.Name, cifaddr.String(), csubnet.Subnet.Name)
+	log.Infof("Successfully allocated IP address: %s on custom Subnet: %s", cifaddr.String(), csubnet.Subnet.Name)
 
 	// Create Nuage ContainerInterface with given address and Nuage Container
 	containerif := new(vspk.ContainerInterface)
@@ -345,12 +341,14 @@ func case2create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 		csubnet.Range.Release(*cifaddr)
 		return nil, bambou.NewBambouError("Error creating K8S Pod: "+pod.ObjectMeta.Name, err.Error())
 	}
+	log = log.WithField(logging.FieldVSDID, container.ID)
 
 	// XXX - For new pods, we do not know the pod node at creation time (empty). If so, just add it to the "Pods" cache of running pods
 	if pod.Spec.NodeName != "" { // Previously created pod, already scheduled on a node
-		err := cniagent.ContainerPUT(cniclient.AgentClient, pod.Spec.NodeName, cniclient.AgentServerPort, (*vspk.Container)(container))
+		agentclient, agentport := cniclient.Agent()
+		err := cniagent.ContainerPUT(agentclient, pod.Spec.NodeName, agentport, (*vspk.Container)(container))
 		if err != nil {
-			glog.Errorf("Creating K8S pod: %s. Failed to submit VSD container: %s to CNI Agent server on host: %s . Error: %s", pod.ObjectMeta.Name, container.Name, pod.Spec.NodeName, err)
+			log.Errorf("Failed to submit VSD Container: %s to the CNI Agent server. Error: %s", container.Name, err)
 		}
 		return nil, err
 	}
@@ -362,19 +360,38 @@ func case2create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 
 }
 
+// K-V pairs of "nuage.io" pod labels, with the "nuage.io/" prefix removed -- e.g. nuageio["Subnet"] = <value>
+func nuageLabels(pod *apiv1.Pod) map[string]string {
+	nuageio := make(map[string]string)
+
+	for label, value := range pod.ObjectMeta.Labels {
+		key := strings.SplitAfterN(label, "nuage.io/", 2) // e.g. "nuage.io/Subnet"
+		if (len(key) == 2) && (key[1] != "") {
+			nuageio[key[1]] = value // nuageio["Subnet"] = <value>
+		}
+
+	}
+
+	return nuageio
+}
+
 // Case 3: "Normal" pod --  Allocate an IP address from a non-custom subnet (subnet from ClusterCIDR address space).
 // Allocate a non-custom subnet if none exists previously  / no free IP address are available in any of previously exsting non-custom subnets
 func case3create(pod *apiv1.Pod) (*vsdclient.Container, error) {
+	log := podLog("create", pod)
 	container := new(vsdclient.Container)
 
 	// Do _NOT_ change those conventions -- the CNI agent relies on them.
 	// Container Name
-	container.Name = pod.ObjectMeta.Name + "_" + pod.ObjectMeta.Namespace
+	container.Name = vsdclient.ContainerName(pod.ObjectMeta.Namespace, pod.ObjectMeta.Name)
 	// Container UUID
 	container.UUID = strings.Replace(string(pod.ObjectMeta.UID), "-", "", -1) + strings.Replace(string(pod.ObjectMeta.UID), "-", "", -1)
 
 	// XXX - Above we made sure this is not nil (VSD Zone is created)
-	podNsZone := Namespaces[pod.ObjectMeta.Namespace]
+	podNsZone, exists := lookupNamespace(pod.ObjectMeta.Namespace)
+	if !exists {
+		return nil, bambou.NewBambouError("Error creating K8S Pod: "+pod.ObjectMeta.Name, "Cannot find namespace "+pod.ObjectMeta.Namespace)
+	}
 
 	// Container interface IP address
 	var cifaddr *net.IP
@@ -428,18 +445,20 @@ func case3create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 				// Save this as pod's subnet
 				csubnet = &newsubnet
 
-				// Append it to this of Subnets for pod's namespace
-				podNsZone.Subnets = append(podNsZone.Subnets, newsubnet)
-
-				// Update the Namespace information
-				Namespaces[pod.ObjectMeta.Namespace] = podNsZone
+				// Append it to the list of Subnets for pod's namespace. Re-read under the lock: Only the Subnets change, e.g. not the isolation mode changed meanwhile (see "NamespaceUpdated")
+				namespacesMutex.Lock()
+				if ns, exists := Namespaces[pod.ObjectMeta.Namespace]; exists {
+					ns.Subnets = append(ns.Subnets, newsubnet)
+					Namespaces[pod.ObjectMeta.Namespace] = ns
+				}
+				namespacesMutex.Unlock()
 
 				break
 			}
 		}
 	}
 
-	glog.Infof("Creating K8S pod: %s . Successfully allocated IP address: %s on Subnet: %s", pod.ObjectMeta.Name, cifaddr.String(), csubnet.Subnet.Name)
+	log.Infof("Successfully allocated IP address: %s on Subnet: %s", cifaddr.String(), csubnet.Subnet.Name)
 
 	// Create Nuage ContainerInterface with given address and Nuage Container
 	containerif := new(vspk.ContainerInterface)
@@ -461,13 +480,15 @@ func case3create(pod *apiv1.Pod) (*vsdclient.Container, error) {
 		csubnet.Range.Release(*cifaddr)
 		return nil, bambou.NewBambouError("Error creating K8S Pod: "+pod.ObjectMeta.Name, err.Error())
 	}
+	log = log.WithField(logging.FieldVSDID, container.ID)
 
 	// XXX - For new pods, we do not know the pod node at creation time (empty). If so, just add it to the "Pods" cache of running pods
 
 	if pod.Spec.NodeName != "" { // Previously created pod, already scheduled on a node
-		err := cniagent.ContainerPUT(cniclient.AgentClient, pod.Spec.NodeName, cniclient.AgentServerPort, (*vspk.Container)(container))
+		agentclient, agentport := cniclient.Agent()
+		err := cniagent.ContainerPUT(agentclient, pod.Spec.NodeName, agentport, (*vspk.Container)(container))
 		if err != nil {
-			glog.Errorf("Creating K8S pod: %s. Failed to submit VSD container: %s to CNI Agent server on host: %s . Error: %s", pod.ObjectMeta.Name, container.Name, pod.Spec.NodeName, err)
+			log.Errorf("Failed to submit VSD Container: %s to the CNI Agent server. Error: %s", container.Name, err)
 		}
 		return nil, err
 	}
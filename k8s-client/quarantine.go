@@ -0,0 +1,171 @@
+package k8s
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"k8s.io/kubernetes/pkg/registry/core/service/ipallocator"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
+	etcdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/etcd-client"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+)
+
+////
+//// Quarantine for released pod IP addresses
+////
+//// XXX - Notes:
+//// - A released pod IP address is kept allocated in its subnet "ipallocator.Range" for "quarantinePeriod" before it is handed back to the Range.
+////   This prevents stale ARP entries / conntrack state / clients caching the old endpoint from reaching a new pod re-using the same address
+//// - The list of quarantined IP addresses is persisted in etcd (shared by all agents) so it survives agent restarts and leader fail-over
+
+// etcd key (under etcdclient.Statedir) for the list of quarantined IP addresses
+const quarantineKey = "ipam-quarantine"
+
+type quarantinedIP struct {
+	Address  string             `json:"address"`  // The released IP address
+	Subnet   string             `json:"subnet"`   // The subnet prefix (i.e. vspk.Subnet.Address) the IP address belongs to
+	Released time.Time          `json:"released"` // When the IP address was released
+	Range    *ipallocator.Range `json:"-"`        // IPAM for the subnet. "nil" until the subnet is discovered (i.e. the namespace is created)
+}
+
+var (
+	quarantinePeriod time.Duration
+
+	quarantine      []*quarantinedIP
+	quarantineMutex sync.Mutex
+)
+
+// Load the list of quarantined IP addresses from etcd, if a quarantine period is configured
+func initQuarantine(conf *config.AgentConfig) error {
+	quarantinePeriod = conf.IpamConfig.QuarantinePeriod
+
+	// Nothing is quarantined without a quarantine period. Any list left by a previous configuration is ignored
+	if quarantinePeriod == 0 {
+		return nil
+	}
+
+	data, err := etcdclient.GetState(quarantineKey)
+	if err != nil {
+		return err
+	}
+
+	if data == "" {
+		return nil
+	}
+
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+
+	if err := json.Unmarshal([]byte(data), &quarantine); err != nil {
+		return err
+	}
+
+	log.Infof("Loaded %d quarantined pod IP addresses", len(quarantine))
+	return nil
+}
+
+// Release a pod IP address from its subnet. If a quarantine period is configured, the IP address is kept allocated in the subnet Range until the quarantine expires
+func quarantineIP(subnet vsdclient.Subnet, ip net.IP) error {
+	if quarantinePeriod == 0 {
+		return subnet.Range.Release(ip)
+	}
+
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+
+	quarantine = append(quarantine, &quarantinedIP{
+		Address:  ip.String(),
+		Subnet:   subnet.Subnet.Address,
+		Released: time.Now(),
+		Range:    subnet.Range,
+	})
+
+	log.Infof("IP address: %s from Subnet: %s in quarantine until: %s", ip.String(), subnet.Subnet.Name, time.Now().Add(quarantinePeriod).Format(time.RFC3339))
+
+	// XXX - The IP address is quarantined locally in any case. Just log the error
+	if err := saveQuarantine(); err != nil {
+		log.Errorf("Cannot save the list of quarantined IP addresses. Error: %s", err)
+	}
+
+	return nil
+}
+
+// Reserve the quarantined IP addresses on a list of (newly discovered) subnets. Called when the subnets of a namespace are (re-)built from the VSD
+func reserveQuarantined(subnets []vsdclient.Subnet) {
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+
+	for _, qip := range quarantine {
+		for _, subnet := range subnets {
+			if qip.Subnet != subnet.Subnet.Address {
+				continue
+			}
+			qip.Range = subnet.Range
+			// XXX - The IP address may be already allocated, e.g. by a container interface on that subnet. Just log it
+			if err := subnet.Range.Allocate(net.ParseIP(qip.Address).To4()); err != nil {
+				log.Warningf("Cannot reserve quarantined IP address: %s on Subnet: %s . Error: %s", qip.Address, subnet.Subnet.Name, err)
+			}
+			break
+		}
+	}
+}
+
+// Periodically release the IP addresses whose quarantine period has expired
+func QuarantineReaper() {
+	if quarantinePeriod == 0 {
+		return
+	}
+
+	// Check at least every second, and at least 10 times per quarantine period
+	interval := quarantinePeriod / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	tick(interval, releaseExpired)
+}
+
+func releaseExpired() {
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+
+	var kept []*quarantinedIP
+
+	for _, qip := range quarantine {
+		if time.Since(qip.Released) < quarantinePeriod {
+			kept = append(kept, qip)
+			continue
+		}
+
+		// XXX - For subnets not (yet) discovered there is nothing to release from. Just drop the entry
+		if qip.Range != nil {
+			if err := qip.Range.Release(net.ParseIP(qip.Address).To4()); err != nil {
+				log.Errorf("Failed to release quarantined IP address: %s from subnet: %s . Error: %s", qip.Address, qip.Subnet, err)
+			}
+		}
+		log.Infof("Quarantine expired for IP address: %s from subnet: %s", qip.Address, qip.Subnet)
+	}
+
+	if len(kept) == len(quarantine) {
+		return
+	}
+
+	quarantine = kept
+
+	if err := saveQuarantine(); err != nil {
+		log.Errorf("Cannot save the list of quarantined IP addresses. Error: %s", err)
+	}
+}
+
+// Persist the list of quarantined IP addresses. The caller must hold "quarantineMutex"
+func saveQuarantine() error {
+	data, err := json.Marshal(quarantine)
+	if err != nil {
+		return err
+	}
+
+	return etcdclient.SetState(quarantineKey, string(data))
+}
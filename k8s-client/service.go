@@ -1,106 +1,626 @@
 package k8s
 
 import (
-	"time"
+	"sort"
+	"strconv"
 
 	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
-	"github.com/golang/glog"
-	//
 
 	"github.com/FlorianOtel/go-bambou/bambou"
+	"github.com/OpenPlatformSDN/client-go/pkg/api/errors"
 	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	metav1 "github.com/OpenPlatformSDN/client-go/pkg/apis/meta/v1"
+	"github.com/OpenPlatformSDN/client-go/pkg/util/intstr"
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
 )
 
 /////
-///// K8S Service <-> VSD NetworkMacro.
+///// K8S Service <-> VSD NetworkMacro(s).
 ///// Coresponding: VSD hierarcy:  K8S Service == VSD NetworkMacro (vspk.EnterpriseNetwork) -> NetworkMacroGroup -> Enterprise
 /////
+///// Every address a Service exposes is mapped to a "/32" VSD NetworkMacro, all grouped in the NetworkMacroGroup of the Service namespace:
+///// - Service ClusterIP. Convention: NM name = vsdclient.ServiceNMName(<namespace>, <service name>) ("service-nm" name template)
+///// - Service ExternalIPs. Convention: NM name = vsdclient.ServiceNMName(<namespace>, <service name>) + " external IP " + <ip>
+///// - LoadBalancer ingress IPs. Convention: NM name = vsdclient.ServiceNMName(<namespace>, <service name>) + " ingress IP " + <ip>
+/////
+///// Traffic to a Service is allowed per Service port, by Ingress Policy Elements:
+///// - From: The Service namespace (VSD Zone) or -- if cross-namespace access is allowed for the Service -- each namespace (VSD Zone) of the same tenant, one PE per namespace
+///// - To: The NetworkMacroGroup of the Service backends (see endpoints.go), since Nuage ACLs evaluate traffic after kube-proxy DNAT
+///// - Traffic: The Service port protocol (TCP/UDP) and target port on the backends
+///// - Convention: PE name = vsdclient.ServicePEPrefix(<namespace>, <service name>) + "allow " + <protocol> + "/" + <target port> + " from namespace " + <source namespace>
+/////
+///// XXX - Notes:
+///// - Headless Services (no ClusterIP) do not get any NetworkMacro for their ClusterIP. Their endpoint addresses are still mapped (see endpoints.go)
+///// - NodePorts are exposed on the K8S nodes addresses, which are outside the VSD Domain. Those are not mapped
+///// - Named target ports are resolved from the Service Endpoints. Backends may resolve the same name to different port numbers, each getting its own PE
+///// - The NetworkMacros / Groups and Policy Elements are in the Enterprise / Domain of the tenant of the Service namespace (see vsd-client/tenants.go). Cross-namespace access is limited to the namespaces of the same tenant
+///// - Cross-namespace access never uses an "any source" scope: That would also allow traffic from outside the cluster. The Policy Elements of those Services are re-synced when namespaces are created (see namespace.go)
+///// - Earlier versions named the NetworkMacros without the namespace (i.e. Services with the same name in different namespaces collided), then without the cluster ID (see vsdclient.LegacyServiceNMName).
+/////   Those -- and the NetworkMacroGroups named without the cluster ID -- are removed when the Service is (re)created. Policy Elements named after "vsdclient.LegacyServiceNMName" are replaced when the Service is synced
+
+// NetworkMacro name prefix used by earlier versions, without the namespace
+const legacyServiceNMPrefix = "K8S service "
+
+// Per Service annotation controlling whether the Service can be reached from other namespaces. Values: "namespace" (own namespace only) or "cluster" (any namespace)
+const serviceAccessAnnotation = "nuage.io/service-access"
+
+// Default for Services without the "serviceAccessAnnotation". From the agent configuration
+var serviceCrossNamespace = false
 
 func ServiceCreated(svc *apiv1.Service) error {
+	log := objLog("create", "service", svc.ObjectMeta)
+
 	// Ensure that the Namespace is already created -- due event processing race conditions at startup, service creation event may be processed before namespace creation
 	// XXX -- The name is the VSD Zone name (different from the K8s namespace name itself)
-	if _, exists := Namespaces[svc.ObjectMeta.Namespace]; !exists {
-		// Wait for a max 10 seconds, probing local cache
-		timeChan := time.NewTimer(time.Second * 10).C
-		tickChan := time.NewTicker(time.Millisecond * 100).C
-
-		for {
-			select {
-			case <-timeChan:
-				return bambou.NewBambouError("Error creating K8S Pod: "+svc.ObjectMeta.Name, "Timeout waiting for namespace "+svc.ObjectMeta.Namespace+" to be created")
-			case <-tickChan:
-				if _, found := Namespaces[svc.ObjectMeta.Namespace]; !found {
-					continue
-				}
-			}
-			break
-		}
+	if !waitForNamespace(svc.ObjectMeta.Namespace) {
+		return bambou.NewBambouError("Error creating K8S service: "+svc.ObjectMeta.Name, "Timeout waiting for namespace "+svc.ObjectMeta.Namespace+" to be created")
+	}
+
+	// Allow traffic to the Service backends, per Service port
+	if err := serviceSyncPEs(svc, nil); err != nil {
+		return err
+	}
+
+	// The Policy Elements no longer refer to the backends NetworkMacroGroup named by earlier versions
+	serviceLegacyEndpointsNMGDelete(svc)
+
+	addrs := serviceAddresses(svc)
+
+	if len(addrs) == 0 {
+		log.Info("Service does not expose any IP addresses (headless service). Skipping...")
+		return nil
 	}
 
 	////
 	//// Check VSD construct hierachy, top down.  Enterprise/Domain are already created
 	////
-	nm := new(vsdclient.NetworkMacro)
-	nm.Name = vsdclient.NM_NAME + svc.ObjectMeta.Name
 
 	// Parent NMG (all services in same K8S namespace)
+	nmg, err := serviceNMG(svc)
+	if err != nil {
+		return err
+	}
+
+	for nmname, address := range addrs {
+		if err := serviceNMCreate(svc, nmg, nmname, address); err != nil {
+			return err
+		}
+	}
+
+	serviceLegacyNMsDelete(svc)
+
+	return nil
+}
+
+func ServiceDeleted(svc *apiv1.Service) error {
+	for nmname := range serviceAddresses(svc) {
+		if err := serviceNMDelete(svc, nmname); err != nil {
+			return err
+		}
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(svc.ObjectMeta.Namespace)
+	if err != nil {
+		return bambou.NewBambouError("Error deleting K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
+	// Remove the Policy Elements for this Service before its backends NetworkMacroGroup they refer to
+	t := tenant.NewPolicyTransaction()
+	for _, pename := range servicePENames(tenant, svc.ObjectMeta.Namespace, svc.ObjectMeta.Name) {
+		t.DeleteIngressPE(pename)
+	}
+	if err := t.Commit(); err != nil {
+		return bambou.NewBambouError("Error deleting K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
+	nmg, err := serviceEndpointsNMG(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, false)
+	if err != nil {
+		return err
+	}
+
+	if nmg == nil {
+		return nil
+	}
+
+	// XXX - The Endpoints of the Service may be deleted after the Service itself. Release any remaining backends first
+	nms, err := nmg.Members()
+	if err != nil {
+		return bambou.NewBambouError("Error deleting K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
+	for _, nm := range nms {
+		if err := nmRelease(nmg, nm); err != nil {
+			return bambou.NewBambouError("Error deleting K8S service: "+svc.ObjectMeta.Name, err.Error())
+		}
+	}
+
+	if err := nmg.Delete(); err != nil {
+		return bambou.NewBambouError("Error deleting K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
+	return nil
+}
+
+// Keep the VSD NetworkMacros in sync with the set of addresses the Service exposes (e.g. newly assigned LoadBalancer ingress IPs), and the Policy Elements with the Service ports
+func ServiceUpdated(old, updated *apiv1.Service) error {
+	if err := serviceSyncPEs(updated, nil); err != nil {
+		return err
+	}
+
+	oldaddrs := serviceAddresses(old)
+	newaddrs := serviceAddresses(updated)
+
+	// Remove the NetworkMacros for addresses that are no longer exposed
+	for nmname := range oldaddrs {
+		if _, kept := newaddrs[nmname]; !kept {
+			if err := serviceNMDelete(old, nmname); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(newaddrs) == 0 {
+		return nil
+	}
+
+	// Add (or update) the NetworkMacros for the currently exposed addresses
+	nmg, err := serviceNMG(updated)
+	if err != nil {
+		return err
+	}
+
+	for nmname, address := range newaddrs {
+		if oldaddress, exists := oldaddrs[nmname]; exists && oldaddress == address {
+			continue
+		}
+		if err := serviceNMCreate(updated, nmg, nmname, address); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+///// Auxilary functions
+
+// All the IP addresses a Service exposes. Key: VSD NetworkMacro name. Value: IP address
+func serviceAddresses(svc *apiv1.Service) map[string]string {
+	addrs := make(map[string]string)
+
+	if apiv1.IsServiceIPSet(svc) {
+		addrs[vsdclient.ServiceNMName(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)] = svc.Spec.ClusterIP
+	}
+
+	for _, extip := range svc.Spec.ExternalIPs {
+		addrs[vsdclient.ServiceExternalIPNMName(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, extip)] = extip
+	}
+
+	// XXX - DNS based LoadBalancer ingress points (i.e. "Hostname" only) are not mapped
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			addrs[vsdclient.ServiceIngressIPNMName(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, ingress.IP)] = ingress.IP
+		}
+	}
+
+	return addrs
+}
+
+// Find -- or create if needed -- the NetworkMacroGroup for the services in the Service namespace
+func serviceNMG(svc *apiv1.Service) (*vsdclient.NetworkMacroGroup, error) {
+	log := objLog("sync", "service", svc.ObjectMeta)
+
+	tenant, err := vsdclient.NamespaceTenant(svc.ObjectMeta.Namespace)
+	if err != nil {
+		return nil, bambou.NewBambouError("Error creating K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
 	nmg := new(vsdclient.NetworkMacroGroup)
-	nmg.Name = vsdclient.NMG_NAME + svc.ObjectMeta.Namespace
+	nmg.Name = vsdclient.ServicesNMGName(svc.ObjectMeta.Namespace)
 
 	// First, check that NMG exists
 
-	if err := nmg.FetchByName(); err != nil {
-		return bambou.NewBambouError("Error creating K8S service: "+svc.ObjectMeta.Name, err.Error())
+	if err := nmg.FetchByName(tenant); err != nil {
+		return nil, bambou.NewBambouError("Error creating K8S service: "+svc.ObjectMeta.Name, err.Error())
 	}
 
 	if nmg.ID == "" {
-		glog.Infof("Cannot find a VSD Network Macro Group with name: %s, creating...", nmg.Name)
+		log.Infof("Cannot find a VSD Network Macro Group with name: %s, creating...", nmg.Name)
 		// Create it
-		if err := nmg.Create(); err != nil {
-			return bambou.NewBambouError("Error creating K8S service: "+svc.ObjectMeta.Name, err.Error())
+		if err := nmg.Create(tenant); err != nil {
+			return nil, bambou.NewBambouError("Error creating K8S service: "+svc.ObjectMeta.Name, err.Error())
 		}
+	}
 
-		// Add a PE (Policy Element) allowing traffic to the services in this namespace (VSD Zone)
-		if err := nmg.AddPESvcsAllow(Namespaces[svc.ObjectMeta.Namespace].Zone); err != nil {
-			// We might get an error if the NMG was deleted but the Policy Element was still there. Just log the error
-			glog.Errorf("Cannot add network Policy Element for K8S Services in namespace %s. Error: %s", svc.ObjectMeta.Namespace, err)
-		} else {
-			glog.Infof("Added network Policy Element for K8S Services in namespace %s", svc.ObjectMeta.Namespace)
-		}
+	// Remove any "allow all" Policy Element left over by earlier versions
+	if err := nmg.DeletePESvcsAllow(); err != nil {
+		log.Errorf("Cannot delete legacy network Policy Element for the K8S Services in the namespace. Error: %s", err)
 	}
 
-	// Secondly, check if NM exists
-	if err := nm.FetchByName(); err != nil {
+	return nmg, nil
+}
+
+// Create -- or update, if its address changed -- a "/32" NetworkMacro for a Service address, and add it to the given NetworkMacroGroup
+func serviceNMCreate(svc *apiv1.Service, nmg *vsdclient.NetworkMacroGroup, nmname, address string) error {
+	log := objLog("sync", "service", svc.ObjectMeta)
+
+	tenant, err := vsdclient.NamespaceTenant(svc.ObjectMeta.Namespace)
+	if err != nil {
+		return bambou.NewBambouError("Error creating K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
+	nm := new(vsdclient.NetworkMacro)
+	nm.Name = nmname
+
+	// Check if NM exists
+	if err := nm.FetchByName(tenant); err != nil {
 		return bambou.NewBambouError("Error creating K8S service: "+svc.ObjectMeta.Name, err.Error())
 	}
 
-	if nm.ID == "" { // Couldn't find it
-		glog.Infof("Cannot find VSD Network Macro with name: %s, creating...", nm.Name)
+	switch {
+	case nm.ID == "": // Couldn't find it
+		log.Infof("Cannot find VSD Network Macro with name: %s, creating...", nm.Name)
 
 		// Create the NM under the NMG (prev existing or created above)
 		// Name was set above. Address is the Service IP address. Netmask is "255.255.255.255"
-		nm.Address = svc.Spec.ClusterIP
+		nm.Address = address
 		nm.Netmask = "255.255.255.255"
-		if err := nm.Create(); err != nil {
+		if err := nm.Create(tenant); err != nil {
 			return bambou.NewBambouError("Error creating K8S service: "+svc.ObjectMeta.Name, err.Error())
 		}
+	case nm.Address != address: // Stale NM, e.g. left over from a previous Service with the same name
+		log.Infof("VSD Network Macro with name: %s has address: %s instead of: %s, updating...", nm.Name, nm.Address, address)
+		nm.Address = address
+		nm.Netmask = "255.255.255.255"
+		if err := nm.Update(); err != nil {
+			return bambou.NewBambouError("Error updating K8S service: "+svc.ObjectMeta.Name, err.Error())
+		}
 	}
 
 	if err := nmg.AddNM(nm); err != nil { // We might get errors -- e.g. in the case this NM was already added to the NMG. Just log them.
-		glog.Errorf("Error creating service: %s. Cannot add NetworkMacro: %s to NetworkMacroGroup: %s . Error: %s", svc.ObjectMeta.Name, nm.Name, nmg.Name, err)
+		log.Errorf("Cannot add NetworkMacro: %s to NetworkMacroGroup: %s . Error: %s", nm.Name, nmg.Name, err)
 	}
 
 	return nil
 }
 
-func ServiceDeleted(svc *apiv1.Service) error {
-	glog.Info("=====> A service got deleted")
-	JsonPrettyPrint("service", svc)
+// Delete the NetworkMacro for a Service address, if it exists
+func serviceNMDelete(svc *apiv1.Service, nmname string) error {
+	tenant, err := vsdclient.NamespaceTenant(svc.ObjectMeta.Namespace)
+	if err != nil {
+		return bambou.NewBambouError("Error deleting K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
+	nm := new(vsdclient.NetworkMacro)
+	nm.Name = nmname
+
+	if err := nm.FetchByName(tenant); err != nil {
+		return bambou.NewBambouError("Error deleting K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
+	if nm.ID == "" { // Nothing to delete
+		return nil
+	}
+
+	if err := nm.Delete(); err != nil {
+		return bambou.NewBambouError("Error deleting K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
 	return nil
 }
 
-// Still TBD if / when / how to use  -- stub so far
-func ServiceUpdated(old, updated *apiv1.Service) error {
+// Delete the NetworkMacros named by earlier versions for the Service addresses. Errors are only logged
+// XXX - A NetworkMacro with the legacy name but a different address belongs to a Service with the same name in another namespace. It is left in place (removed when that Service is processed)
+func serviceLegacyNMsDelete(svc *apiv1.Service) {
+	log := objLog("sync", "service", svc.ObjectMeta)
+
+	tenant, err := vsdclient.NamespaceTenant(svc.ObjectMeta.Namespace)
+	if err != nil {
+		log.Warningf("Cannot check legacy VSD Network Macros. Error: %s", err)
+		return
+	}
+
+	legacy := make(map[string]string)
+	for _, prefix := range []string{legacyServiceNMPrefix + svc.ObjectMeta.Name, vsdclient.LegacyServiceNMName(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)} {
+		if apiv1.IsServiceIPSet(svc) {
+			legacy[prefix] = svc.Spec.ClusterIP
+		}
+		for _, extip := range svc.Spec.ExternalIPs {
+			legacy[prefix+" external IP "+extip] = extip
+		}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				legacy[prefix+" ingress IP "+ingress.IP] = ingress.IP
+			}
+		}
+	}
+
+	current := serviceAddresses(svc)
+
+	for nmname, address := range legacy {
+		if _, inuse := current[nmname]; inuse { // Name templates producing the legacy names
+			continue
+		}
+
+		nm := new(vsdclient.NetworkMacro)
+		nm.Name = nmname
+		if err := nm.FetchByName(tenant); err != nil {
+			log.Warningf("Cannot check legacy VSD Network Macro: %s . Error: %s", nmname, err)
+			continue
+		}
+
+		if nm.ID == "" || nm.Address != address {
+			continue
+		}
+
+		log.Infof("Deleting legacy VSD Network Macro: %s", nmname)
+		if err := nm.Delete(); err != nil {
+			log.Warningf("Cannot delete legacy VSD Network Macro: %s . Error: %s", nmname, err)
+		}
+	}
+
+	// The NetworkMacroGroup of the namespace named by earlier versions, once all its Services were processed
+	nmg := new(vsdclient.NetworkMacroGroup)
+	nmg.Name = vsdclient.LegacyServicesNMGName(svc.ObjectMeta.Namespace)
+	if nmg.Name == vsdclient.ServicesNMGName(svc.ObjectMeta.Namespace) {
+		return
+	}
+	if err := nmg.FetchByName(tenant); err != nil {
+		log.Warningf("Cannot check legacy VSD Network Macro Group: %s . Error: %s", nmg.Name, err)
+		return
+	}
+	if nmg.ID == "" {
+		return
+	}
+	if members, err := nmg.Members(); err != nil || len(members) > 0 {
+		return
+	}
+	log.Infof("Deleting legacy VSD Network Macro Group: %s", nmg.Name)
+	if err := nmg.Delete(); err != nil {
+		log.Warningf("Cannot delete legacy VSD Network Macro Group: %s . Error: %s", nmg.Name, err)
+	}
+}
+
+// Delete the NetworkMacroGroup named by earlier versions for the Service backends, releasing its NetworkMacros. Errors are only logged
+func serviceLegacyEndpointsNMGDelete(svc *apiv1.Service) {
+	log := objLog("sync", "service", svc.ObjectMeta)
+
+	tenant, err := vsdclient.NamespaceTenant(svc.ObjectMeta.Namespace)
+	if err != nil {
+		log.Warningf("Cannot check the legacy VSD Network Macro Group of the Service backends. Error: %s", err)
+		return
+	}
+
+	nmg := new(vsdclient.NetworkMacroGroup)
+	nmg.Name = vsdclient.LegacyEndpointsNMGName(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
+	if nmg.Name == vsdclient.EndpointsNMGName(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name) { // Name templates producing the legacy names
+		return
+	}
+
+	if err := nmgLegacyDelete(tenant, nmg); err != nil {
+		log.Warningf("Cannot delete legacy VSD Network Macro Group: %s . Error: %s", nmg.Name, err)
+	}
+}
+
+////
+//// Service Policy Elements
+////
+
+// Common prefix for the names of the Policy Elements of a Service
+func servicePEPrefix(namespace, name string) string {
+	return vsdclient.ServicePEPrefix(namespace, name)
+}
+
+// The names of the Ingress Policy Elements of a Service, incl. those named by earlier versions (see vsdclient.LegacyServiceNMName)
+func servicePENames(tenant *vsdclient.Tenant, namespace, name string) []string {
+	penames := tenant.IngressPENames(servicePEPrefix(namespace, name))
+	if legacy := vsdclient.LegacyServiceNMName(namespace, name) + ": "; legacy != servicePEPrefix(namespace, name) {
+		penames = append(penames, tenant.IngressPENames(legacy)...)
+	}
+	return penames
+}
+
+// Whether the Service may be reached from other namespaces
+func serviceCrossNS(svc *apiv1.Service) bool {
+	switch access := svc.ObjectMeta.Annotations[serviceAccessAnnotation]; access {
+	case "namespace":
+		return false
+	case "cluster":
+		return true
+	case "":
+	default:
+		objLog("sync", "service", svc.ObjectMeta).Warningf("Invalid %s annotation: %s . Using default", serviceAccessAnnotation, access)
+	}
+
+	return serviceCrossNamespace
+}
+
+// Whether any of the Service ports uses a named target port (i.e. resolved from the Service Endpoints)
+func serviceNamedPorts(svc *apiv1.Service) bool {
+	for _, sp := range svc.Spec.Ports {
+		if sp.TargetPort.Type == intstr.String {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The backend port numbers of a Service port. Named target ports are resolved from the Service Endpoints ("ep" may be nil)
+func servicePortTargets(sp apiv1.ServicePort, ep *apiv1.Endpoints) []string {
+	if sp.TargetPort.Type == intstr.Int {
+		if sp.TargetPort.IntVal == 0 { // Defaults to the Service port
+			return []string{strconv.Itoa(int(sp.Port))}
+		}
+		return []string{strconv.Itoa(int(sp.TargetPort.IntVal))}
+	}
+
+	if ep == nil {
+		return nil
+	}
+
+	// XXX - Endpoints ports are named after the Service port -- not the target port
+	found := make(map[string]bool)
+	var targets []string
+	for _, subset := range ep.Subsets {
+		for _, epport := range subset.Ports {
+			port := strconv.Itoa(int(epport.Port))
+			if epport.Name == sp.Name && epport.Protocol == sp.Protocol && !found[port] {
+				found[port] = true
+				targets = append(targets, port)
+			}
+		}
+	}
+
+	sort.Strings(targets)
+	return targets
+}
+
+// The Policy Elements allowing traffic to the Service backends from the given namespaces (VSD Zones, key: K8S namespace name). Key: PE name
+// XXX - Priorities are assigned when the Policy Elements are applied
+func servicePEs(svc *apiv1.Service, ep *apiv1.Endpoints, srczones map[string]*vsdclient.Zone) map[string]*netpolicy.PolicyElement {
+	pes := make(map[string]*netpolicy.PolicyElement)
+
+	epnmgname := vsdclient.EndpointsNMGName(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name)
+
+	for _, sp := range svc.Spec.Ports {
+		proto := netpolicy.TCP
+		if sp.Protocol == apiv1.ProtocolUDP {
+			proto = netpolicy.UDP
+		}
+
+		for _, port := range servicePortTargets(sp, ep) {
+			for srcns, zone := range srczones {
+				name := servicePEPrefix(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name) + "allow " + string(proto) + "/" + port + " from namespace " + srcns
+				srcports, dstports := "*", port
+				pes[name] = &netpolicy.PolicyElement{
+					Name: name,
+					From: netpolicy.PolicySrcScope{Type: string(netpolicy.LZone), Name: &zone.Name},
+					To: netpolicy.PolicyDstScope{
+						Type: string(netpolicy.NetworkMacroGroup),
+						Name: &epnmgname,
+					},
+					TrafficSpec: netpolicy.TrafficSpec{
+						Protocol:     proto,
+						SrcPortRange: &srcports,
+						DstPortRange: &dstports,
+					},
+					Action: netpolicy.Allow,
+				}
+			}
+		}
+	}
+
+	return pes
+}
+
+// Keep the Policy Elements of a Service in sync with the Service ports. If "ep" is nil and the Service has named target ports, the Service Endpoints are fetched
+func serviceSyncPEs(svc *apiv1.Service, ep *apiv1.Endpoints) error {
+	ns, exists := lookupNamespace(svc.ObjectMeta.Namespace)
+	if !exists {
+		return bambou.NewBambouError("Error processing K8S service: "+svc.ObjectMeta.Name, "Cannot find namespace "+svc.ObjectMeta.Namespace)
+	}
+
+	if ep == nil && serviceNamedPorts(svc) {
+		var err error
+		if ep, err = clientset.Core().Endpoints(svc.ObjectMeta.Namespace).Get(svc.ObjectMeta.Name, metav1.GetOptions{}); err != nil {
+			if !errors.IsNotFound(err) {
+				return bambou.NewBambouError("Error processing K8S service: "+svc.ObjectMeta.Name, err.Error())
+			}
+			ep = nil // Named target ports are resolved once the Endpoints are created
+		}
+	}
+
+	pes := servicePEs(svc, ep, serviceSrcZones(svc, ns.Zone))
+
+	// XXX - No traffic is allowed to the Services in namespaces with "deny" isolation
+	if ns.Isolation == isolationDeny {
+		pes = nil
+	}
+
+	// The Policy Elements refer to the NetworkMacroGroup of the Service backends by name. Make sure it exists
+	if len(pes) > 0 {
+		if _, err := serviceEndpointsNMG(svc.ObjectMeta.Namespace, svc.ObjectMeta.Name, true); err != nil {
+			return err
+		}
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(svc.ObjectMeta.Namespace)
+	if err != nil {
+		return bambou.NewBambouError("Error processing K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
+	// Apply the Policy Elements and remove the stale ones -- e.g. for removed Service ports or changed access scope -- in one policy transaction
+	t := tenant.NewPolicyTransaction()
+
+	for _, pe := range pes {
+		t.ApplyIngressPE(pe, vsdclient.ServicesBand)
+	}
+
+	for _, pename := range servicePENames(tenant, svc.ObjectMeta.Namespace, svc.ObjectMeta.Name) {
+		if _, kept := pes[pename]; !kept {
+			t.DeleteIngressPE(pename)
+		}
+	}
+
+	if err := t.Commit(); err != nil {
+		return bambou.NewBambouError("Error processing K8S service: "+svc.ObjectMeta.Name, err.Error())
+	}
+
+	return nil
+}
+
+// The namespaces (VSD Zones) allowed to reach a Service: Its own namespace or -- with cross-namespace access -- all the known namespaces of the same tenant. Key: K8S namespace name
+func serviceSrcZones(svc *apiv1.Service, zone *vsdclient.Zone) map[string]*vsdclient.Zone {
+	srczones := map[string]*vsdclient.Zone{svc.ObjectMeta.Namespace: zone}
+
+	if !serviceCrossNS(svc) {
+		return srczones
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(svc.ObjectMeta.Namespace)
+	if err != nil {
+		return srczones
+	}
+
+	namespacesMutex.RLock()
+	defer namespacesMutex.RUnlock()
+
+	for nsname, ns := range Namespaces {
+		if nstenant, err := vsdclient.NamespaceTenant(nsname); err == nil && nstenant == tenant {
+			srczones[nsname] = ns.Zone
+		}
+	}
+
+	return srczones
+}
+
+// Re-sync the Policy Elements of the cross-namespace K8S services of a tenant, e.g. when a namespace is created in the tenant Domain
+func tenantSyncCrossNSServices(tenant *vsdclient.Tenant) error {
+	svcs, err := clientset.Core().Services(apiv1.NamespaceAll).List(apiv1.ListOptions{})
+	if err != nil {
+		return bambou.NewBambouError("Error fetching the list of K8S services", err.Error())
+	}
+
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+
+		if !serviceCrossNS(svc) {
+			continue
+		}
+
+		_, known := lookupNamespace(svc.ObjectMeta.Namespace)
+		if !known { // Synced when its namespace is created
+			continue
+		}
+
+		if svctenant, err := vsdclient.NamespaceTenant(svc.ObjectMeta.Namespace); err != nil || svctenant != tenant {
+			continue
+		}
+
+		if err := serviceSyncPEs(svc, nil); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -0,0 +1,116 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+)
+
+////
+//// Graceful shutdown: Stop handling K8S events, drain the in-flight ones and flush the persisted IPAM state
+////
+//// XXX - Notes:
+//// - The informers and the periodic tasks (IPAM check, policy audit, quarantine reaper) are stopped first, then the work queues: Pending events are dropped.
+////   The next leader lists all the K8S objects at startup and handles them again (e.g. "case1create" for pods whose VSD Container exists)
+//// - The in-flight events / periodic task runs are given until the deadline to finish. The VSD client is expected to fail fast meanwhile (see vsdclient.Drain),
+////   so the handlers complete or run their own cleanup, e.g. releasing the IP address of a pod whose VSD Container could not be created
+//// - Events still in flight at the deadline are logged: Their VSD objects are reconciled by the next leader (IPAM check, policy audit)
+
+var (
+	// Closed on shutdown: Stops the informers and the periodic tasks
+	stopCh = make(chan struct{})
+
+	shutdownMutex sync.Mutex
+	stopping      bool
+	started       bool           // Whether "EventWatcher" was started, i.e. this agent is the leader
+	tasks         sync.WaitGroup // In-flight runs of the periodic tasks
+)
+
+// Register a run of a periodic task. False if shutting down: The task must not run
+func startTask() bool {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+
+	if stopping {
+		return false
+	}
+	tasks.Add(1)
+	return true
+}
+
+// Stop handling K8S events and wait -- until "deadline" -- for the in-flight ones. Then flush the persisted IPAM state
+func Shutdown(deadline time.Time) error {
+	shutdownMutex.Lock()
+	if stopping {
+		shutdownMutex.Unlock()
+		return nil
+	}
+	stopping = true
+	close(stopCh)
+	leader := started
+	shutdownMutex.Unlock()
+
+	if !leader { // Nothing handled, nothing to flush
+		return nil
+	}
+
+	queuesMutex.Lock()
+	stopped := append([]*workQueue(nil), queues...)
+	queuesMutex.Unlock()
+
+	for _, q := range stopped {
+		q.Stop()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		for _, q := range stopped {
+			<-q.done
+		}
+		tasks.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Info("Shutdown: All in-flight K8S events handled")
+	case <-time.After(deadline.Sub(time.Now())):
+		for _, q := range stopped {
+			if desc := q.InFlight(); desc != "" {
+				log.Warningf("Shutdown: Deadline reached while handling: %s (%s work queue)", desc, q.name)
+			}
+		}
+		log.Warn("Shutdown: Deadline reached. Not waiting for the in-flight K8S events / periodic tasks any longer")
+	}
+
+	//// Flush the persisted IPAM state
+	quarantineMutex.Lock()
+	defer quarantineMutex.Unlock()
+
+	if quarantinePeriod == 0 {
+		return nil
+	}
+	if err := saveQuarantine(); err != nil {
+		return err
+	}
+	log.Infof("Shutdown: Saved %d quarantined pod IP addresses", len(quarantine))
+	return nil
+}
+
+// Periodic ticks, until shutdown
+func tick(interval time.Duration, run func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !startTask() {
+				return
+			}
+			run()
+			tasks.Done()
+		case <-stopCh:
+			return
+		}
+	}
+}
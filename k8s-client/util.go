@@ -2,56 +2,143 @@ package k8s
 
 import (
 	"encoding/json"
-	"fmt"
+	"time"
 
-	"github.com/golang/glog"
-	//
+	"github.com/Sirupsen/logrus"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
 
 	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
 	apiv1beta1 "github.com/OpenPlatformSDN/client-go/pkg/apis/extensions/v1beta1"
+	metav1 "github.com/OpenPlatformSDN/client-go/pkg/apis/meta/v1"
 	"github.com/OpenPlatformSDN/client-go/pkg/runtime"
 	// "github.com/OpenPlatformSDN/client-go/pkg/util/wait"
 )
 
-// Pretty Prints (JSON) for a Kubernetes API object:
+// Log a Kubernetes API object (debug level), with its "ObjectMeta" and "Spec" as JSON fields:
 // - The "ObjectMeta"  is common to all the API objects and is handled identically, disregarding of the underlying type
 // - The "Spec" is specific to each reasource and is handled on per-object specific basis (even if the field -- "Spec" -- is named the same for all objects)
 
-func JsonPrettyPrint(resource string, obj runtime.Object) error {
+func logObject(resource string, obj runtime.Object) error {
 	var meta apiv1.ObjectMeta
-	var jsonmeta, jsonspec []byte
-	var err error
+	var spec interface{}
 
 	switch resource {
 	case "pod":
-		meta = obj.(*apiv1.Pod).ObjectMeta
-		jsonspec, err = json.MarshalIndent(obj.(*apiv1.Pod).Spec, "", " ")
+		meta, spec = obj.(*apiv1.Pod).ObjectMeta, obj.(*apiv1.Pod).Spec
 	case "service":
-		meta = obj.(*apiv1.Service).ObjectMeta
-		jsonspec, err = json.MarshalIndent(obj.(*apiv1.Service).Spec, "", " ")
+		meta, spec = obj.(*apiv1.Service).ObjectMeta, obj.(*apiv1.Service).Spec
 	case "namespace":
-		meta = obj.(*apiv1.Namespace).ObjectMeta
-		jsonspec, err = json.MarshalIndent(obj.(*apiv1.Namespace).Spec, "", " ")
+		meta, spec = obj.(*apiv1.Namespace).ObjectMeta, obj.(*apiv1.Namespace).Spec
 	case "networkpolicy":
-		meta = obj.(*apiv1beta1.NetworkPolicy).ObjectMeta
-		jsonspec, err = json.MarshalIndent(obj.(*apiv1beta1.NetworkPolicy).Spec, "", " ")
+		meta, spec = obj.(*apiv1beta1.NetworkPolicy).ObjectMeta, obj.(*apiv1beta1.NetworkPolicy).Spec
 	default:
-		glog.Errorf("Don't know how to pretty-print API object: %s", resource)
+		log.Errorf("Don't know how to log API object: %s", resource)
+		return nil
 	}
 
-	// If any of the JSON marshalling of the object-specific specs above returned an error
+	// Marshalled here, so the JSON tags of the API types apply
+	jsonmeta, err := json.Marshal(meta)
 	if err != nil {
 		return err
 	}
-
-	// JSON pretty-print the ObjectMeta -- unlike "Spec" it's the same for all type of objects (has it's own type)
-	jsonmeta, err = json.MarshalIndent(meta, "", " ")
-
+	jsonspec, err := json.Marshal(spec)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("====> %s <====\n ######## %s ObjectMetadata ########\n%s\n ######## %s Spec ########\n%s\n\n ", resource, resource, string(jsonmeta), resource, string(jsonspec))
+	objLog("dump", resource, meta).WithFields(logrus.Fields{
+		"metadata": json.RawMessage(jsonmeta),
+		"spec":     json.RawMessage(jsonspec),
+	}).Debugf("K8S %s", resource)
+
+	return nil
+}
+
+// Logger with the context of a K8S object: Kind, namespace, name, UID. "op" is the operation, e.g. "create"
+func objLog(op, kind string, meta apiv1.ObjectMeta) *logrus.Entry {
+	fields := logrus.Fields{
+		logging.FieldOp:        op,
+		logging.FieldKind:      kind,
+		logging.FieldNamespace: meta.Namespace,
+		logging.FieldName:      meta.Name,
+		logging.FieldUID:       string(meta.UID),
+	}
+	if kind == "namespace" {
+		fields[logging.FieldNamespace] = meta.Name
+	}
+
+	return logging.With(log, fields)
+}
 
-	return err
+// Logger with the context of a K8S pod, incl. its node (once scheduled)
+func podLog(op string, pod *apiv1.Pod) *logrus.Entry {
+	return logging.With(objLog(op, "pod", pod.ObjectMeta), logrus.Fields{
+		logging.FieldPod:  pod.ObjectMeta.Name,
+		logging.FieldNode: pod.Spec.NodeName,
+	})
+}
+
+// The K8S namespace with the given name, from the "Namespaces" local cache. Safe for concurrent use with the namespace changes
+func lookupNamespace(nsname string) (namespace, bool) {
+	namespacesMutex.RLock()
+	defer namespacesMutex.RUnlock()
+
+	ns, exists := Namespaces[nsname]
+	return ns, exists
+}
+
+// Wait for a K8S namespace to be created (i.e. present in "Namespaces" local cache) for a max 10 seconds.
+// Due event processing race conditions at startup, events for namespaced objects (pods, services...) may be processed before the namespace creation. Returns false on timeout
+func waitForNamespace(nsname string) bool {
+	if _, exists := lookupNamespace(nsname); exists {
+		return true
+	}
+
+	// Wait for a max 10 seconds, probing local cache
+	timer := time.NewTimer(time.Second * 10)
+	ticker := time.NewTicker(time.Millisecond * 100)
+	defer timer.Stop()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return false
+		case <-ticker.C:
+			if _, found := lookupNamespace(nsname); found {
+				return true
+			}
+		}
+	}
+}
+
+// Record a "Warning" K8S Event for the given object. Errors are only logged
+func recordEvent(obj *apiv1.ObjectReference, reason, message string) {
+	now := metav1.Now()
+
+	// Events for cluster wide objects (e.g. Namespaces) go to the "default" namespace
+	evns := obj.Namespace
+	if evns == "" {
+		evns = apiv1.NamespaceDefault
+	}
+
+	event := &apiv1.Event{
+		ObjectMeta: apiv1.ObjectMeta{
+			GenerateName: obj.Name + ".",
+			Namespace:    evns,
+		},
+		InvolvedObject: *obj,
+		Reason:         reason,
+		Message:        message,
+		Source:         apiv1.EventSource{Component: agentComponent},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Type:           apiv1.EventTypeWarning,
+	}
+
+	if _, err := clientset.Core().Events(evns).Create(event); err != nil {
+		log.Errorf("Cannot record event for %s: %s in namespace: %s . Error: %s", obj.Kind, obj.Name, evns, err)
+	}
 }
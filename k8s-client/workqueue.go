@@ -0,0 +1,191 @@
+package k8s
+
+import (
+	"sync"
+	"time"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+)
+
+////
+//// Work queues of K8S events, one per watched resource type (see controllers.go)
+////
+//// XXX - Notes:
+//// - Events are handled in order, one at a time per queue -- as when the informers were calling the handlers directly
+//// - While the VSD circuit breaker is open (see vsd-client/resilience.go) the queues pause, i.e. the events are kept instead of failing one by one
+//// - Events failing with transient (VSD) errors are retried, with backoff, before moving on to the next event: The handlers are expected to be idempotent
+//// - Retries are capped ("eventRetryAttempts", "eventRetryMaxTime"), so an event failing over and over does not block the queue: It is then dropped, with an error.
+////   The pauses of the circuit breaker are not counted in "eventRetryMaxTime". Dropped events are not replayed: The periodic policy audit / IPAM check report (and correct, if enabled) the resulting drift
+//// - Events failing with other errors are logged and dropped, as before
+//// - On shutdown the queues are stopped (see shutdown.go): The event in progress is finished, the pending ones are dropped
+
+const (
+	eventRetryBaseDelay = 1 * time.Second
+	eventRetryMaxDelay  = 1 * time.Minute
+	eventRetryAttempts  = 10               // Max nr. of attempts per event
+	eventRetryMaxTime   = 15 * time.Minute // Max time retrying an event, not counting the circuit breaker pauses
+)
+
+type workItem struct {
+	desc   string // E.g. "Add Pod"
+	handle func() error
+}
+
+type workQueue struct {
+	name    string
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	items   []workItem
+	stopped bool
+	stop    chan struct{} // Closed when stopped: Interrupts the pauses / retry delays
+	done    chan struct{} // Closed when the worker exits, once stopped
+}
+
+var (
+	// All the work queues, for shutdown
+	queues      []*workQueue
+	queuesMutex sync.Mutex
+)
+
+// Create a work queue and start its worker
+func newWorkQueue(name string) *workQueue {
+	q := &workQueue{name: name, stop: make(chan struct{}), done: make(chan struct{})}
+	q.cond = sync.NewCond(&q.mutex)
+
+	queuesMutex.Lock()
+	queues = append(queues, q)
+	queuesMutex.Unlock()
+
+	go q.run()
+	return q
+}
+
+func (q *workQueue) Add(desc string, handle func() error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.stopped {
+		log.Infof("%s work queue stopped, shutting down. Dropping: %s", q.name, desc)
+		return
+	}
+
+	q.items = append(q.items, workItem{desc: desc, handle: handle})
+	q.cond.Signal()
+}
+
+// Stop the worker once the event in progress (if any) is handled. The pending events are dropped
+func (q *workQueue) Stop() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.stopped {
+		return
+	}
+	q.stopped = true
+	close(q.stop)
+
+	if len(q.items) > 1 {
+		log.Warningf("%s work queue stopped. Dropping %d pending event(s)", q.name, len(q.items)-1)
+	}
+	q.cond.Signal()
+}
+
+func (q *workQueue) isStopped() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.stopped
+}
+
+// The event in progress. Empty if none
+func (q *workQueue) InFlight() string {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.items) > 0 {
+		return q.items[0].desc
+	}
+	return ""
+}
+
+func (q *workQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.items)
+}
+
+func (q *workQueue) run() {
+	defer close(q.done)
+
+	for {
+		q.mutex.Lock()
+		for len(q.items) == 0 && !q.stopped {
+			q.cond.Wait()
+		}
+		if q.stopped {
+			q.items = nil
+			q.mutex.Unlock()
+			return
+		}
+		item := q.items[0]
+		q.mutex.Unlock()
+
+		q.process(item)
+
+		// Dequeue only once handled: "Len" includes the event in progress
+		q.mutex.Lock()
+		if len(q.items) > 0 {
+			q.items = q.items[1:]
+		}
+		q.mutex.Unlock()
+	}
+}
+
+func (q *workQueue) process(item workItem) {
+	log := log.WithField(logging.FieldQueue, q.name).WithField(logging.FieldEvent, item.desc)
+
+	deadline := time.Now().Add(eventRetryMaxTime)
+
+	for attempt := 1; ; attempt++ {
+		if wait := vsdclient.CircuitWait(); wait > 0 {
+			log.Warningf("VSD circuit breaker open. Pausing for: %s , %d event(s) pending", wait, q.Len())
+			q.sleep(wait)
+			deadline = deadline.Add(wait)
+		}
+
+		// Not started or retried once shutting down
+		if q.isStopped() {
+			log.Warn("Shutting down. Not handling the event")
+			return
+		}
+
+		err := item.handle()
+		if err == nil {
+			return
+		}
+
+		if vsdclient.Classify(err) != vsdclient.ErrTransient {
+			log.Infof("Error while handling the event: %s ", err)
+			return
+		}
+
+		delay := vsdclient.Backoff(attempt, eventRetryBaseDelay, eventRetryMaxDelay)
+		if attempt == eventRetryAttempts || time.Now().Add(delay).After(deadline) {
+			log.Errorf("Dropping the event after %d attempts. Error: %s", attempt, err)
+			return
+		}
+
+		log.Warningf("Transient error while handling the event (attempt %d): %s . Retrying in: %s", attempt, err, delay)
+		q.sleep(delay)
+	}
+}
+
+// Sleep for "d", or until the queue is stopped
+func (q *workQueue) sleep(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-q.stop:
+	}
+}
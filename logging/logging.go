@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+////////
+//////// Structured logging of the K8S / VSD clients: One JSON object per line on stderr
+////////
+
+//// XXX - Notes:
+//// - The K8S event handlers and VSD operations log with the context of the object being handled (see the "Field..." keys). Empty fields are left out
+//// - The level ("log-level" setting) can be changed at runtime through the "/loglevel" HTTP endpoint, served on "admin-address" (see "LevelHandler" and main: adminServer)
+//// - The agent startup, leader election and configuration handling still log through glog
+
+// Context fields
+const (
+	FieldComponent = "component" // E.g. "k8s-client"
+	FieldOp        = "op"        // The operation, e.g. "create"
+	FieldKind      = "kind"      // K8S object kind, e.g. "Pod"
+	FieldName      = "name"      // K8S object name
+	FieldPod       = "pod"       // K8S pod name
+	FieldNamespace = "namespace" // K8S namespace
+	FieldUID       = "uid"       // K8S object UID
+	FieldNode      = "node"      // K8S node
+	FieldVSDID     = "vsd_id"    // VSD object ID
+	FieldVSDName   = "vsd_name"  // VSD object name
+	FieldQueue     = "queue"     // K8S event work queue, e.g. "Pods"
+	FieldEvent     = "event"     // K8S event, e.g. "Add Pod"
+)
+
+var (
+	// The structured logger
+	Log = newLogger()
+
+	levelMutex sync.Mutex
+)
+
+func newLogger() *logrus.Logger {
+	l := logrus.New()
+	l.Out = os.Stderr
+	l.Formatter = new(logrus.JSONFormatter)
+	return l
+}
+
+// Add context fields to a logger, leaving out the empty ones
+func With(entry *logrus.Entry, fields logrus.Fields) *logrus.Entry {
+	set := make(logrus.Fields, len(fields))
+	for k, v := range fields {
+		if s, ok := v.(string); ok && s == "" {
+			continue
+		}
+		set[k] = v
+	}
+	return entry.WithFields(set)
+}
+
+// Set the log level: "debug", "info", "warning", "error", "fatal" or "panic"
+// XXX - logrus reads the level without synchronization. Changing it while logging is benign: Lines are logged as per either level
+func SetLevel(level string) error {
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	levelMutex.Lock()
+	defer levelMutex.Unlock()
+
+	if l != Log.Level {
+		Log.Level = l
+		Log.WithField(FieldOp, "set-log-level").Infof("Log level set to: %s", l)
+	}
+	return nil
+}
+
+func GetLevel() string {
+	levelMutex.Lock()
+	defer levelMutex.Unlock()
+
+	return Log.Level.String()
+}
+
+// HTTP endpoint for the log level:
+//
+//	GET  /loglevel              -> {"level": "info"}
+//	PUT  /loglevel?level=debug  -> Sets the level. Also accepts POST
+func LevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		if err := SetLevel(r.URL.Query().Get("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed: "+r.Method, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": GetLevel()})
+}
@@ -2,14 +2,18 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"path"
+	"sync/atomic"
+	"time"
 
 	cniclient "github.com/OpenPlatformSDN/nuage-k8s-cni/cni-agent-client"
 	etcdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/etcd-client"
 
 	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
 	k8sclient "github.com/OpenPlatformSDN/nuage-k8s-cni/k8s-client"
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
 	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
 
 	"github.com/golang/glog"
@@ -17,9 +21,14 @@ import (
 
 const errorLogLevel = 2
 
+// Interval between the two checks of a one-shot IPAM check with repairs
+const ipamRepairGrace = 30 * time.Second
+
 var (
 	// Top level Agent Configuration
 	Config *config.AgentConfig
+	// The configuration in effect once the agent runs: Replaced as a whole -- never modified in place -- by configuration reloads. See "currentConfig"
+	liveConfig atomic.Value // *config.AgentConfig
 	// MasterConfig  = masterConfig{}
 	// NetworkConfig = networkConfig{}
 	UseNetPolicies = false
@@ -32,13 +41,28 @@ func main() {
 	config.Flags(Config, flag.CommandLine)
 	flag.Parse()
 
-	if len(os.Args) == 1 { // With no arguments, print default usage
+	if len(os.Args) == 1 && !config.EnvConfigured() { // With no arguments nor NUAGE_* environment variables, print default usage
 		flag.PrintDefaults()
 		os.Exit(0)
 	}
 	// Flush the logs upon exit
 	defer glog.Flush()
 
+	// Configured through the environment only (e.g. K8S Deployment): The default configuration file is optional
+	if !flagGiven("config") && config.EnvConfigured() {
+		if _, err := os.Stat(Config.ConfigFile); os.IsNotExist(err) {
+			Config.ConfigFile = ""
+		}
+	}
+
+	// E.g. NUAGE_VALIDATE_CONFIG. Invalid values are reported when loading the configuration below
+	config.ApplyEnv(Config)
+
+	// Validate the configuration only. Before loading it: All the problems are reported, incl. the configuration file ones
+	if Config.ValidateOnly {
+		os.Exit(validateConfig())
+	}
+
 	glog.Infof("===> Starting %s...", path.Base(os.Args[0]))
 
 	if err := config.LoadAgentConfig(Config); err != nil {
@@ -46,11 +70,38 @@ func main() {
 		os.Exit(255)
 	}
 
+	if err := resolveMasterConfig(Config); err != nil {
+		glog.Errorf("Cannot load K8S master configuration: %s", err)
+		os.Exit(255)
+	}
+
+	if errs := Config.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			glog.Errorf("Invalid configuration: %s", err)
+		}
+		os.Exit(255)
+	}
+
+	// Validated above
+	logging.SetLevel(Config.LogLevel)
+
+	// One-shot policy audit / IPAM check. No leader election needed (read-only unless drift correction / repairs are enabled)
+	if Config.Audit || Config.IPAMCheck {
+		os.Exit(oneshot())
+	}
+
 	if err := etcdclient.InitClient(Config); err != nil {
 		glog.Errorf("ETCD client error: %s", err)
 		os.Exit(255)
 	}
 
+	liveConfig.Store(Config)
+
+	go shutdownOnSignal()
+
+	// Before the leader election: Standby agents serve them as well
+	go adminServer(Config.AdminAddress)
+
 	// XXX  -- This will block until we get a Leader lock from etcd
 
 	etcdclient.LeaderElection()
@@ -72,6 +123,162 @@ func main() {
 
 	go k8sclient.EventWatcher()
 
+	go configReloader()
+
+	// Until shutdown (see shutdown.go)
 	select {}
 
 }
+
+// The configuration in effect, once the agent runs (see reload.go)
+func currentConfig() *config.AgentConfig {
+	return liveConfig.Load().(*config.AgentConfig)
+}
+
+// Load and validate the configuration, print all the problems found. Returns the exit status
+func validateConfig() int {
+	var problems []error
+
+	// Continue with whatever was loaded: E.g. unknown settings are reported after loading the known ones
+	if err := config.LoadAgentConfig(Config); err != nil {
+		problems = append(problems, fmt.Errorf("%s: %s", Config.ConfigFile, err))
+	}
+
+	if err := resolveMasterConfig(Config); err != nil {
+		problems = append(problems, err)
+	}
+
+	problems = append(problems, Config.Validate()...)
+
+	if err := vsdclient.ValidateNaming(Config); err != nil {
+		problems = append(problems, fmt.Errorf("naming-config: %s", err))
+	}
+
+	for _, p := range problems {
+		fmt.Printf("- %s\n", p)
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("Configuration file: %s : %d problem(s) found\n", Config.ConfigFile, len(problems))
+		return 1
+	}
+
+	fmt.Printf("Configuration file: %s : OK\n", Config.ConfigFile)
+	return 0
+}
+
+// Resolve the K8S master configuration: The K8S master configuration file, the network config of the K8S master ConfigMap over it, then the NUAGE_* environment variables
+func resolveMasterConfig(conf *config.AgentConfig) error {
+	master := new(config.MasterConfig)
+
+	if conf.MasterConfigFile != "" {
+		var err error
+		if master, err = config.LoadMasterConfig(conf.MasterConfigFile); err != nil {
+			return fmt.Errorf("k8s-master-config: %s : %s", conf.MasterConfigFile, err)
+		}
+	}
+
+	if conf.MasterConfigMap != "" {
+		data, err := k8sclient.MasterConfigMap(conf)
+		if err != nil {
+			return fmt.Errorf("k8s-master-configmap: %s", err)
+		}
+		if err := config.ApplyMasterConfigMap(master, data); err != nil {
+			return fmt.Errorf("k8s-master-configmap: %s : %s", conf.MasterConfigMap, err)
+		}
+	}
+
+	conf.MasterConfig = *master
+	return config.ApplyEnv(&conf.MasterConfig)
+}
+
+// Whether the given flag was given on the command line
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// Run the one-shot policy audit and / or IPAM check. Returns the exit status
+func oneshot() int {
+	// etcd holds the agent state, e.g. the quarantined pod IP addresses
+	if err := etcdclient.InitClient(Config); err != nil {
+		glog.Errorf("ETCD client error: %s", err)
+		return 255
+	}
+
+	if err := vsdclient.InitClient(Config); err != nil {
+		glog.Errorf("VSD client error: %s", err)
+		return 255
+	}
+
+	if err := k8sclient.InitClient(Config); err != nil {
+		glog.Errorf("Kubernetes client error: %s", err)
+		return 255
+	}
+
+	status := 0
+
+	if Config.Audit {
+		status = audit()
+	}
+
+	if Config.IPAMCheck {
+		if ipamstatus := ipamCheck(); ipamstatus > status {
+			status = ipamstatus
+		}
+	}
+
+	return status
+}
+
+// Audit the VSD Policy Elements against the Kubernetes state. Returns the exit status
+func audit() int {
+	report, err := k8sclient.Audit(Config.PolicyConfig.AuditCorrect)
+	if err != nil {
+		glog.Errorf("Policy audit error: %s", err)
+		return 255
+	}
+
+	fmt.Print(report)
+
+	if report.Drift() {
+		return 1
+	}
+	return 0
+}
+
+// Check the pod IP addresses in Kubernetes against the VSD Container interfaces and subnet allocators. Returns the exit status
+// XXX - Leaks are repaired only if found by two consecutive checks. With repairs enabled, the check runs twice, "ipamRepairGrace" apart
+func ipamCheck() int {
+	if err := k8sclient.LoadNamespaces(); err != nil {
+		glog.Errorf("IPAM check error: %s", err)
+		return 255
+	}
+
+	report, err := k8sclient.IPAMCheck(false)
+	if err != nil {
+		glog.Errorf("IPAM check error: %s", err)
+		return 255
+	}
+
+	if Config.IpamConfig.CheckRepair && len(report.Leaks) > 0 {
+		glog.Infof("IPAM check found %d leaks. Checking again in %s before repairing...", len(report.Leaks), ipamRepairGrace)
+		time.Sleep(ipamRepairGrace)
+		if report, err = k8sclient.IPAMCheck(true); err != nil {
+			glog.Errorf("IPAM check error: %s", err)
+			return 255
+		}
+	}
+
+	fmt.Print(report)
+
+	if report.Inconsistent() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/OpenPlatformSDN/client-go/kubernetes"
+	apiv1 "github.com/OpenPlatformSDN/client-go/pkg/api/v1"
+	metav1 "github.com/OpenPlatformSDN/client-go/pkg/apis/meta/v1"
+
+	cniagent "github.com/OpenPlatformSDN/cni-plugin/nuage-cni-agent/client"
+	cniclient "github.com/OpenPlatformSDN/nuage-k8s-cni/cni-agent-client"
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
+	k8sclient "github.com/OpenPlatformSDN/nuage-k8s-cni/k8s-client"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
+
+	"github.com/nuagenetworks/go-bambou/bambou"
+	"github.com/nuagenetworks/vspk-go/vspk"
+)
+
+////
+//// nuage-k8s-ctl: Inspect the K8S <-> VSD mappings made by the Nuage K8S masters agent. Read-only
+////
+//// Usage: nuage-k8s-ctl [-config <agent config file>] [-o text|json] <command>
+////
+//// Commands:
+//// - pod <namespace>/<name>: VSD Container, Zone, Subnet, IP / MAC, Policy Elements in effect, CNI agent record on the pod's node
+//// - namespace <name>: VSD Zone, Subnets, Containers, services Network Macro Group, Policy Elements referring to the namespace
+//// - service <namespace>/<name>: VSD Network Macros, endpoints Network Macro Group, Policy Elements referring to the service
+////
+//// Uses the agent configuration file (same flags as the agent) for the VSD, K8S API and CNI agent connections
+////
+//// XXX - Notes:
+//// - The VSD names are derived from the K8S names as per the agent conventions (see vsd-client/naming.go)
+//// - The VSD Enterprise / Domain of a namespace is the one in the tenants mapping file, if any (see vsd-client/tenants.go)
+//// - For pods, the Policy Elements "in effect" are those with a scope matching the pod: Any, MyDomain / MyZone / MySubnet, its Zone, Subnet, Policy Group, and the endpoints of the services it backs
+//// - Logs go to the log files as per the "glog" flags. Results go to stdout
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var (
+	// Agent configuration
+	Config *config.AgentConfig
+
+	// Output format: "text" or "json"
+	output string
+
+	clientset *kubernetes.Clientset
+)
+
+// A VSD object. Empty ID if not found on the VSD
+type vsdObject struct {
+	Name    string      `json:"name"`
+	ID      string      `json:"id,omitempty"`
+	Address string      `json:"address,omitempty"`
+	Netmask string      `json:"netmask,omitempty"`
+	Members []vsdObject `json:"members,omitempty"`
+}
+
+// A Policy Element applied to the Domain
+type peInfo struct {
+	Policy   string `json:"policy"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Traffic  string `json:"traffic"`
+	Action   string `json:"action"`
+}
+
+type podReport struct {
+	Pod            string                   `json:"pod"`
+	Domain         string                   `json:"domain"` // <Enterprise>/<Domain>
+	Node           string                   `json:"node"`
+	PodIP          string                   `json:"podIP"`
+	Container      vsdObject                `json:"container"`
+	Interface      *vspk.ContainerInterface `json:"interface,omitempty"`
+	Zone           vsdObject                `json:"zone"`
+	Subnet         vsdObject                `json:"subnet"`
+	PolicyGroup    string                   `json:"policyGroup,omitempty"`
+	Endpoints      []vsdObject              `json:"endpoints,omitempty"` // Network Macro Groups for the endpoints of the services the pod backs
+	PolicyElements []peInfo                 `json:"policyElements"`
+	AgentRecord    *vspk.Container          `json:"cniAgentRecord,omitempty"`
+	AgentError     string                   `json:"cniAgentError,omitempty"`
+}
+
+type namespaceReport struct {
+	Namespace      string      `json:"namespace"`
+	Domain         string      `json:"domain"` // <Enterprise>/<Domain>
+	Zone           vsdObject   `json:"zone"`
+	Subnets        []vsdObject `json:"subnets"`
+	Containers     []vsdObject `json:"containers"`
+	Services       vsdObject   `json:"services"`
+	PolicyElements []peInfo    `json:"policyElements"`
+}
+
+type serviceReport struct {
+	Service        string      `json:"service"`
+	Domain         string      `json:"domain"` // <Enterprise>/<Domain>
+	ClusterIP      string      `json:"clusterIP"`
+	NetworkMacros  []vsdObject `json:"networkMacros"`
+	Services       vsdObject   `json:"services"`
+	Endpoints      vsdObject   `json:"endpoints"`
+	PolicyElements []peInfo    `json:"policyElements"`
+}
+
+func main() {
+	Config = new(config.AgentConfig)
+
+	config.Flags(Config, flag.CommandLine)
+	flag.StringVar(&output, "o", outputText, "output format: \"text\" or \"json\"")
+	flag.Usage = usage
+	flag.Parse()
+
+	defer glog.Flush()
+
+	if flag.NArg() != 2 || (output != outputText && output != outputJSON) {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := config.LoadAgentConfig(Config); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read configuration file: %s\n", err)
+		os.Exit(255)
+	}
+
+	if err := vsdclient.Connect(Config); err != nil {
+		fmt.Fprintf(os.Stderr, "VSD client error: %s\n", err)
+		os.Exit(255)
+	}
+
+	kubeconfig, err := k8sclient.RestConfig(Config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Kubernetes client error: %s\n", err)
+		os.Exit(255)
+	}
+
+	if clientset, err = kubernetes.NewForConfig(kubeconfig); err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating Kubernetes client: %s\n", err)
+		os.Exit(255)
+	}
+
+	var report interface{}
+
+	switch cmd, arg := flag.Arg(0), flag.Arg(1); cmd {
+	case "pod":
+		report, err = inspectPod(arg)
+	case "namespace", "ns":
+		report, err = inspectNamespace(arg)
+	case "service", "svc":
+		report, err = inspectService(arg)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	if output == outputJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+
+	switch r := report.(type) {
+	case *podReport:
+		printPod(r)
+	case *namespaceReport:
+		printNamespace(r)
+	case *serviceReport:
+		printService(r)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] pod <namespace>/<name> | namespace <name> | service <namespace>/<name>\n\nFlags:\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+////////
+//////// Commands
+////////
+
+func inspectPod(arg string) (*podReport, error) {
+	namespace, name, err := splitName(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	pod, err := clientset.Core().Pods(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, bambou.NewBambouError("Cannot fetch K8S pod: "+arg, err.Error())
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &podReport{
+		Pod:         arg,
+		Domain:      tenant.String(),
+		Node:        pod.Spec.NodeName,
+		PodIP:       pod.Status.PodIP,
+		PolicyGroup: pod.ObjectMeta.Labels["nuage.io/PolicyGroup"],
+	}
+
+	container := new(vsdclient.Container)
+	container.Name = vsdclient.ContainerName(namespace, name)
+	if err := container.FetchByName(tenant); err != nil {
+		return nil, err
+	}
+	report.Container = vsdObject{Name: container.Name, ID: container.ID}
+
+	zone := new(vsdclient.Zone)
+	zone.Name = vsdclient.ZoneName(namespace)
+
+	if container.ID != "" {
+		if report.Interface, err = container.Interface(); err != nil {
+			return nil, err
+		}
+		// The pod may be in a Zone other than the namespace one, e.g. for a custom Subnet
+		if report.Interface.ZoneName != "" {
+			zone.Name = report.Interface.ZoneName
+		}
+	}
+
+	if err := zone.FetchByName(tenant); err != nil {
+		return nil, err
+	}
+	report.Zone = vsdObject{Name: zone.Name, ID: zone.ID}
+
+	scopes := map[string]bool{
+		string(netpolicy.LAny):                        true,
+		string(netpolicy.MyDomain):                    true,
+		string(netpolicy.MyZone):                      true,
+		string(netpolicy.MySubnet):                    true,
+		scopeKey(string(netpolicy.LZone), &zone.Name): true,
+	}
+
+	if report.Interface != nil {
+		subnets, err := zoneSubnets(zone)
+		if err != nil {
+			return nil, err
+		}
+		report.Subnet = vsdObject{Name: report.Interface.NetworkName, ID: report.Interface.NetworkID}
+		for _, subnet := range subnets {
+			if subnet.ID == report.Interface.NetworkID {
+				report.Subnet = subnet
+			}
+		}
+		scopes[scopeKey(string(netpolicy.LSubnet), &report.Subnet.Name)] = true
+	}
+
+	if report.PolicyGroup != "" {
+		scopes[scopeKey(string(netpolicy.LPolicyGroup), &report.PolicyGroup)] = true
+	}
+
+	// The services the pod backs
+	podIP := report.PodIP
+	if podIP == "" && report.Interface != nil {
+		podIP = report.Interface.IPAddress
+	}
+
+	if podIP != "" {
+		nmname := vsdclient.EndpointNMName(namespace, podIP)
+		scopes[scopeKey(string(netpolicy.NetworkMacro), &nmname)] = true
+
+		eplist, err := clientset.Core().Endpoints(namespace).List(apiv1.ListOptions{})
+		if err != nil {
+			return nil, bambou.NewBambouError("Cannot fetch the K8S endpoints in namespace: "+namespace, err.Error())
+		}
+
+		for _, ep := range eplist.Items {
+			if !endpointsHaveIP(&ep, podIP) {
+				continue
+			}
+			nmg := new(vsdclient.NetworkMacroGroup)
+			nmg.Name = vsdclient.EndpointsNMGName(namespace, ep.ObjectMeta.Name)
+			if err := nmg.FetchByName(tenant); err != nil {
+				return nil, err
+			}
+			report.Endpoints = append(report.Endpoints, vsdObject{Name: nmg.Name, ID: nmg.ID})
+			scopes[scopeKey(string(netpolicy.NetworkMacroGroup), &nmg.Name)] = true
+		}
+	}
+
+	if report.PolicyElements, err = policyElements(tenant, func(pe *netpolicy.PolicyElement) bool {
+		return scopes[scopeKey(pe.From.Type, pe.From.Name)] || scopes[scopeKey(pe.To.Type, pe.To.Name)]
+	}); err != nil {
+		return nil, err
+	}
+
+	// CNI agent record on the pod's node
+	if report.Node != "" {
+		if err := cniclient.InitClient(Config); err != nil {
+			report.AgentError = err.Error()
+		} else {
+			agentclient, agentport := cniclient.Agent()
+			if report.AgentRecord, err = cniagent.ContainerGET(agentclient, report.Node, agentport, container.Name); err != nil {
+				report.AgentRecord = nil
+				report.AgentError = err.Error()
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func inspectNamespace(namespace string) (*namespaceReport, error) {
+	if _, err := clientset.Core().Namespaces().Get(namespace, metav1.GetOptions{}); err != nil {
+		return nil, bambou.NewBambouError("Cannot fetch K8S namespace: "+namespace, err.Error())
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &namespaceReport{Namespace: namespace, Domain: tenant.String()}
+
+	zone := new(vsdclient.Zone)
+	zone.Name = vsdclient.ZoneName(namespace)
+	if err := zone.FetchByName(tenant); err != nil {
+		return nil, err
+	}
+	report.Zone = vsdObject{Name: zone.Name, ID: zone.ID}
+
+	scopes := map[string]bool{
+		scopeKey(string(netpolicy.LZone), &zone.Name): true,
+	}
+
+	if zone.ID != "" {
+		if report.Subnets, err = zoneSubnets(zone); err != nil {
+			return nil, err
+		}
+		for _, subnet := range report.Subnets {
+			scopes[scopeKey(string(netpolicy.LSubnet), &subnet.Name)] = true
+		}
+
+		containers, berr := (*vspk.Zone)(zone).Containers(&bambou.FetchingInfo{})
+		if berr != nil {
+			return nil, bambou.NewBambouError("Cannot fetch the Containers in Zone: "+zone.Name, berr.Error())
+		}
+		for _, c := range containers {
+			container := vsdObject{Name: c.Name, ID: c.ID}
+			if ciface, err := (*vsdclient.Container)(c).Interface(); err == nil {
+				container.Address = ciface.IPAddress
+				container.Netmask = ciface.Netmask
+			}
+			report.Containers = append(report.Containers, container)
+		}
+	}
+
+	nmg := new(vsdclient.NetworkMacroGroup)
+	nmg.Name = vsdclient.ServicesNMGName(namespace)
+	if err := nmg.FetchByName(tenant); err != nil {
+		return nil, err
+	}
+	report.Services = vsdObject{Name: nmg.Name, ID: nmg.ID}
+	if nmg.ID != "" {
+		members, err := nmg.Members()
+		if err != nil {
+			return nil, err
+		}
+		report.Services.Members = networkMacros(members)
+		scopes[scopeKey(string(netpolicy.NetworkMacroGroup), &nmg.Name)] = true
+	}
+
+	if report.PolicyElements, err = policyElements(tenant, func(pe *netpolicy.PolicyElement) bool {
+		return strings.HasPrefix(pe.Name, vsdclient.NamespacePEPrefix(namespace)) ||
+			scopes[scopeKey(pe.From.Type, pe.From.Name)] || scopes[scopeKey(pe.To.Type, pe.To.Name)]
+	}); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func inspectService(arg string) (*serviceReport, error) {
+	namespace, name, err := splitName(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err := clientset.Core().Services(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, bambou.NewBambouError("Cannot fetch K8S service: "+arg, err.Error())
+	}
+
+	tenant, err := vsdclient.NamespaceTenant(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &serviceReport{Service: arg, Domain: tenant.String(), ClusterIP: svc.Spec.ClusterIP}
+
+	scopes := make(map[string]bool)
+
+	nmg := new(vsdclient.NetworkMacroGroup)
+	nmg.Name = vsdclient.ServicesNMGName(namespace)
+	if err := nmg.FetchByName(tenant); err != nil {
+		return nil, err
+	}
+	report.Services = vsdObject{Name: nmg.Name, ID: nmg.ID}
+
+	// The Network Macros of the service, in the services Network Macro Group
+	var nmnames []string
+	if apiv1.IsServiceIPSet(svc) {
+		nmnames = append(nmnames, vsdclient.ServiceNMName(namespace, name))
+	}
+	for _, extip := range svc.Spec.ExternalIPs {
+		nmnames = append(nmnames, vsdclient.ServiceExternalIPNMName(namespace, name, extip))
+	}
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			nmnames = append(nmnames, vsdclient.ServiceIngressIPNMName(namespace, name, ingress.IP))
+		}
+	}
+
+	for _, nmname := range nmnames {
+		nm := new(vsdclient.NetworkMacro)
+		nm.Name = nmname
+		if err := nm.FetchByName(tenant); err != nil {
+			return nil, err
+		}
+		report.NetworkMacros = append(report.NetworkMacros, vsdObject{Name: nm.Name, ID: nm.ID, Address: nm.Address, Netmask: nm.Netmask})
+		scopes[scopeKey(string(netpolicy.NetworkMacro), &nm.Name)] = true
+	}
+
+	epnmg := new(vsdclient.NetworkMacroGroup)
+	epnmg.Name = vsdclient.EndpointsNMGName(namespace, name)
+	if err := epnmg.FetchByName(tenant); err != nil {
+		return nil, err
+	}
+	report.Endpoints = vsdObject{Name: epnmg.Name, ID: epnmg.ID}
+	if epnmg.ID != "" {
+		members, err := epnmg.Members()
+		if err != nil {
+			return nil, err
+		}
+		report.Endpoints.Members = networkMacros(members)
+		scopes[scopeKey(string(netpolicy.NetworkMacroGroup), &epnmg.Name)] = true
+	}
+
+	if report.PolicyElements, err = policyElements(tenant, func(pe *netpolicy.PolicyElement) bool {
+		return strings.HasPrefix(pe.Name, vsdclient.ServicePEPrefix(namespace, name)) ||
+			scopes[scopeKey(pe.From.Type, pe.From.Name)] || scopes[scopeKey(pe.To.Type, pe.To.Name)]
+	}); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+////////
+//////// Text output
+////////
+
+func printPod(r *podReport) {
+	fmt.Printf("Pod: %s\n", r.Pod)
+	fmt.Printf("  VSD Domain: %s\n", r.Domain)
+	fmt.Printf("  Node: %s\n", r.Node)
+	fmt.Printf("  Pod IP: %s\n", r.PodIP)
+	fmt.Printf("VSD Container: %s\n", objectString(r.Container))
+	if r.Interface != nil {
+		fmt.Printf("  IP address: %s/%s, gateway: %s\n", r.Interface.IPAddress, r.Interface.Netmask, r.Interface.Gateway)
+		fmt.Printf("  MAC: %s\n", r.Interface.MAC)
+	}
+	fmt.Printf("VSD Zone: %s\n", objectString(r.Zone))
+	if r.Subnet.Name != "" {
+		fmt.Printf("VSD Subnet: %s\n", objectString(r.Subnet))
+	}
+	if r.PolicyGroup != "" {
+		fmt.Printf("VSD Policy Group: %s\n", r.PolicyGroup)
+	}
+	for _, nmg := range r.Endpoints {
+		fmt.Printf("VSD Network Macro Group: %s\n", objectString(nmg))
+	}
+	printPolicyElements(r.PolicyElements)
+	switch {
+	case r.AgentRecord != nil:
+		data, _ := json.MarshalIndent(r.AgentRecord, "  ", "  ")
+		fmt.Printf("CNI agent record on node: %s\n  %s\n", r.Node, data)
+	case r.AgentError != "":
+		fmt.Printf("CNI agent record on node: %s: %s\n", r.Node, r.AgentError)
+	}
+}
+
+func printNamespace(r *namespaceReport) {
+	fmt.Printf("Namespace: %s\n", r.Namespace)
+	fmt.Printf("  VSD Domain: %s\n", r.Domain)
+	fmt.Printf("VSD Zone: %s\n", objectString(r.Zone))
+	for _, subnet := range r.Subnets {
+		fmt.Printf("VSD Subnet: %s\n", objectString(subnet))
+	}
+	fmt.Printf("VSD Containers (%d):\n", len(r.Containers))
+	for _, container := range r.Containers {
+		fmt.Printf("  %s\n", objectString(container))
+	}
+	fmt.Printf("VSD Network Macro Group: %s\n", objectString(r.Services))
+	for _, nm := range r.Services.Members {
+		fmt.Printf("  %s\n", objectString(nm))
+	}
+	printPolicyElements(r.PolicyElements)
+}
+
+func printService(r *serviceReport) {
+	fmt.Printf("Service: %s\n", r.Service)
+	fmt.Printf("  VSD Domain: %s\n", r.Domain)
+	fmt.Printf("  Cluster IP: %s\n", r.ClusterIP)
+	for _, nm := range r.NetworkMacros {
+		fmt.Printf("VSD Network Macro: %s\n", objectString(nm))
+	}
+	fmt.Printf("VSD Network Macro Group: %s\n", objectString(r.Services))
+	fmt.Printf("VSD Network Macro Group: %s\n", objectString(r.Endpoints))
+	for _, nm := range r.Endpoints.Members {
+		fmt.Printf("  %s\n", objectString(nm))
+	}
+	printPolicyElements(r.PolicyElements)
+}
+
+func printPolicyElements(pes []peInfo) {
+	fmt.Printf("Policy Elements (%d):\n", len(pes))
+	for _, pe := range pes {
+		fmt.Printf("  %s %s, priority %d: %s\n", pe.Type, pe.Policy, pe.Priority, pe.Name)
+		fmt.Printf("    %s %s -> %s, %s\n", pe.Action, pe.From, pe.To, pe.Traffic)
+	}
+}
+
+func objectString(o vsdObject) string {
+	s := o.Name
+	if o.Address != "" {
+		s += " (" + o.Address
+		if o.Netmask != "" {
+			s += "/" + o.Netmask
+		}
+		s += ")"
+	}
+	if o.ID == "" {
+		return s + " -- not found on the VSD"
+	}
+	return s + " ID: " + o.ID
+}
+
+///// Auxilary functions
+
+// "<namespace>/<name>"
+func splitName(arg string) (string, string, error) {
+	parts := strings.SplitN(arg, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", bambou.NewBambouError("Invalid name: "+arg, "Expected: <namespace>/<name>")
+	}
+	return parts[0], parts[1], nil
+}
+
+// Policy scope as "<type> <name>" (or "<type>" for unnamed scopes)
+func scopeKey(stype string, name *string) string {
+	if name == nil {
+		return stype
+	}
+	return stype + " " + *name
+}
+
+// The Subnets of a Zone, straight from the VSD (no IPAM side effects, see vsdclient.Zone.Subnets)
+func zoneSubnets(zone *vsdclient.Zone) ([]vsdObject, error) {
+	sl, err := (*vspk.Zone)(zone).Subnets(&bambou.FetchingInfo{})
+	if err != nil {
+		return nil, bambou.NewBambouError("Cannot fetch list of Subnets for Zone: "+zone.Name, err.Error())
+	}
+
+	var subnets []vsdObject
+	for _, s := range sl {
+		subnets = append(subnets, vsdObject{Name: s.Name, ID: s.ID, Address: s.Address, Netmask: s.Netmask})
+	}
+	return subnets, nil
+}
+
+func networkMacros(nms []*vsdclient.NetworkMacro) []vsdObject {
+	var objects []vsdObject
+	for _, nm := range nms {
+		objects = append(objects, vsdObject{Name: nm.Name, ID: nm.ID, Address: nm.Address, Netmask: nm.Netmask})
+	}
+	return objects
+}
+
+func endpointsHaveIP(ep *apiv1.Endpoints, ip string) bool {
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			if addr.IP == ip {
+				return true
+			}
+		}
+		for _, addr := range subset.NotReadyAddresses {
+			if addr.IP == ip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The Policy Elements applied to the Domain of the tenant, in any Policy, matching the given filter. Sorted by Policy type, then priority
+func policyElements(tenant *vsdclient.Tenant, match func(*netpolicy.PolicyElement) bool) ([]peInfo, error) {
+	policies, err := tenant.Policies()
+	if err != nil {
+		return nil, err
+	}
+
+	traffic := func(ts netpolicy.TrafficSpec) string {
+		if ts.Protocol == netpolicy.ProtoAny || ts.DstPortRange == nil {
+			return string(ts.Protocol)
+		}
+		return string(ts.Protocol) + "/" + *ts.DstPortRange
+	}
+
+	pes := []peInfo{}
+	for _, p := range policies {
+		for i := range p.PolicyElements {
+			pe := &p.PolicyElements[i]
+			if !match(pe) {
+				continue
+			}
+			pes = append(pes, peInfo{
+				Policy:   p.Name,
+				Type:     string(p.Type),
+				Name:     pe.Name,
+				Priority: pe.Priority,
+				From:     scopeKey(pe.From.Type, pe.From.Name),
+				To:       scopeKey(pe.To.Type, pe.To.Name),
+				Traffic:  traffic(pe.TrafficSpec),
+				Action:   string(pe.Action),
+			})
+		}
+	}
+
+	sort.SliceStable(pes, func(i, j int) bool {
+		if pes[i].Type != pes[j].Type {
+			return pes[i].Type > pes[j].Type // Ingress first
+		}
+		return pes[i].Priority < pes[j].Priority
+	})
+
+	return pes, nil
+}
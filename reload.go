@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	cniclient "github.com/OpenPlatformSDN/nuage-k8s-cni/cni-agent-client"
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+
+	"github.com/golang/glog"
+)
+
+////
+//// Configuration reload: On SIGHUP, or when the configuration file or the files it references (VSD certificate / key / credentials, CNI CA) change
+////
+//// XXX - Notes:
+//// - Only the VSD connection, CNI Agent client and log level settings are applied live ("liveSettings"): The VSD session / CNI Agent client TLS transport are rebuilt in place.
+////   A new configuration changing any other setting (e.g. the VSD Domain) is rejected as a whole, and the current one is kept -- restart the agent for those
+//// - The new configuration is validated as at startup (see config.Validate), then by establishing the new VSD session / loading the new CNI CA before switching to it
+//// - Files are polled every "configPollInterval" (content checksums, as K8S ConfigMap / Secret mounts replace the files via symlinks)
+//// - Settings removed from the configuration file keep their current value (the file is loaded over the current configuration, as at startup over the flags)
+//// - The new configuration is loaded into a copy of the current one, then published as a whole (see "currentConfig"): The current configuration is never modified in place.
+////   The CNI Agent client and port are switched together (see cni-agent-client "SetAgent")
+
+const configPollInterval = 30 * time.Second
+
+// Configuration file settings applied without a restart
+var liveSettings = map[string]bool{
+	"vsd-config.vsd-url":       true,
+	"vsd-config.certFile":      true,
+	"vsd-config.keyFile":       true,
+	"vsd-config.username":      true,
+	"vsd-config.username-file": true,
+	"vsd-config.password":      true,
+	"vsd-config.password-file": true,
+	"vsd-config.organization":  true,
+	"cni-config.server-port":   true,
+	"cni-config.caFile":        true,
+	"log-level":                true,
+}
+
+// Watch for configuration changes and reload. Does not return
+func configReloader() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	checksums := watchedFiles(currentConfig())
+
+	for {
+		select {
+		case <-hup:
+			glog.Info("Received SIGHUP, reloading the configuration")
+		case <-ticker.C:
+			if current := watchedFiles(currentConfig()); changedFiles(checksums, current) == nil {
+				continue
+			}
+			glog.Info("Configuration files changed, reloading the configuration")
+		}
+
+		// On failure the files are not checked again until they change again
+		checksums = reloadConfig(checksums)
+	}
+}
+
+// Reload the configuration. Returns the checksums of the watched files the current configuration is based on
+func reloadConfig(checksums map[string][32]byte) map[string][32]byte {
+	conf := currentConfig()
+
+	newconf := *conf
+	if err := config.LoadAgentConfig(&newconf); err != nil {
+		glog.Errorf("Configuration reload: Cannot read configuration file: %s . Keeping the current configuration", err)
+		return watchedFiles(conf)
+	}
+
+	current := watchedFiles(&newconf)
+
+	if errs := newconf.Validate(); len(errs) > 0 {
+		for _, err := range errs {
+			glog.Errorf("Configuration reload rejected: Invalid configuration: %s", err)
+		}
+		return current
+	}
+
+	changed := config.Changes(conf, &newconf)
+
+	var restart []string
+	vsdChanged, cniChanged, logChanged := false, false, false
+	for _, setting := range changed {
+		switch {
+		case !liveSettings[setting]:
+			restart = append(restart, setting)
+		case setting == "log-level":
+			logChanged = true
+		case strings.HasPrefix(setting, "vsd-config."):
+			vsdChanged = true
+		case strings.HasPrefix(setting, "cni-config."):
+			cniChanged = true
+		}
+	}
+
+	if len(restart) > 0 {
+		glog.Errorf("Configuration reload rejected: Changing: %s requires an agent restart. Keeping the current configuration", strings.Join(restart, ", "))
+		return current
+	}
+
+	// Referenced files with new contents, e.g. rotated certificates
+	for _, fname := range changedFiles(checksums, current) {
+		switch fname {
+		case newconf.VsdConfig.CertFile, newconf.VsdConfig.KeyFile, newconf.VsdConfig.UsernameFile, newconf.VsdConfig.PasswordFile:
+			vsdChanged = true
+		case newconf.CniConfig.CaFile:
+			cniChanged = true
+		}
+	}
+
+	if !vsdChanged && !cniChanged && !logChanged {
+		glog.Info("Configuration reload: No changes")
+		return current
+	}
+
+	var agentclient *http.Client
+	if cniChanged {
+		var err error
+		if agentclient, err = cniclient.NewAgentClient(&newconf); err != nil {
+			glog.Errorf("Configuration reload rejected: %s . Keeping the current configuration", err)
+			return current
+		}
+	}
+
+	if vsdChanged {
+		if err := vsdclient.Reconnect(&newconf); err != nil {
+			glog.Errorf("Configuration reload rejected: %s . Keeping the current configuration", err)
+			return current
+		}
+		glog.Info("Configuration reload: VSD session re-established")
+	}
+
+	if cniChanged {
+		cniclient.SetAgent(agentclient, newconf.CniConfig.ServerPort)
+		glog.Info("Configuration reload: CNI Agent client re-created")
+	}
+
+	// XXX - Overrides any level set through the "/loglevel" endpoint meanwhile
+	if logChanged {
+		logging.SetLevel(newconf.LogLevel)
+	}
+
+	liveConfig.Store(&newconf)
+	glog.Infof("Configuration reloaded. Changed settings: %s", strings.Join(changed, ", "))
+	return current
+}
+
+// Checksums of the configuration file and the files it references. Unreadable files are left out
+func watchedFiles(conf *config.AgentConfig) map[string][32]byte {
+	resp := make(map[string][32]byte)
+
+	for _, fname := range []string{conf.ConfigFile, conf.VsdConfig.CertFile, conf.VsdConfig.KeyFile, conf.VsdConfig.UsernameFile, conf.VsdConfig.PasswordFile, conf.CniConfig.CaFile} {
+		if fname == "" {
+			continue
+		}
+		if data, err := ioutil.ReadFile(fname); err == nil {
+			resp[fname] = sha256.Sum256(data)
+		}
+	}
+
+	return resp
+}
+
+// The files whose checksums differ (incl. files added / removed)
+func changedFiles(old, new map[string][32]byte) []string {
+	var resp []string
+
+	for fname, sum := range new {
+		if oldsum, exists := old[fname]; !exists || oldsum != sum {
+			resp = append(resp, fname)
+		}
+	}
+	for fname := range old {
+		if _, exists := new[fname]; !exists {
+			resp = append(resp, fname)
+		}
+	}
+
+	return resp
+}
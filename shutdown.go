@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	etcdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/etcd-client"
+	k8sclient "github.com/OpenPlatformSDN/nuage-k8s-cni/k8s-client"
+	vsdclient "github.com/OpenPlatformSDN/nuage-k8s-cni/vsd-client"
+
+	"github.com/golang/glog"
+)
+
+////
+//// Graceful shutdown on SIGTERM / SIGINT
+////
+//// XXX - Notes:
+//// - Order: VSD calls stop retrying, K8S events stop being handled and the in-flight ones are drained (until "shutdown-timeout"), the persisted IPAM state is flushed,
+////   the etcd leader lock is released (another agent takes over right away) and the VSD session is closed
+//// - Standby agents (waiting for the leader lock) only deregister from etcd
+//// - A second signal exits immediately
+
+// Shut down on SIGTERM / SIGINT. Does not return
+func shutdownOnSignal() {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+	s := <-sig
+	glog.Infof("===> Received %s, shutting down...", s)
+
+	go func() {
+		s := <-sig
+		glog.Errorf("Received %s while shutting down, exiting immediately", s)
+		glog.Flush()
+		os.Exit(1)
+	}()
+
+	status := shutdown(time.Now().Add(currentConfig().ShutdownTimeout))
+	glog.Flush()
+	os.Exit(status)
+}
+
+// Returns the exit status
+func shutdown(deadline time.Time) int {
+	status := 0
+
+	// In-flight events complete or fail (and clean up) instead of retrying VSD errors past the deadline
+	vsdclient.Drain()
+
+	if err := k8sclient.Shutdown(deadline); err != nil {
+		glog.Errorf("Shutdown: Cannot save the IPAM state: %s", err)
+		status = 1
+	}
+
+	if err := etcdclient.Resign(); err != nil {
+		glog.Errorf("Shutdown: %s", err)
+		status = 1
+	}
+
+	vsdclient.Close()
+
+	glog.Info("===> Shutdown complete")
+	return status
+}
@@ -3,8 +3,6 @@ package vsd
 import (
 	"encoding/json"
 
-	"github.com/golang/glog"
-
 	"github.com/nuagenetworks/go-bambou/bambou"
 	"github.com/nuagenetworks/vspk-go/vspk"
 )
@@ -12,49 +10,118 @@ import (
 // XXX -- All those methods rely on a configured VSD connection:
 // - "root" object
 // - valid "Enterprise" and "Domain" set
+// - Containers are in the Domain of the tenant of their K8S namespace (see tenants.go), i.e. the Domain of the Subnet of their interface
 
-func (container *Container) FetchByName() error {
+func (container *Container) FetchByName(tenant *Tenant) error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
+	return container.fetchByName(tenant)
+}
+
+// Caller must hold "vsdmutex"
+func (container *Container) fetchByName(tenant *Tenant) error {
 	// XXX - We are not locally caching pods (ephemeral constructs)
 
 	// Check the VSD. If it's there, update the local cache and return it
-	containerlist, err := Domain.Containers(&bambou.FetchingInfo{Filter: "name == \"" + container.Name + "\""})
+	var containerlist vspk.ContainersList
+	err := vsdCall("fetch Container: "+container.Name, func() (err *bambou.Error) {
+		containerlist, err = tenant.Domain.Containers(&bambou.FetchingInfo{Filter: "name == \"" + container.Name + "\""})
+		return
+	})
 
 	if err != nil {
 		return bambou.NewBambouError("Cannot fetch Container with name: "+container.Name, err.Error())
 	}
 
 	if len(containerlist) == 1 {
-		glog.Infof("Container with name: %s found on VSD", container.Name)
+		log.Infof("Container with name: %s found on VSD", container.Name)
 		*container = (Container)(*containerlist[0])
 	}
 
 	return nil
 }
 
+// All the Containers in the Domain of the tenant. Not cached (see above)
+func (tenant *Tenant) Containers() ([]*Container, error) {
+	vsdmutex.Lock()
+	defer vsdmutex.Unlock()
+
+	var containerlist vspk.ContainersList
+	err := vsdCall("fetch the Containers of Domain: "+tenant.Domain.Name, func() (err *bambou.Error) {
+		containerlist, err = tenant.Domain.Containers(&bambou.FetchingInfo{})
+		return
+	})
+	if err != nil {
+		return nil, bambou.NewBambouError("Cannot fetch the Containers of Domain: "+tenant.Domain.Name, err.Error())
+	}
+
+	var containers []*Container
+	for _, c := range containerlist {
+		containers = append(containers, (*Container)(c))
+	}
+
+	return containers, nil
+}
+
 func (container *Container) Create() error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
-	if err := root.CreateContainer((*vspk.Container)(container)); err != nil {
+	container.ExternalID = ExternalID(container.Name)
+
+	if err := vsdCall("create Container: "+container.Name, func() *bambou.Error { return currentRoot().CreateContainer((*vspk.Container)(container)) }); err != nil {
+		// E.g. an earlier attempt whose response was lost: Adopt it
+		if Classify(err) == ErrConflict && container.adopt() {
+			return nil
+		}
 		return bambou.NewBambouError("Cannot create Container with name: "+container.Name, err.Error())
 	}
 
-	glog.Infof("Container with name: %s created on the VSD", container.Name)
+	vsdLog("create", container.ID, container.Name).Info("Container created on the VSD")
 	return nil
 }
 
+// Replace the receiver with the existing VSD Container with the same name -- only if it has the same IP address: Otherwise the caller's IP address allocation would not match
+// Caller must hold "vsdmutex"
+func (container *Container) adopt() bool {
+	ciface, err := container.Interface()
+	if err != nil {
+		return false
+	}
+
+	var containerlist vspk.ContainersList
+	if err := vsdCall("fetch Container: "+container.Name, func() (err *bambou.Error) {
+		containerlist, err = currentRoot().Containers(&bambou.FetchingInfo{Filter: "name == \"" + container.Name + "\""})
+		return
+	}); err != nil || len(containerlist) != 1 {
+		return false
+	}
+
+	existing := (*Container)(containerlist[0])
+	if eciface, err := existing.Interface(); err != nil || eciface.IPAddress != ciface.IPAddress {
+		vsdLog("adopt", existing.ID, container.Name).Warn("Container already exists on the VSD with a different interface, not adopting it")
+		return false
+	}
+
+	vsdLog("adopt", existing.ID, container.Name).Info("Container already exists on the VSD, adopting it")
+	*container = *existing
+	return true
+}
+
 func (container *Container) Delete() error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
-	if err := (*vspk.Container)(container).Delete(); err != nil {
+	if err := checkOwned("Container", container.Name, container.ExternalID); err != nil {
+		return err
+	}
+
+	if err := vsdCall("delete Container: "+container.Name, (*vspk.Container)(container).Delete); err != nil {
 		return bambou.NewBambouError("Cannot delete Container with name: "+container.Name, err.Error())
 	}
 
-	glog.Infof("Container with name: %s successfully deleted from the VSD", container.Name)
+	vsdLog("delete", container.ID, container.Name).Info("Container successfully deleted from the VSD")
 	return nil
 }
 
@@ -64,16 +131,29 @@ func (container *Container) Delete() error {
 // - Workaround SDK bug: "vspk.Container.Interfaces" is not "[]ContainerInterface" so it unmarshalls into "map[string]interface{}".  As such we access it as a "map[string]interface{}
 // - No need to reach to the VSD, so no need for Mutex locking
 func (container *Container) IPandMask() (string, string) {
+	ciface, err := container.Interface()
+	if err != nil {
+		log.Fatalf("%s. Container info: %#v", err, container)
+	}
+
+	return ciface.IPAddress, ciface.Netmask
+}
+
+// The (single) interface of the container -- IP address, MAC, Subnet, Zone (see "IPandMask" above for the SDK workaround). Errors if the container does not have exactly one interface
+func (container *Container) Interface() (*vspk.ContainerInterface, error) {
 	if len(container.Interfaces) != 1 {
-		glog.Fatalf("Given container does not have exactly one interface. Container info: %#v", container)
+		return nil, bambou.NewBambouError("Container: "+container.Name+" does not have exactly one interface", "")
 	}
 
 	//XXX - "container.Interfaces[0]" is "map[string]interface{}" (arbitrary JSON object) instead of a "ContainerInterface"
 	// We deal with that by JSON marshalling & unmarshalling in the (right) type
 	data, _ := json.Marshal(container.Interfaces[0])
-	ciface := vspk.ContainerInterface{}
-	json.Unmarshal(data, &ciface)
-	return ciface.IPAddress, ciface.Netmask
+	ciface := new(vspk.ContainerInterface)
+	if err := json.Unmarshal(data, ciface); err != nil {
+		return nil, bambou.NewBambouError("Cannot decode the interface of Container: "+container.Name, err.Error())
+	}
+
+	return ciface, nil
 }
 
 //
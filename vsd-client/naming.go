@@ -0,0 +1,232 @@
+package vsd
+
+import (
+	"bytes"
+	"text/template"
+
+	"github.com/nuagenetworks/go-bambou/bambou"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
+)
+
+////
+//// Names of the VSD constructs for K8S objects. Shared by the agent and the "nuage-k8s-ctl" tool
+////
+//// Names are set by Go text/template name templates ("naming-config" section of the agent configuration), with the fields in "NameFields"
+//// The defaults of the Domain level objects (Zones, Policies) are the names used by earlier versions. The defaults of the Enterprise level objects (Network Macros / Groups) include the cluster ID,
+//// i.e. no collisions between K8S clusters sharing the same VSD Enterprise
+////
+//// XXX - Notes:
+//// - Templates must include the fields identifying the K8S object (e.g. {{.Namespace}} for Zones), otherwise different K8S objects would share the same VSD object
+//// - With "shared-enterprise", the templates of the Enterprise level objects must include {{.Cluster}}
+//// - The Network Macros / Groups named by earlier versions (without the cluster ID, see "Legacy*Name") are migrated: Removed once the objects with the current names are in use
+//// - Changing the templates of an existing cluster otherwise leaves the VSD objects with the previous names in place. Those have to be removed manually
+//// - VSD Container names are not configurable: <pod>_<namespace> (the CNI plugin relies on it)
+
+// Fields available to the name templates
+type NameFields struct {
+	Cluster   string // Cluster ID (see ownership.go)
+	Namespace string // K8S namespace
+	Name      string // K8S Service / NuageNetworkPolicy / ConfigMap name
+	IP        string // Endpoint IP address
+	Key       string // ConfigMap key
+}
+
+// Default name templates
+const (
+	DefaultZoneTemplate         = "K8S namespace {{.Namespace}}"
+	DefaultServicesNMGTemplate  = "K8S services in namespace {{.Cluster}}/{{.Namespace}}"
+	DefaultServiceNMTemplate    = "K8S service {{.Cluster}}/{{.Namespace}}/{{.Name}}"
+	DefaultEndpointsNMGTemplate = "K8S endpoints of service {{.Cluster}}/{{.Namespace}}/{{.Name}}"
+	DefaultEndpointNMTemplate   = "K8S endpoint {{.Cluster}}/{{.Namespace}}/{{.IP}}"
+	DefaultNuagePolicyTemplate  = "K8S Nuage network policy {{.Namespace}}/{{.Name}}"
+	DefaultExternalNMGTemplate  = "K8S external networks {{.Cluster}}/{{.Namespace}}/{{.Name}}"
+	DefaultExternalNMTemplate   = "K8S external network {{.Cluster}}/{{.Namespace}}/{{.Name}}/{{.Key}}"
+)
+
+var nameTemplates struct {
+	zone, servicesNMG, serviceNM, endpointsNMG, endpointNM, nuagePolicy, externalNMG, externalNM *template.Template
+}
+
+func init() {
+	if err := initNaming(new(config.AgentConfig)); err != nil {
+		panic(err)
+	}
+}
+
+// Check the name templates of the configuration, e.g. for configuration validation (see config.Validate)
+func ValidateNaming(conf *config.AgentConfig) error {
+	return initNaming(conf)
+}
+
+// Parse and sanity check the name templates from the configuration. Defaults for the ones not set
+func initNaming(conf *config.AgentConfig) error {
+	nc := conf.NamingConfig
+
+	for _, t := range []struct {
+		tmpl       **template.Template
+		kind       string
+		text       string
+		def        string
+		required   []string // Fields the name must depend on
+		enterprise bool     // Enterprise level object, i.e. possibly shared with other K8S clusters
+	}{
+		{&nameTemplates.zone, "zone", nc.Zone, DefaultZoneTemplate, []string{"Namespace"}, false},
+		{&nameTemplates.servicesNMG, "services-nmg", nc.ServicesNMG, DefaultServicesNMGTemplate, []string{"Namespace"}, true},
+		{&nameTemplates.serviceNM, "service-nm", nc.ServiceNM, DefaultServiceNMTemplate, []string{"Namespace", "Name"}, true},
+		{&nameTemplates.endpointsNMG, "endpoints-nmg", nc.EndpointsNMG, DefaultEndpointsNMGTemplate, []string{"Namespace", "Name"}, true},
+		{&nameTemplates.endpointNM, "endpoint-nm", nc.EndpointNM, DefaultEndpointNMTemplate, []string{"IP"}, true},
+		{&nameTemplates.nuagePolicy, "nuage-policy", nc.NuagePolicy, DefaultNuagePolicyTemplate, []string{"Namespace", "Name"}, false},
+		{&nameTemplates.externalNMG, "external-nmg", nc.ExternalNMG, DefaultExternalNMGTemplate, []string{"Namespace", "Name"}, true},
+		{&nameTemplates.externalNM, "external-nm", nc.ExternalNM, DefaultExternalNMTemplate, []string{"Namespace", "Name", "Key"}, true},
+	} {
+		text := t.text
+		if text == "" {
+			text = t.def
+		}
+
+		required := t.required
+		if t.enterprise && nc.SharedEnterprise {
+			required = append([]string{"Cluster"}, required...)
+		}
+
+		tmpl, err := template.New(t.kind).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return bambou.NewBambouError("Invalid "+t.kind+" name template: "+text, err.Error())
+		}
+
+		// Sample names, differing in one field at a time
+		sample := NameFields{Cluster: "c", Namespace: "ns", Name: "name", IP: "10.0.0.1", Key: "key"}
+		base, err := renderName(tmpl, sample)
+		if err != nil {
+			return bambou.NewBambouError("Invalid "+t.kind+" name template: "+text, err.Error())
+		}
+
+		for _, field := range required {
+			other := sample
+			switch field {
+			case "Cluster":
+				other.Cluster = "other"
+			case "Namespace":
+				other.Namespace = "other"
+			case "Name":
+				other.Name = "other"
+			case "IP":
+				other.IP = "10.0.0.2"
+			case "Key":
+				other.Key = "other"
+			}
+			if name, _ := renderName(tmpl, other); name == base {
+				return bambou.NewBambouError("Invalid "+t.kind+" name template: "+text, "The template must include {{."+field+"}}")
+			}
+		}
+
+		*t.tmpl = tmpl
+	}
+
+	return nil
+}
+
+func renderName(tmpl *template.Template, fields NameFields) (string, error) {
+	var name bytes.Buffer
+	if err := tmpl.Execute(&name, fields); err != nil {
+		return "", err
+	}
+	return name.String(), nil
+}
+
+// XXX - Templates are checked by "initNaming". Execution errors are not expected
+func name(tmpl *template.Template, fields NameFields) string {
+	fields.Cluster = ClusterID
+	n, _ := renderName(tmpl, fields)
+	return n
+}
+
+// VSD Container for a K8S pod
+func ContainerName(namespace, pod string) string {
+	return pod + "_" + namespace
+}
+
+// VSD Zone for a K8S namespace
+func ZoneName(namespace string) string {
+	return name(nameTemplates.zone, NameFields{Namespace: namespace})
+}
+
+// Network Macro Group for the addresses of all the K8S services in a namespace
+func ServicesNMGName(namespace string) string {
+	return name(nameTemplates.servicesNMG, NameFields{Namespace: namespace})
+}
+
+// Network Macro for the ClusterIP of a K8S service
+func ServiceNMName(namespace, service string) string {
+	return name(nameTemplates.serviceNM, NameFields{Namespace: namespace, Name: service})
+}
+
+// Network Macro for an external IP of a K8S service
+func ServiceExternalIPNMName(namespace, service, ip string) string {
+	return ServiceNMName(namespace, service) + " external IP " + ip
+}
+
+// Network Macro for a load balancer ingress IP of a K8S service
+func ServiceIngressIPNMName(namespace, service, ip string) string {
+	return ServiceNMName(namespace, service) + " ingress IP " + ip
+}
+
+// Network Macro Group for the backends (endpoints) of a K8S service
+func EndpointsNMGName(namespace, service string) string {
+	return name(nameTemplates.endpointsNMG, NameFields{Namespace: namespace, Name: service})
+}
+
+// Network Macro for an endpoint address of a K8S service in the namespace
+func EndpointNMName(namespace, ip string) string {
+	return name(nameTemplates.endpointNM, NameFields{Namespace: namespace, IP: ip})
+}
+
+// Policy for a NuageNetworkPolicy custom resource
+func NuagePolicyName(namespace, policy string) string {
+	return name(nameTemplates.nuagePolicy, NameFields{Namespace: namespace, Name: policy})
+}
+
+// Network Macro Group for the external networks declared in a ConfigMap
+func ExternalNMGName(namespace, configmap string) string {
+	return name(nameTemplates.externalNMG, NameFields{Namespace: namespace, Name: configmap})
+}
+
+// Network Macro for an external network declared in a ConfigMap
+func ExternalNMName(namespace, configmap, key string) string {
+	return name(nameTemplates.externalNM, NameFields{Namespace: namespace, Name: configmap, Key: key})
+}
+
+// Common prefix for the names of the Policy Elements of a K8S namespace (isolation mode, egress rules)
+func NamespacePEPrefix(namespace string) string {
+	return ZoneName(namespace) + ": "
+}
+
+// Common prefix for the names of the Policy Elements of a K8S service
+func ServicePEPrefix(namespace, service string) string {
+	return ServiceNMName(namespace, service) + ": "
+}
+
+////
+//// Names of the Enterprise level objects used by earlier versions, i.e. the defaults without the cluster ID. The VSD objects with those names are migrated to the current names
+////
+
+// Network Macro Group for the addresses of all the K8S services in a namespace
+func LegacyServicesNMGName(namespace string) string {
+	return "K8S services in namespace " + namespace
+}
+
+// Network Macro for the ClusterIP of a K8S service. The external / ingress IP Network Macros and the Service Policy Elements names are derived from it, as for "ServiceNMName"
+func LegacyServiceNMName(namespace, service string) string {
+	return "K8S service " + namespace + "/" + service
+}
+
+// Network Macro Group for the backends (endpoints) of a K8S service. Its (endpoint) Network Macros are released with it
+func LegacyEndpointsNMGName(namespace, service string) string {
+	return "K8S endpoints of service " + namespace + "/" + service
+}
+
+// Network Macro Group for the external networks declared in a ConfigMap. Its Network Macros are released with it
+func LegacyExternalNMGName(namespace, configmap string) string {
+	return "K8S external networks " + namespace + "/" + configmap
+}
@@ -1,26 +1,30 @@
 package vsd
 
 import (
-	"github.com/golang/glog"
-
 	"github.com/nuagenetworks/go-bambou/bambou"
 	"github.com/nuagenetworks/vspk-go/vspk"
-
-	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
 )
 
 // XXX -- All those methods rely on a configured VSD connection:
 // - "root" object
 // - valid "Enterprise" and "Domain" set
+// - Network Macro Groups are in the Enterprise of the tenant of their K8S namespace (see tenants.go)
 
-func (nmg *NetworkMacroGroup) FetchByName() error {
+func (nmg *NetworkMacroGroup) FetchByName(tenant *Tenant) error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
+	return nmg.fetchByName(tenant)
+}
+
+// Caller must hold "vsdmutex"
+func (nmg *NetworkMacroGroup) fetchByName(tenant *Tenant) error {
+	key := cacheKey(tenant.Enterprise.ID, nmg.Name)
+
 	// First, check the local cache of VSD constructs. If it's there already, return it from the cache
-	if NMGs[nmg.Name] != nil {
-		*nmg = *NMGs[nmg.Name]
-		glog.Infof("VSD Network Macro Group with name: %s is already cached", nmg.Name)
+	if NMGs[key] != nil {
+		*nmg = *NMGs[key]
+		log.Infof("VSD Network Macro Group with name: %s is already cached", nmg.Name)
 		return nil
 	}
 
@@ -32,15 +36,22 @@ func (nmg *NetworkMacroGroup) FetchByName() error {
 
 	// nmgs, err = Enterprise.NetworkMacroGroups(&bambou.FetchingInfo{Filter: "name == \"" + nmg.Name + "\""})
 
-	nmglist, err := Enterprise.NetworkMacroGroups(&bambou.FetchingInfo{})
+	var nmglist vspk.NetworkMacroGroupsList
+	err := vsdCall("fetch Network Macro Groups", func() (err *bambou.Error) {
+		nmglist, err = tenant.Enterprise.NetworkMacroGroups(&bambou.FetchingInfo{})
+		return
+	})
 	if err != nil {
 		return bambou.NewBambouError("Error fetching list of Network Macro Groups from the VSD", err.Error())
 	}
 	for _, vsdnmg := range nmglist {
 		if vsdnmg.Name == nmg.Name {
-			glog.Infof("VSD Network Macro Group with name: %s found on VSD, caching ...", nmg.Name)
-			NMGs[nmg.Name] = (*NetworkMacroGroup)(vsdnmg)
-			*nmg = *NMGs[nmg.Name]
+			if err := claim("Network Macro Group", vsdnmg.Name, &vsdnmg.ExternalID, vsdnmg.Save); err != nil {
+				return err
+			}
+			log.Infof("VSD Network Macro Group with name: %s found on VSD, caching ...", nmg.Name)
+			NMGs[key] = (*NetworkMacroGroup)(vsdnmg)
+			*nmg = *NMGs[key]
 			break
 		}
 	}
@@ -48,62 +59,141 @@ func (nmg *NetworkMacroGroup) FetchByName() error {
 	return nil
 }
 
-func (nmg *NetworkMacroGroup) Create() error {
+func (nmg *NetworkMacroGroup) Create(tenant *Tenant) error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
-	if err := Enterprise.CreateNetworkMacroGroup((*vspk.NetworkMacroGroup)(nmg)); err != nil {
+	nmg.ExternalID = ExternalID(nmg.Name)
+	nmg.Description = OwnerDescription()
+
+	if err := vsdCall("create Network Macro Group: "+nmg.Name, func() *bambou.Error { return tenant.Enterprise.CreateNetworkMacroGroup((*vspk.NetworkMacroGroup)(nmg)) }); err != nil {
+		// Created concurrently: Adopt it
+		if Classify(err) == ErrConflict {
+			vsdLog("create", "", nmg.Name).Info("Network Macro Group already exists, fetching it")
+			if ferr := nmg.fetchByName(tenant); ferr == nil && nmg.ID != "" {
+				return nil
+			}
+		}
 		return bambou.NewBambouError("Cannot create Network Macro Group: "+nmg.Name, err.Error())
 	}
 
 	// Add it to the local cache as well.
 	// XXX - Up to the caller to ensure there are no map conflicts
-	NMGs[nmg.Name] = nmg
-	glog.Infof("Successfully created Network Macro Group: %s", nmg.Name)
+	NMGs[cacheKey(tenant.Enterprise.ID, nmg.Name)] = nmg
+	vsdLog("create", nmg.ID, nmg.Name).Info("Successfully created Network Macro Group")
+	return nil
+}
+
+func (nmg *NetworkMacroGroup) Delete() error {
+	vsdmutex.Lock()
+	defer vsdmutex.Unlock()
+
+	if err := checkOwned("Network Macro Group", nmg.Name, nmg.ExternalID); err != nil {
+		return err
+	}
+
+	if err := vsdCall("delete Network Macro Group: "+nmg.Name, (*vspk.NetworkMacroGroup)(nmg).Delete); err != nil {
+		return bambou.NewBambouError("Cannot delete Network Macro Group: "+nmg.Name, err.Error())
+	}
+
+	delete(NMGs, cacheKey(nmg.ParentID, nmg.Name))
+	vsdLog("delete", nmg.ID, nmg.Name).Info("Successfully deleted Network Macro Group")
 	return nil
 }
 
 // Add a Network Macro to a Network Macro Group
-// XXX - no checks performed.
+// XXX - Notes:
+// - VSD assignment replaces the whole list of Network Macro Groups of the Network Macro. As such we keep any other groups the Network Macro is part of
+// - Idempotent: No changes if the Network Macro is already part of the Network Macro Group
 func (nmg *NetworkMacroGroup) AddNM(nm *NetworkMacro) error {
-	// vsdmutex.Lock()
-	// defer vsdmutex.Unlock()
+	vsdmutex.Lock()
+	defer vsdmutex.Unlock()
+
+	var nmgroups vspk.NetworkMacroGroupsList
+	err := vsdCall("fetch the Network Macro Groups of Network Macro: "+nm.Name, func() (err *bambou.Error) {
+		nmgroups, err = (*vspk.EnterpriseNetwork)(nm).NetworkMacroGroups(&bambou.FetchingInfo{})
+		return
+	})
+	if err != nil {
+		return bambou.NewBambouError("Cannot fetch the Network Macro Groups of Network Macro: "+nm.Name, err.Error())
+	}
+
+	for _, group := range nmgroups {
+		if group.ID == nmg.ID {
+			return nil
+		}
+	}
 
-	nmchildren := []*vspk.NetworkMacroGroup{(*vspk.NetworkMacroGroup)(nmg)}
-	if err := (*vspk.EnterpriseNetwork)(nm).AssignNetworkMacroGroups(nmchildren); err != nil {
+	nmgroups = append(nmgroups, (*vspk.NetworkMacroGroup)(nmg))
+	if err := vsdCall("assign the Network Macro Groups of Network Macro: "+nm.Name, func() *bambou.Error {
+		return (*vspk.EnterpriseNetwork)(nm).AssignNetworkMacroGroups(nmgroups)
+	}); err != nil {
 		return bambou.NewBambouError("Cannot add Network Macro: "+nm.Name+" to Network Macro Group: "+nmg.Name, err.Error())
 	}
 
-	glog.Infof("Successfully added Network Macro: %s to Network Macro Group: %s", nm.Name, nmg.Name)
+	vsdLog("add-member", nmg.ID, nmg.Name).Infof("Successfully added Network Macro: %s", nm.Name)
 	return nil
 }
 
-////////
-//////// Policy functions:  All functions are done at network ingress, assuming "IngressPolicy" as an applied policy
-////////
-////////
-////////
-
-// Adds a Policy Element:
-// - From: Pods in current namesspace (VSD zone)
-// - To: Services in own namespace (VSD NMG)
-// - Action: Allow
-// - Priority: 900000
-func (nmg *NetworkMacroGroup) AddPESvcsAllow(zone *Zone) error {
-	aazone2nmg := netpolicy.PolicyElement{
-		Name:     "Allow traffic to " + nmg.Name,
-		Priority: 900000,
-		From: netpolicy.PolicySrcScope{
-			Type: "Zone",
-			Name: &zone.Name,
-		},
-		To: netpolicy.PolicyDstScope{
-			Type: "NetworkMacroGroup",
-			Name: &nmg.Name,
-		},
-		TrafficSpec: netpolicy.MatchAllTraffic,
-		Action:      netpolicy.Allow,
+// Remove a Network Macro from a Network Macro Group. Returns the number of Network Macro Groups the Network Macro is still part of
+func (nmg *NetworkMacroGroup) RemoveNM(nm *NetworkMacro) (int, error) {
+	vsdmutex.Lock()
+	defer vsdmutex.Unlock()
+
+	var nmgroups vspk.NetworkMacroGroupsList
+	err := vsdCall("fetch the Network Macro Groups of Network Macro: "+nm.Name, func() (err *bambou.Error) {
+		nmgroups, err = (*vspk.EnterpriseNetwork)(nm).NetworkMacroGroups(&bambou.FetchingInfo{})
+		return
+	})
+	if err != nil {
+		return 0, bambou.NewBambouError("Cannot fetch the Network Macro Groups of Network Macro: "+nm.Name, err.Error())
+	}
+
+	var kept vspk.NetworkMacroGroupsList
+	for _, group := range nmgroups {
+		if group.ID != nmg.ID {
+			kept = append(kept, group)
+		}
+	}
+
+	if len(kept) == len(nmgroups) { // Not part of this NMG. Nothing to do
+		return len(kept), nil
+	}
+
+	if err := vsdCall("assign the Network Macro Groups of Network Macro: "+nm.Name, func() *bambou.Error {
+		return (*vspk.EnterpriseNetwork)(nm).AssignNetworkMacroGroups(kept)
+	}); err != nil {
+		return len(nmgroups), bambou.NewBambouError("Cannot remove Network Macro: "+nm.Name+" from Network Macro Group: "+nmg.Name, err.Error())
+	}
+
+	vsdLog("remove-member", nmg.ID, nmg.Name).Infof("Successfully removed Network Macro: %s", nm.Name)
+	return len(kept), nil
+}
+
+// The Network Macros that are part of the Network Macro Group
+func (nmg *NetworkMacroGroup) Members() ([]*NetworkMacro, error) {
+	vsdmutex.Lock()
+	defer vsdmutex.Unlock()
+
+	var nmlist vspk.EnterpriseNetworksList
+	err := vsdCall("fetch the Network Macros of Network Macro Group: "+nmg.Name, func() (err *bambou.Error) {
+		nmlist, err = (*vspk.NetworkMacroGroup)(nmg).EnterpriseNetworks(&bambou.FetchingInfo{})
+		return
+	})
+	if err != nil {
+		return nil, bambou.NewBambouError("Cannot fetch the Network Macros of Network Macro Group: "+nmg.Name, err.Error())
+	}
+
+	var nms []*NetworkMacro
+	for _, nm := range nmlist {
+		nms = append(nms, (*NetworkMacro)(nm))
 	}
 
-	return IngressPolicy.ApplyPE(&aazone2nmg)
+	return nms, nil
+}
+
+// Removes the "allow all traffic" Policy Element to this Network Macro Group installed by earlier versions, if any
+// XXX - Traffic to K8S services is now allowed per Service port (see k8s-client/service.go)
+func (nmg *NetworkMacroGroup) DeletePESvcsAllow() error {
+	return DeleteIngressPE("Allow traffic to " + nmg.Name)
 }
@@ -1,7 +1,6 @@
 package vsd
 
 import (
-	"github.com/golang/glog"
 	"github.com/nuagenetworks/vspk-go/vspk"
 
 	"github.com/nuagenetworks/go-bambou/bambou"
@@ -10,45 +9,105 @@ import (
 // XXX -- All those methods rely on a configured VSD connection:
 // - "root" object
 // - valid "Enterprise" and "Domain" set
+// - Network Macros are in the Enterprise of the tenant of their K8S namespace (see tenants.go)
 
 // NetworkMacro (Enterprise Network). Mutates the receiver if it exists
-func (nm *NetworkMacro) FetchByName() error {
+func (nm *NetworkMacro) FetchByName(tenant *Tenant) error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
+	return nm.fetchByName(tenant)
+}
+
+// Caller must hold "vsdmutex"
+func (nm *NetworkMacro) fetchByName(tenant *Tenant) error {
+	key := cacheKey(tenant.Enterprise.ID, nm.Name)
+
 	// First, check the local cache of VSD constructs. If it's there already, return it from the cache
-	if NMs[nm.Name] != nil {
-		*nm = *NMs[nm.Name]
-		glog.Infof("VSD Network Macro with name: %s already cached", nm.Name)
+	if NMs[key] != nil {
+		*nm = *NMs[key]
+		log.Infof("VSD Network Macro with name: %s already cached", nm.Name)
 		return nil
 	}
 
 	// Second, check the VSD. If it's there, update the local cache and return it
-	nmlist, err := Enterprise.EnterpriseNetworks(&bambou.FetchingInfo{Filter: "name == \"" + nm.Name + "\""})
+	var nmlist vspk.EnterpriseNetworksList
+	err := vsdCall("fetch Network Macro: "+nm.Name, func() (err *bambou.Error) {
+		nmlist, err = tenant.Enterprise.EnterpriseNetworks(&bambou.FetchingInfo{Filter: "name == \"" + nm.Name + "\""})
+		return
+	})
 	if err != nil {
 		return bambou.NewBambouError("Error fetching list of Network Macros from the VSD", err.Error())
 	}
 
 	if len(nmlist) == 1 {
-		glog.Infof("VSD Network Macro with name: %s found on VSD, caching ...", nm.Name)
-		NMs[nm.Name] = (*NetworkMacro)(nmlist[0])
-		*nm = *NMs[nm.Name]
+		if err := claim("Network Macro", nmlist[0].Name, &nmlist[0].ExternalID, nmlist[0].Save); err != nil {
+			return err
+		}
+		log.Infof("VSD Network Macro with name: %s found on VSD, caching ...", nm.Name)
+		NMs[key] = (*NetworkMacro)(nmlist[0])
+		*nm = *NMs[key]
 	}
 
 	return nil
 }
 
-func (nm *NetworkMacro) Create() error {
+func (nm *NetworkMacro) Create(tenant *Tenant) error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
-	if err := Enterprise.CreateEnterpriseNetwork((*vspk.EnterpriseNetwork)(nm)); err != nil {
+	nm.ExternalID = ExternalID(nm.Name)
+
+	if err := vsdCall("create Network Macro: "+nm.Name, func() *bambou.Error { return tenant.Enterprise.CreateEnterpriseNetwork((*vspk.EnterpriseNetwork)(nm)) }); err != nil {
+		// Created concurrently: Adopt it. XXX - Its address may differ, up to the caller to check
+		if Classify(err) == ErrConflict {
+			vsdLog("create", "", nm.Name).Info("Network Macro already exists, fetching it")
+			if ferr := nm.fetchByName(tenant); ferr == nil && nm.ID != "" {
+				return nil
+			}
+		}
 		return bambou.NewBambouError("Cannot create Network Macro: "+nm.Name, err.Error())
 	}
 
 	// Add it to the local cache as well.
 	// XXX - Up to the caller to ensure there are no map conflicts
-	NMs[nm.Name] = nm
-	glog.Infof("Successfully created Network Macro: %s", nm.Name)
+	NMs[cacheKey(tenant.Enterprise.ID, nm.Name)] = nm
+	vsdLog("create", nm.ID, nm.Name).Infof("Successfully created Network Macro. Address: %s , Netmask: %s", nm.Address, nm.Netmask)
+	return nil
+}
+
+// Update the VSD Network Macro (e.g. changed address) and the local cache
+func (nm *NetworkMacro) Update() error {
+	vsdmutex.Lock()
+	defer vsdmutex.Unlock()
+
+	if err := checkOwned("Network Macro", nm.Name, nm.ExternalID); err != nil {
+		return err
+	}
+
+	if err := vsdCall("update Network Macro: "+nm.Name, (*vspk.EnterpriseNetwork)(nm).Save); err != nil {
+		return bambou.NewBambouError("Cannot update Network Macro: "+nm.Name, err.Error())
+	}
+
+	NMs[cacheKey(nm.ParentID, nm.Name)] = nm
+	vsdLog("update", nm.ID, nm.Name).Infof("Successfully updated Network Macro. Address: %s , Netmask: %s", nm.Address, nm.Netmask)
+	return nil
+}
+
+// Delete the VSD Network Macro. Removes it from any Network Macro Groups it was part of and from the local cache
+func (nm *NetworkMacro) Delete() error {
+	vsdmutex.Lock()
+	defer vsdmutex.Unlock()
+
+	if err := checkOwned("Network Macro", nm.Name, nm.ExternalID); err != nil {
+		return err
+	}
+
+	if err := vsdCall("delete Network Macro: "+nm.Name, (*vspk.EnterpriseNetwork)(nm).Delete); err != nil {
+		return bambou.NewBambouError("Cannot delete Network Macro: "+nm.Name, err.Error())
+	}
+
+	delete(NMs, cacheKey(nm.ParentID, nm.Name))
+	vsdLog("delete", nm.ID, nm.Name).Info("Successfully deleted Network Macro")
 	return nil
 }
@@ -0,0 +1,91 @@
+package vsd
+
+import (
+	"strings"
+
+	"github.com/nuagenetworks/go-bambou/bambou"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
+)
+
+////
+//// Ownership of the VSD objects created by the agent
+////
+//// Objects created by the agent (Zones, Subnets, Network Macros / Groups, Containers) carry:
+//// - externalID: <object name> + "@" + <cluster ID>
+//// - description (where available): "Created by nuage-k8s-master-agent for K8S cluster: " + <cluster ID>
+////
+//// The agent only modifies and deletes (incl. garbage collection) objects it owns. Objects owned by another cluster (e.g. sharing the VSD Enterprise) are never changed: Fetching them by name is an error
+////
+//// XXX - Notes:
+//// - The cluster ID defaults to the VSD Domain name
+//// - Objects without an externalID (e.g. created by earlier versions) are adopted -- i.e. their externalID is set -- unless "strict-ownership" is configured
+//// - Policies and their Policy Elements are created by the policy framework, without ownership metadata. Those are identified by name within the Domain of the cluster
+//// - VSD Containers are not adopted (ephemeral). Those without an externalID are deleted only if "strict-ownership" is not configured
+
+var (
+	// ID of the K8S cluster, for the ownership metadata of the VSD objects
+	ClusterID string
+
+	// Only modify VSD objects with this cluster's externalID (i.e. do not adopt objects without an externalID)
+	StrictOwnership = false
+)
+
+func initOwnership(conf *config.AgentConfig) {
+	ClusterID = conf.NamingConfig.ClusterID
+	if ClusterID == "" {
+		ClusterID = conf.VsdConfig.Domain
+	}
+	StrictOwnership = conf.NamingConfig.StrictOwnership
+
+	log.Infof("VSD objects ownership: Cluster ID: %s . Strict ownership: %t", ClusterID, StrictOwnership)
+}
+
+// The externalID of a VSD object created by the agent
+func ExternalID(name string) string {
+	return name + "@" + ClusterID
+}
+
+// The description of a VSD object created by the agent
+func OwnerDescription() string {
+	return "Created by nuage-k8s-master-agent for K8S cluster: " + ClusterID
+}
+
+// Whether the agent may modify / delete a VSD object with the given externalID
+func Owned(externalID string) bool {
+	if externalID == "" {
+		return !StrictOwnership
+	}
+	return strings.HasSuffix(externalID, "@"+ClusterID)
+}
+
+// Check the ownership of a VSD object fetched by name. Adopts objects without an externalID (unless "StrictOwnership"), using "save" to persist the externalID
+func claim(kind, name string, externalID *string, save func() *bambou.Error) error {
+	if !Owned(*externalID) {
+		if *externalID == "" {
+			return bambou.NewBambouError("VSD "+kind+": "+name+" is not owned by K8S cluster: "+ClusterID, "No externalID (strict ownership)")
+		}
+		return bambou.NewBambouError("VSD "+kind+": "+name+" is not owned by K8S cluster: "+ClusterID, "externalID: "+*externalID)
+	}
+
+	if *externalID != "" {
+		return nil
+	}
+
+	*externalID = ExternalID(name)
+	if err := save(); err != nil {
+		*externalID = ""
+		return bambou.NewBambouError("Cannot adopt VSD "+kind+": "+name, err.Error())
+	}
+
+	vsdLog("adopt", "", name).Infof("Adopted VSD %s, externalID: %s", kind, *externalID)
+	return nil
+}
+
+// Refuse changes to VSD objects not owned by the agent
+func checkOwned(kind, name, externalID string) error {
+	if Owned(externalID) {
+		return nil
+	}
+	return bambou.NewBambouError("Cannot change VSD "+kind+": "+name, "Not owned by K8S cluster: "+ClusterID+" , externalID: "+externalID)
+}
@@ -1,7 +1,11 @@
 package vsd
 
 import (
-	"github.com/golang/glog"
+	"strings"
+	"sync"
+
+	"github.com/nuagenetworks/go-bambou/bambou"
+	"github.com/nuagenetworks/vspk-go/vspk"
 
 	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
 )
@@ -12,72 +16,351 @@ const (
 	ipname = "Ingress Policy for K8S"
 )
 
-var (
-	// Private, low priority "allow all" traffic for network egress
-	egressPolicy *netpolicy.Policy
-	// Actual policy rules are imposed on network ingress
-	IngressPolicy *netpolicy.Policy
-)
+// Serialize changes to the Policies and their Policy Elements. The local list of Policy Elements is used to select free priorities
+var policymutex sync.Mutex
 
-// Initialize network policies for the Domain:
+// Initialize network policies for the Domain of the tenant (see tenants.go):
 // - Egress: low priority, single "allow all traffic" PolicyElement
 // - Ingress: At this stage, a single entry allowing intra-namespace traffic
 
-func initPolicies() error {
+func (tenant *Tenant) initPolicies() error {
 
-	policies, perr := (*netpolicy.PolicyDomain)(Domain).GetPolicies()
-
-	if perr != nil {
-		return perr
+	if err := tenant.lookupPolicies(); err != nil {
+		return err
 	}
 
-	for _, policy := range policies {
-		if epname == policy.Name && policy.Type == netpolicy.Egress {
-			egressPolicy = policy
-			glog.Infof("The domain already has an existing %s: %s", epname, egressPolicy)
-			break
+	if tenant.EgressPolicy == nil { // Not found above
+		tenant.EgressPolicy, _ = netpolicy.NewPolicy(epname, netpolicy.Egress, tenant.Enterprise.Name, tenant.Domain.Name, DefaultPriority)
+		// Create a Policy Element allowing all egress traffic
+		for _, pe := range DefaultPEs(netpolicy.Egress) {
+			tenant.EgressPolicy.AttachPE(pe)
+		}
+		if err := applyPolicy((*netpolicy.PolicyDomain)(tenant.Domain), tenant.EgressPolicy); err != nil {
+			return err
 		}
+		// The policy framework does not set the ID of the applied Policy. Refresh it, e.g. for the policy audit (see "LivePolicyElements")
+		if err := refreshPolicy((*netpolicy.PolicyDomain)(tenant.Domain), tenant.EgressPolicy); err != nil {
+			return err
+		}
+		log.Infof("Successfully applied Egress Policy: %s", *tenant.EgressPolicy)
 	}
 
-	if egressPolicy == nil { // Not found above
-		egressPolicy, _ := netpolicy.NewPolicy(epname, netpolicy.Egress, Enterprise.Name, Domain.Name, 999999999)
-		// Create a Policy Element allowing all egress traffic
-		aaegressPE := netpolicy.AllowAllEgressPE
-		egressPolicy.AttachPE(&aaegressPE)
-		if err := (*netpolicy.PolicyDomain)(Domain).ApplyPolicy(egressPolicy); err != nil {
+	// Ingress -- Basic is a lowest priority "allow traffic to endpoint Zone" <--> allow traffic btw. pods in the same namespace
+
+	if tenant.IngressPolicy == nil { // Not found above
+		tenant.IngressPolicy, _ = netpolicy.NewPolicy(ipname, netpolicy.Ingress, tenant.Enterprise.Name, tenant.Domain.Name, DefaultPriority)
+		// Create a PolicyElement allowing ingress traffic to endpoint's own Zone
+		for _, pe := range DefaultPEs(netpolicy.Ingress) {
+			tenant.IngressPolicy.AttachPE(pe)
+		}
+		if err := applyPolicy((*netpolicy.PolicyDomain)(tenant.Domain), tenant.IngressPolicy); err != nil {
 			return err
 		}
-		glog.Infof("Successfully applied Egress Policy: %s", *egressPolicy)
+		// The policy framework does not set the ID of the applied Policy. Refresh it, e.g. for the policy audit (see "LivePolicyElements")
+		if err := refreshPolicy((*netpolicy.PolicyDomain)(tenant.Domain), tenant.IngressPolicy); err != nil {
+			return err
+		}
+		log.Infof("Successfully applied Ingress Policy: %s", *tenant.IngressPolicy)
+
 	}
 
-	// Ingress -- Basic is a lowest priority "allow traffic to endpoint Zone" <--> allow traffic btw. pods in the same namespace
+	return nil
+}
+
+// Find the existing Egress / Ingress Policies of the Domain of the tenant, if any
+func (tenant *Tenant) lookupPolicies() error {
+	policies, err := getPolicies((*netpolicy.PolicyDomain)(tenant.Domain))
+	if err != nil {
+		return err
+	}
 
 	for _, policy := range policies {
-		if ipname == policy.Name && policy.Type == netpolicy.Ingress {
-			IngressPolicy = policy
-			glog.Infof("The domain already has an existing %s: %s", ipname, IngressPolicy)
-			break
+		switch {
+		case epname == policy.Name && policy.Type == netpolicy.Egress && tenant.EgressPolicy == nil:
+			tenant.EgressPolicy = policy
+			log.Infof("The domain: %s already has an existing %s: %s", tenant.Domain.Name, epname, tenant.EgressPolicy)
+		case ipname == policy.Name && policy.Type == netpolicy.Ingress && tenant.IngressPolicy == nil:
+			tenant.IngressPolicy = policy
+			log.Infof("The domain: %s already has an existing %s: %s", tenant.Domain.Name, ipname, tenant.IngressPolicy)
 		}
 	}
 
-	if IngressPolicy == nil { // Not found above
-		IngressPolicy, _ = netpolicy.NewPolicy(ipname, netpolicy.Ingress, Enterprise.Name, Domain.Name, 999999999)
-		// Create a PolicyElement allowing ingress traffic to endpoint's own Zone
-		aaizone := netpolicy.PolicyElement{
+	return nil
+}
+
+// The Policy Elements "initPolicies" applies to the Ingress / Egress Policies, in the DefaultBand
+func DefaultPEs(ptype netpolicy.PolicyType) []*netpolicy.PolicyElement {
+	switch ptype {
+	case netpolicy.Ingress:
+		return []*netpolicy.PolicyElement{{
 			Name:        "Allow intra-namespace traffic",
-			Priority:    999999999,
+			Priority:    DefaultPriority,
 			From:        netpolicy.AllSrcsIngress,
 			To:          netpolicy.PolicyDstScope{Type: string(netpolicy.MyZone)},
 			TrafficSpec: netpolicy.MatchAllTraffic,
 			Action:      netpolicy.Allow,
+		}}
+	case netpolicy.Egress:
+		aaegressPE := netpolicy.AllowAllEgressPE
+		return []*netpolicy.PolicyElement{&aaegressPE}
+	}
+
+	return nil
+}
+
+// Find a Policy Element by Name in the given Policy. Returns a copy of the Policy Element, or nil if not found
+func findPE(p *netpolicy.Policy, name string) *netpolicy.PolicyElement {
+	for _, pe := range p.PolicyElements {
+		if pe.Name == name {
+			found := pe
+			return &found
+		}
+	}
+
+	return nil
+}
+
+////////
+//////// Ingress / Egress Policy Elements, identified by Name. The package level functions apply to the default tenant
+////////
+
+// Apply a Policy Element to the Ingress Policy, with a priority in the given band (see priorities.go). Single Policy Element transaction (see transactions.go)
+func ApplyIngressPE(pe *netpolicy.PolicyElement, band PriorityBand) error {
+	t := NewPolicyTransaction()
+	t.ApplyIngressPE(pe, band)
+	return t.Commit()
+}
+
+// Apply a Policy Element to the Egress Policy, with a priority in the given band (see priorities.go). Single Policy Element transaction (see transactions.go)
+func ApplyEgressPE(pe *netpolicy.PolicyElement, band PriorityBand) error {
+	t := NewPolicyTransaction()
+	t.ApplyEgressPE(pe, band)
+	return t.Commit()
+}
+
+// Delete a Policy Element from the Ingress Policy, if it exists
+func DeleteIngressPE(name string) error {
+	t := NewPolicyTransaction()
+	t.DeleteIngressPE(name)
+	return t.Commit()
+}
+
+// Delete a Policy Element from the Egress Policy, if it exists
+func DeleteEgressPE(name string) error {
+	t := NewPolicyTransaction()
+	t.DeleteEgressPE(name)
+	return t.Commit()
+}
+
+// The Names of the Ingress Policy Elements of the tenant starting with "prefix"
+func (tenant *Tenant) IngressPENames(prefix string) []string {
+	return peNames(tenant.IngressPolicy, prefix)
+}
+
+// The Names of the Egress Policy Elements of the tenant starting with "prefix"
+func (tenant *Tenant) EgressPENames(prefix string) []string {
+	return peNames(tenant.EgressPolicy, prefix)
+}
+
+// Refresh the Ingress / Egress Policy of the tenant from the VSD, e.g. to find changes made outside the agent. Returns a copy of the live Policy Elements
+func (tenant *Tenant) LivePolicyElements(ptype netpolicy.PolicyType) ([]netpolicy.PolicyElement, error) {
+	policymutex.Lock()
+	defer policymutex.Unlock()
+
+	p := tenant.IngressPolicy
+	if ptype == netpolicy.Egress {
+		p = tenant.EgressPolicy
+	}
+
+	policies, err := getPoliciesByType((*netpolicy.PolicyDomain)(tenant.Domain), ptype)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, live := range policies {
+		if live.ID == p.ID {
+			*p = *live
+			pes := make([]netpolicy.PolicyElement, len(p.PolicyElements))
+			copy(pes, p.PolicyElements)
+			return pes, nil
 		}
-		IngressPolicy.AttachPE(&aaizone)
-		if err := (*netpolicy.PolicyDomain)(Domain).ApplyPolicy(IngressPolicy); err != nil {
+	}
+
+	return nil, bambou.NewBambouError("Cannot find the live "+string(ptype)+" Policy: "+p.Name, "Policy was deleted from the VSD")
+}
+
+func peNames(p *netpolicy.Policy, prefix string) []string {
+	policymutex.Lock()
+	defer policymutex.Unlock()
+
+	var names []string
+	for _, pe := range p.PolicyElements {
+		if strings.HasPrefix(pe.Name, prefix) {
+			names = append(names, pe.Name)
+		}
+	}
+
+	return names
+}
+
+////////
+//////// Domain Policies, identified by Name and Type
+////////
+
+// Whether a Policy with the same Name and Type is applied to the Domain of the tenant. Refreshes the Policy in the process
+func (tenant *Tenant) HasPolicy(p *netpolicy.Policy) bool {
+	policymutex.Lock()
+	defer policymutex.Unlock()
+
+	found, err := hasPolicy((*netpolicy.PolicyDomain)(tenant.Domain), p)
+	if err != nil {
+		log.Warningf("Cannot check whether the %s Policy: %s is applied: %s", p.Type, p.Name, err)
+	}
+	return found
+}
+
+// All the (live) Policies applied to the Domain of the tenant -- the K8S Ingress / Egress Policies, Nuage policies, and any others
+func (tenant *Tenant) Policies() ([]*netpolicy.Policy, error) {
+	policymutex.Lock()
+	defer policymutex.Unlock()
+
+	policies, err := getPolicies((*netpolicy.PolicyDomain)(tenant.Domain))
+	if err != nil {
+		return nil, err
+	}
+
+	return policies, nil
+}
+
+// Apply a Policy to the Domain of the tenant
+func (tenant *Tenant) ApplyPolicy(p *netpolicy.Policy) error {
+	policymutex.Lock()
+	defer policymutex.Unlock()
+
+	if err := applyPolicy((*netpolicy.PolicyDomain)(tenant.Domain), p); err != nil {
+		return err
+	}
+
+	// Refresh the ID of the applied Policy (not set by the policy framework)
+	if err := refreshPolicy((*netpolicy.PolicyDomain)(tenant.Domain), p); err != nil {
+		vsdLog("apply", "", p.Name).Warningf("Cannot refresh the applied %s Policy: %s", p.Type, err)
+	}
+
+	vsdLog("apply", p.ID, p.Name).Infof("Successfully applied %s Policy", p.Type)
+	return nil
+}
+
+// Delete a Policy from the Domain of the tenant, if it exists
+// XXX - The policy framework can delete Ingress Policies only. Egress Policies are deleted here
+func (tenant *Tenant) DeletePolicy(p *netpolicy.Policy) error {
+	policymutex.Lock()
+	defer policymutex.Unlock()
+
+	pd := (*netpolicy.PolicyDomain)(tenant.Domain)
+
+	found, err := hasPolicy(pd, p) // Refreshes the Policy ID
+	if err != nil {
+		return err
+	}
+	if !found { // Nothing to delete
+		return nil
+	}
+	id := p.ID
+
+	switch p.Type {
+	case netpolicy.Egress:
+		eacl := new(vspk.EgressACLTemplate)
+		eacl.ID = p.ID
+		if err := vsdCall("delete Policy: "+p.Name, func() *bambou.Error {
+			if err := eacl.Delete(); err != nil {
+				return bambou.NewBambouError("Cannot delete Policy: "+p.Name, err.Error())
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		p.ID = ""
+		p.Parent = nil
+	default:
+		if err := vsdCall("delete Policy: "+p.Name, func() *bambou.Error {
+			if err := pd.DeletePolicy(p); err != nil {
+				return bambou.NewBambouError("Cannot delete Policy: "+p.Name, err.Error())
+			}
+			return nil
+		}); err != nil {
 			return err
 		}
-		glog.Infof("Successfully applied Ingress Policy: %s", *IngressPolicy)
+	}
+
+	vsdLog("delete", id, p.Name).Infof("Successfully deleted %s Policy", p.Type)
+	return nil
+}
+
+////////
+//////// Policy framework calls, retrying transient VSD errors (see resilience.go)
+////////
+
+// All the Policies of the Domain
+func getPolicies(pd *netpolicy.PolicyDomain) ([]*netpolicy.Policy, *bambou.Error) {
+	var policies []*netpolicy.Policy
+	err := vsdCall("fetch the Policies of Domain: "+pd.Name, func() *bambou.Error {
+		var err error
+		if policies, err = pd.GetPolicies(); err != nil {
+			return bambou.NewBambouError("Cannot fetch the Policies of Domain: "+pd.Name, err.Error())
+		}
+		return nil
+	})
+	return policies, err
+}
+
+// The live Policies of the Domain with the given Type
+func getPoliciesByType(pd *netpolicy.PolicyDomain, ptype netpolicy.PolicyType) ([]*netpolicy.Policy, *bambou.Error) {
+	var policies []*netpolicy.Policy
+	err := vsdCall("fetch the live "+string(ptype)+" Policies of Domain: "+pd.Name, func() *bambou.Error {
+		var err error
+		if policies, err = pd.GetPoliciesByType(ptype); err != nil {
+			return bambou.NewBambouError("Cannot fetch the live "+string(ptype)+" Policies", err.Error())
+		}
+		return nil
+	})
+	return policies, err
+}
 
+// Whether a Policy with the same Name and Type is live in the Domain. If so, refreshes the Policy (incl. its ID) with the live one
+func hasPolicy(pd *netpolicy.PolicyDomain, p *netpolicy.Policy) (bool, *bambou.Error) {
+	policies, err := getPoliciesByType(pd, p.Type)
+	if err != nil {
+		return false, err
+	}
+
+	for _, live := range policies {
+		if live.Name == p.Name {
+			*p = *live
+			return true, nil
+		}
 	}
 
+	return false, nil
+}
+
+// Refresh a Policy (incl. its ID) with the live one in the Domain. Error if not found
+func refreshPolicy(pd *netpolicy.PolicyDomain, p *netpolicy.Policy) *bambou.Error {
+	found, err := hasPolicy(pd, p)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return bambou.NewBambouError("Cannot find the live "+string(p.Type)+" Policy: "+p.Name, "")
+	}
 	return nil
 }
+
+// Apply a Policy to the Domain. The policy framework discards the draft changes on errors, so the Policy can be applied again
+func applyPolicy(pd *netpolicy.PolicyDomain, p *netpolicy.Policy) *bambou.Error {
+	return vsdCall("apply Policy: "+p.Name, func() *bambou.Error {
+		if err := pd.ApplyPolicy(p); err != nil {
+			return bambou.NewBambouError("Cannot apply Policy: "+p.Name, err.Error())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,243 @@
+package vsd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
+)
+
+////
+//// Priority management for the Policy Elements of the Ingress / Egress Policies
+////
+//// The VSD evaluates Policy Elements in increasing priority order (1 - 1,000,000,000), the first match wins. The priority range is split in bands, in order of precedence:
+//// - Nuage custom: Policy Elements of Nuage custom policies (NuageNetworkPolicy resources, see k8s-client/nuagepolicy.go). Their priorities are offsets within the band
+//// - K8S NetworkPolicy: Reserved for the Policy Elements translated from K8S NetworkPolicies
+//// - Services: Policy Elements allowing traffic to K8S services (see k8s-client/service.go)
+//// - Namespace default, allow resp. drop: Policy Elements for the namespace isolation modes (see k8s-client/isolation.go)
+//// - DefaultPriority: Domain wide default, lowest precedence
+////
+//// XXX - Notes:
+//// - Within a band, the priority of a Policy Element is derived from a hash of its Name (with linear probing on collisions). As such priorities do not depend on the order Policy Elements are applied in, and are the same across agent restarts
+//// - Policy Elements within a band are expected not to conflict with each other. Shadowed or overlapping Policy Elements are reported (see "PEConflicts")
+//// - Priorities below the Nuage custom band are not allocated by the agent. K8S NetworkPolicies are not translated to Policy Elements (yet): Nothing is allocated in the K8S NetworkPolicy band either
+
+type PriorityBand struct {
+	Name string
+	Min  int
+	Max  int
+}
+
+var (
+	CustomBand         = PriorityBand{"Nuage custom", 100000000, 299999999}
+	NetworkPolicyBand  = PriorityBand{"K8S NetworkPolicy", 300000000, 599999999}
+	ServicesBand       = PriorityBand{"K8S services", 600000000, 799999999}
+	NamespaceAllowBand = PriorityBand{"namespace default allow", 800000000, 899999999}
+	NamespaceDropBand  = PriorityBand{"namespace default drop", 900000000, 999999998}
+	DefaultBand        = PriorityBand{"default", DefaultPriority, DefaultPriority}
+)
+
+// Domain wide defaults (lowest precedence)
+const DefaultPriority = 999999999
+
+func (b PriorityBand) Contains(priority int) bool {
+	return priority >= b.Min && priority <= b.Max
+}
+
+// The priority at the given offset (1 - band size) within the band
+func (b PriorityBand) At(offset int) (int, error) {
+	if offset < 1 || offset > b.Max-b.Min+1 {
+		return 0, fmt.Errorf("Priority: %d outside the %s band. Valid values: 1 - %d", offset, b.Name, b.Max-b.Min+1)
+	}
+
+	return b.Min + offset - 1, nil
+}
+
+// The priority for a Policy Element with the given Name, in the band, not used by any other Policy Element of the given Policy
+func (b PriorityBand) slot(p *netpolicy.Policy, name string) (int, error) {
+	used := make(map[int]bool)
+	for _, pe := range p.PolicyElements {
+		if pe.Name != name {
+			used[pe.Priority] = true
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name))
+
+	size := b.Max - b.Min + 1
+	start := int(h.Sum32() % uint32(size))
+
+	for i := 0; i < size && i < len(used)+1; i++ {
+		prio := b.Min + (start+i)%size
+		if !used[prio] {
+			return prio, nil
+		}
+	}
+
+	return 0, fmt.Errorf("No free priority in %s band for Policy Element: %s", b.Name, name)
+}
+
+////
+//// Conflict detection
+////
+
+// Report the Policy Elements of the Policy that shadow or overlap with the given Policy Element (not yet applied)
+// - Shadowing: A Policy Element with higher precedence matches all the traffic "pe" matches. "pe" is never used (redundant if the Action is the same, conflicting otherwise)
+// - Overlapping: A Policy Element with higher / lower precedence and different Action matches part of the traffic "pe" matches
+func PEConflicts(p *netpolicy.Policy, pe *netpolicy.PolicyElement) []string {
+	var conflicts []string
+
+	for i := range p.PolicyElements {
+		other := &p.PolicyElements[i]
+		if other.Name == pe.Name {
+			continue
+		}
+		if conflict := peConflict(other, pe, ""); conflict != "" {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+
+	return conflicts
+}
+
+// Report the conflicts of the Policy Elements of a Policy not yet applied -- e.g. a Nuage custom policy -- within the Policy, and with the Policy Elements of the other Policies of the same Type in the Domain of the tenant
+func (tenant *Tenant) PolicyConflicts(p *netpolicy.Policy) ([]string, error) {
+	policies, err := tenant.Policies()
+	if err != nil {
+		return nil, err
+	}
+
+	var conflicts []string
+
+	for i := range p.PolicyElements {
+		pe := &p.PolicyElements[i]
+
+		conflicts = append(conflicts, PEConflicts(p, pe)...)
+
+		for _, other := range policies {
+			if other.Type != p.Type || other.Name == p.Name {
+				continue
+			}
+			for j := range other.PolicyElements {
+				if conflict := peConflict(&other.PolicyElements[j], pe, " of Policy: "+strconv.Quote(other.Name)); conflict != "" {
+					conflicts = append(conflicts, conflict)
+				}
+			}
+		}
+	}
+
+	return conflicts, nil
+}
+
+// The conflict between "pe" and another Policy Element ("in": the other Policy, if not the same one), if any
+func peConflict(other, pe *netpolicy.PolicyElement, in string) string {
+	switch {
+	case other.Priority == pe.Priority:
+		return fmt.Sprintf("Policy Element: %q has the same priority %d as Policy Element: %q%s", pe.Name, pe.Priority, other.Name, in)
+	case other.Priority < pe.Priority && peCovers(other, pe):
+		if other.Action == pe.Action {
+			return fmt.Sprintf("Policy Element: %q is redundant. Shadowed by Policy Element: %q%s (priority %d)", pe.Name, other.Name, in, other.Priority)
+		}
+		return fmt.Sprintf("Policy Element: %q is shadowed by Policy Element: %q%s (priority %d) with Action: %s", pe.Name, other.Name, in, other.Priority, other.Action)
+	case other.Action != pe.Action && peOverlaps(other, pe):
+		return fmt.Sprintf("Policy Element: %q (priority %d) overlaps with Policy Element: %q%s (priority %d) with Action: %s", pe.Name, pe.Priority, other.Name, in, other.Priority, other.Action)
+	}
+
+	return ""
+}
+
+// If all the traffic matched by "b" is matched by "a"
+func peCovers(a, b *netpolicy.PolicyElement) bool {
+	return scopeCovers(a.From.Type, a.From.Name, b.From.Type, b.From.Name, string(netpolicy.LAny)) &&
+		scopeCovers(a.To.Type, a.To.Name, b.To.Type, b.To.Name, string(netpolicy.NAny)) &&
+		trafficCovers(a.TrafficSpec, b.TrafficSpec)
+}
+
+// If some of the traffic matched by "b" may be matched by "a"
+// XXX - Scopes are compared by Type and Name only (e.g. a Zone vs. a Subnet of that Zone are assumed not to overlap)
+func peOverlaps(a, b *netpolicy.PolicyElement) bool {
+	return scopeOverlaps(a.From.Type, a.From.Name, b.From.Type, b.From.Name, string(netpolicy.LAny)) &&
+		scopeOverlaps(a.To.Type, a.To.Name, b.To.Type, b.To.Name, string(netpolicy.NAny)) &&
+		trafficOverlaps(a.TrafficSpec, b.TrafficSpec)
+}
+
+func scopeName(name *string) string {
+	if name == nil {
+		return ""
+	}
+	return *name
+}
+
+func scopeCovers(atype string, aname *string, btype string, bname *string, any string) bool {
+	return atype == any || (atype == btype && scopeName(aname) == scopeName(bname))
+}
+
+func scopeOverlaps(atype string, aname *string, btype string, bname *string, any string) bool {
+	return scopeCovers(atype, aname, btype, bname, any) || btype == any
+}
+
+func trafficCovers(a, b netpolicy.TrafficSpec) bool {
+	if a.Protocol == netpolicy.ProtoAny {
+		return true
+	}
+	if a.Protocol != b.Protocol {
+		return false
+	}
+
+	amin, amax := portRange(a.SrcPortRange)
+	bmin, bmax := portRange(b.SrcPortRange)
+	if bmin < amin || bmax > amax {
+		return false
+	}
+
+	amin, amax = portRange(a.DstPortRange)
+	bmin, bmax = portRange(b.DstPortRange)
+	return bmin >= amin && bmax <= amax
+}
+
+func trafficOverlaps(a, b netpolicy.TrafficSpec) bool {
+	if a.Protocol == netpolicy.ProtoAny || b.Protocol == netpolicy.ProtoAny {
+		return true
+	}
+	if a.Protocol != b.Protocol {
+		return false
+	}
+
+	amin, amax := portRange(a.SrcPortRange)
+	bmin, bmax := portRange(b.SrcPortRange)
+	if bmax < amin || bmin > amax {
+		return false
+	}
+
+	amin, amax = portRange(a.DstPortRange)
+	bmin, bmax = portRange(b.DstPortRange)
+	return bmax >= amin && bmin <= amax
+}
+
+// Port range as per policy framework format: nil or "*" (all ports), "<port>" or "<start port>-<end port>". Invalid port ranges match all ports
+func portRange(prange *string) (int, int) {
+	if prange == nil || *prange == "*" {
+		return 0, 65535
+	}
+
+	bounds := strings.SplitN(*prange, "-", 2)
+
+	min, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 65535
+	}
+
+	if len(bounds) == 1 {
+		return min, min
+	}
+
+	max, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return 0, 65535
+	}
+
+	return min, max
+}
@@ -0,0 +1,202 @@
+package vsd
+
+import (
+	"strings"
+	"testing"
+
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
+)
+
+func TestPriorityBandAt(t *testing.T) {
+	band := PriorityBand{"test", 100, 199}
+
+	tests := []struct {
+		offset int
+		prio   int
+		valid  bool
+	}{
+		{1, 100, true},
+		{50, 149, true},
+		{100, 199, true},
+		{0, 0, false},
+		{-1, 0, false},
+		{101, 0, false},
+	}
+
+	for _, test := range tests {
+		prio, err := band.At(test.offset)
+		if (err == nil) != test.valid {
+			t.Errorf("At(%d): error: %v, expected valid: %t", test.offset, err, test.valid)
+			continue
+		}
+		if prio != test.prio {
+			t.Errorf("At(%d) = %d, expected: %d", test.offset, prio, test.prio)
+		}
+	}
+}
+
+func TestPriorityBandsDisjoint(t *testing.T) {
+	bands := []PriorityBand{CustomBand, NetworkPolicyBand, ServicesBand, NamespaceAllowBand, NamespaceDropBand, DefaultBand}
+
+	for i := 1; i < len(bands); i++ {
+		if bands[i].Min <= bands[i-1].Max {
+			t.Errorf("%s band overlaps with %s band", bands[i].Name, bands[i-1].Name)
+		}
+	}
+}
+
+func TestSlot(t *testing.T) {
+	band := PriorityBand{"test", 1000, 1999}
+	p := &netpolicy.Policy{}
+
+	prio, err := band.slot(p, "pe")
+	if err != nil {
+		t.Fatalf("slot: %s", err)
+	}
+	if !band.Contains(prio) {
+		t.Fatalf("slot = %d, outside the band", prio)
+	}
+
+	// Stable: Does not depend on the other Policy Elements, unless the priority is taken
+	p.PolicyElements = append(p.PolicyElements, netpolicy.PolicyElement{Name: "other", Priority: band.Min})
+	if again, _ := band.slot(p, "pe"); again != prio {
+		t.Errorf("slot = %d, expected the same priority as before: %d", again, prio)
+	}
+
+	// A priority taken by another Policy Element is skipped, the one of the same Policy Element is re-used
+	p.PolicyElements = append(p.PolicyElements, netpolicy.PolicyElement{Name: "taken", Priority: prio})
+	if next, _ := band.slot(p, "pe"); next == prio || !band.Contains(next) {
+		t.Errorf("slot = %d, expected a free priority in the band other than: %d", next, prio)
+	}
+
+	p.PolicyElements = []netpolicy.PolicyElement{{Name: "pe", Priority: prio}}
+	if same, _ := band.slot(p, "pe"); same != prio {
+		t.Errorf("slot = %d, expected the priority of the Policy Element itself: %d", same, prio)
+	}
+}
+
+func TestSlotFull(t *testing.T) {
+	band := PriorityBand{"test", 10, 11}
+	p := &netpolicy.Policy{PolicyElements: []netpolicy.PolicyElement{{Name: "a", Priority: 10}, {Name: "b", Priority: 11}}}
+
+	if _, err := band.slot(p, "c"); err == nil {
+		t.Error("slot: expected an error for a full band")
+	}
+
+	if prio, err := band.slot(p, "a"); err != nil || prio != 10 {
+		t.Errorf("slot = %d, %v . Expected the priority of the Policy Element itself: 10", prio, err)
+	}
+}
+
+func TestPortRange(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	tests := []struct {
+		prange   *string
+		min, max int
+	}{
+		{nil, 0, 65535},
+		{str("*"), 0, 65535},
+		{str("80"), 80, 80},
+		{str("1000-2000"), 1000, 2000},
+		{str("http"), 0, 65535},
+		{str("10-x"), 0, 65535},
+	}
+
+	for _, test := range tests {
+		if min, max := portRange(test.prange); min != test.min || max != test.max {
+			t.Errorf("portRange(%s) = %d-%d, expected: %d-%d", scopeName(test.prange), min, max, test.min, test.max)
+		}
+	}
+}
+
+func TestPEConflicts(t *testing.T) {
+	zone := "zone"
+	other := "other zone"
+	port80, port8080, ports := "80", "8080", "1-1024"
+	any := "*"
+
+	tcp := func(dst *string) netpolicy.TrafficSpec {
+		return netpolicy.TrafficSpec{Protocol: netpolicy.TCP, SrcPortRange: &any, DstPortRange: dst}
+	}
+	pe := func(name string, prio int, from netpolicy.PolicySrcScope, traffic netpolicy.TrafficSpec, action netpolicy.Action) netpolicy.PolicyElement {
+		return netpolicy.PolicyElement{
+			Name:        name,
+			Priority:    prio,
+			From:        from,
+			To:          netpolicy.PolicyDstScope{Type: string(netpolicy.NZone), Name: &zone},
+			TrafficSpec: traffic,
+			Action:      action,
+		}
+	}
+	fromZone := netpolicy.PolicySrcScope{Type: string(netpolicy.LZone), Name: &zone}
+	fromOther := netpolicy.PolicySrcScope{Type: string(netpolicy.LZone), Name: &other}
+
+	tests := []struct {
+		desc     string
+		existing netpolicy.PolicyElement
+		pe       netpolicy.PolicyElement
+		conflict string // Expected in the conflict. Empty: No conflict
+	}{
+		{
+			"redundant",
+			pe("allow all", 10, netpolicy.AllSrcsIngress, netpolicy.MatchAllTraffic, netpolicy.Allow),
+			pe("allow http", 20, fromZone, tcp(&port80), netpolicy.Allow),
+			"is redundant",
+		},
+		{
+			"shadowed",
+			pe("drop all", 10, netpolicy.AllSrcsIngress, netpolicy.MatchAllTraffic, netpolicy.Deny),
+			pe("allow http", 20, fromZone, tcp(&port80), netpolicy.Allow),
+			"is shadowed",
+		},
+		{
+			"overlapping",
+			pe("drop low ports", 30, fromZone, tcp(&ports), netpolicy.Deny),
+			pe("allow http", 20, fromZone, tcp(&port80), netpolicy.Allow),
+			"overlaps",
+		},
+		{
+			"same priority",
+			pe("allow https", 20, fromZone, tcp(&port8080), netpolicy.Allow),
+			pe("allow http", 20, fromZone, tcp(&port80), netpolicy.Allow),
+			"same priority",
+		},
+		{
+			"disjoint ports",
+			pe("drop alt http", 10, fromZone, tcp(&port8080), netpolicy.Deny),
+			pe("allow http", 20, fromZone, tcp(&port80), netpolicy.Allow),
+			"",
+		},
+		{
+			"disjoint sources",
+			pe("drop other", 10, fromOther, netpolicy.MatchAllTraffic, netpolicy.Deny),
+			pe("allow http", 20, fromZone, tcp(&port80), netpolicy.Allow),
+			"",
+		},
+		{
+			"lower precedence, same action",
+			pe("allow all", 30, netpolicy.AllSrcsIngress, netpolicy.MatchAllTraffic, netpolicy.Allow),
+			pe("allow http", 20, fromZone, tcp(&port80), netpolicy.Allow),
+			"",
+		},
+	}
+
+	for _, test := range tests {
+		p := &netpolicy.Policy{PolicyElements: []netpolicy.PolicyElement{test.existing}}
+		conflicts := PEConflicts(p, &test.pe)
+
+		switch {
+		case test.conflict == "" && len(conflicts) != 0:
+			t.Errorf("%s: unexpected conflicts: %v", test.desc, conflicts)
+		case test.conflict != "" && (len(conflicts) != 1 || !strings.Contains(conflicts[0], test.conflict)):
+			t.Errorf("%s: conflicts: %v , expected one with: %q", test.desc, conflicts, test.conflict)
+		}
+	}
+
+	// The Policy Element itself (same Name) is not a conflict
+	self := pe("allow http", 20, fromZone, tcp(&port80), netpolicy.Allow)
+	if conflicts := PEConflicts(&netpolicy.Policy{PolicyElements: []netpolicy.PolicyElement{self}}, &self); len(conflicts) != 0 {
+		t.Errorf("self: unexpected conflicts: %v", conflicts)
+	}
+}
@@ -0,0 +1,210 @@
+package vsd
+
+import (
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
+
+	"github.com/nuagenetworks/go-bambou/bambou"
+)
+
+////
+//// Resilient VSD calls: Error classification, retries with jittered backoff and circuit breaking
+////
+//// XXX - Notes:
+//// - Transient errors (VSD unreachable, 5xx, throttling) are retried in place, up to "vsdRetryAttempts" times. The caller still holds "vsdmutex", i.e. the other VSD operations wait as well
+//// - A call failing after all its retries opens the circuit breaker for "circuitCooldown": Calls then fail fast -- without reaching the VSD -- with a transient error.
+////   After the cooldown the next calls go through again ("half open"): A success closes the circuit, a failure opens it again
+//// - The K8S event queues pause while the circuit is open and retry the events failing with transient errors (see k8s-client/workqueue.go), so events are not lost during VSD outages
+//// - "Already exists" conflicts are handled by the callers creating VSD objects: They fetch and adopt the existing object
+//// - A rejected API key (user + password sessions, e.g. expired key) is not counted as a failed attempt: The call is retried once after logging in again (see "relogin")
+//// - On shutdown ("Drain") transient errors are not retried any longer: The in-flight operations complete, or fail and clean up, before the shutdown deadline
+
+const (
+	vsdRetryAttempts  = 5
+	vsdRetryBaseDelay = 500 * time.Millisecond
+	vsdRetryMaxDelay  = 8 * time.Second
+	circuitCooldown   = 15 * time.Second
+)
+
+type ErrorClass int
+
+const (
+	ErrFatal        ErrorClass = iota // Not retried, e.g. VSD validation errors
+	ErrTransient                      // Retried, e.g. VSD unreachable or temporarily unavailable
+	ErrConflict                       // The VSD object already exists
+	ErrUnauthorized                   // The API key / credentials were rejected, e.g. expired API key
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrTransient:
+		return "transient"
+	case ErrConflict:
+		return "conflict"
+	case ErrUnauthorized:
+		return "unauthorized"
+	}
+	return "fatal"
+}
+
+var (
+	// bambou "HTTP error" responses worth retrying: 5xx, 408 (Request Timeout), 429 (Too Many Requests)
+	transientStatus = regexp.MustCompile(`"HTTP error", "description": "(5[0-9][0-9]|408|429) `)
+
+	// bambou "HTTP error" response to a rejected API key / credentials
+	unauthorizedStatus = regexp.MustCompile(`"HTTP error", "description": "401 `)
+
+	breaker struct {
+		sync.Mutex
+		open      bool
+		openUntil time.Time
+	}
+
+	// Non-zero once shutting down
+	draining int32
+)
+
+// Classify an error returned by the VSD client -- incl. wrapped bambou errors (their description holds the underlying error)
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ErrFatal
+	}
+
+	msg := err.Error()
+	switch {
+	case alreadyexistserr(err) || strings.Contains(msg, "already exists"):
+		return ErrConflict
+	case strings.Contains(msg, "HTTP client error"), // Connection errors, timeouts
+		strings.Contains(msg, "Non-VSD server HTTP error"), // E.g. load balancer / proxy responses during VSD maintenance
+		strings.Contains(msg, circuitOpenTitle),
+		transientStatus.MatchString(msg):
+		return ErrTransient
+	case unauthorizedStatus.MatchString(msg):
+		return ErrUnauthorized
+	}
+	return ErrFatal
+}
+
+// Jittered exponential backoff for the given attempt (starting at 1): Random in [d/2, d) with d = base * 2^(attempt-1), capped at max
+func Backoff(attempt int, base, max time.Duration) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Time left until the circuit breaker lets VSD calls through again. Zero if the circuit is closed (or half open)
+func CircuitWait() time.Duration {
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	if !breaker.open {
+		return 0
+	}
+	if wait := breaker.openUntil.Sub(time.Now()); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+const circuitOpenTitle = "VSD circuit breaker open"
+
+// Run a VSD call, retrying transient errors with jittered backoff. "op" describes the call, for logging
+func vsdCall(op string, call func() *bambou.Error) *bambou.Error {
+	if wait := CircuitWait(); wait > 0 {
+		return bambou.NewBambouError(circuitOpenTitle, "Not attempting: "+op+" . Retrying in: "+wait.String())
+	}
+
+	var err *bambou.Error
+	relogged := false
+	for attempt := 1; ; attempt++ {
+		session := currentSession()
+		if err = call(); err != nil && !relogged && Classify(err) == ErrUnauthorized {
+			if lerr := relogin(session); lerr != nil {
+				log.WithField(logging.FieldOp, op).Errorf("API key rejected. Cannot log in to the VSD again: %s", lerr)
+				err = lerr
+			} else {
+				relogged = true
+				err = call()
+			}
+		}
+
+		if err == nil || Classify(err) != ErrTransient {
+			circuitSuccess()
+			return err
+		}
+
+		if atomic.LoadInt32(&draining) != 0 {
+			log.WithField(logging.FieldOp, op).Warningf("Transient VSD error. Shutting down, not retrying. Error: %s", err)
+			return err
+		}
+
+		if attempt == vsdRetryAttempts {
+			break
+		}
+
+		delay := Backoff(attempt, vsdRetryBaseDelay, vsdRetryMaxDelay)
+		log.WithField(logging.FieldOp, op).Warningf("Transient VSD error (attempt %d/%d), retrying in: %s . Error: %s", attempt, vsdRetryAttempts, delay, err)
+		time.Sleep(delay)
+	}
+
+	circuitFailure(op)
+	return err
+}
+
+// Log in to the VSD again after the API key of the "rejected" session was rejected, e.g. expired. User + password sessions only
+// Calls rejected concurrently with the same session log in once: The session was already replaced for the later ones
+func relogin(rejected *bambou.Session) *bambou.Error {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	if mysession != rejected {
+		return nil
+	}
+
+	if loginConf == nil {
+		return bambou.NewBambouError("VSD login failed", "The VSD certificate was rejected")
+	}
+
+	log.Infof("API key rejected by the VSD. Logging in again as: %s", mysession.Username)
+
+	if err := makePasswordConn(loginConf); err != nil {
+		return bambou.NewBambouError("VSD login failed", err.Error())
+	}
+
+	return nil
+}
+
+// Stop retrying transient VSD errors, e.g. on shutdown
+func Drain() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+func circuitSuccess() {
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	if breaker.open {
+		log.Info("VSD calls succeeding again, closing the circuit breaker")
+		breaker.open = false
+	}
+}
+
+func circuitFailure(op string) {
+	breaker.Lock()
+	defer breaker.Unlock()
+
+	breaker.open = true
+	breaker.openUntil = time.Now().Add(circuitCooldown)
+	log.WithField(logging.FieldOp, op).Errorf("VSD call failed after %d attempts. Opening the circuit breaker for: %s", vsdRetryAttempts, circuitCooldown)
+}
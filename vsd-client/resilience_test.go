@@ -0,0 +1,59 @@
+package vsd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nuagenetworks/go-bambou/bambou"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err   error
+		class ErrorClass
+	}{
+		{nil, ErrFatal},
+		{bambou.NewBambouError("HTTP client error", "dial tcp 10.0.0.1:8443: connection refused"), ErrTransient},
+		{bambou.NewBambouError("HTTP error", "503 Service Unavailable"), ErrTransient},
+		{bambou.NewBambouError("HTTP error", "429 Too Many Requests"), ErrTransient},
+		{bambou.NewBambouError("Non-VSD server HTTP error", "404 Not Found"), ErrTransient},
+		{bambou.NewBambouError(circuitOpenTitle, "Not attempting: test"), ErrTransient},
+		{bambou.NewBambouError("HTTP error", "401 Unauthorized"), ErrUnauthorized},
+		{bambou.NewBambouError("HTTP error", "400 Bad Request"), ErrFatal},
+		{bambou.NewBambouError("Cannot create Zone: test", "Another zone with the same name already exists"), ErrConflict},
+		{errors.New("invalid Policy"), ErrFatal},
+		// Wrapped errors: Classified by their underlying error
+		{bambou.NewBambouError("Cannot fetch the Containers of Domain: test", bambou.NewBambouError("HTTP error", "502 Bad Gateway").Error()), ErrTransient},
+		{bambou.NewBambouError("Cannot fetch the Containers of Domain: test", bambou.NewBambouError("HTTP error", "401 Unauthorized").Error()), ErrUnauthorized},
+	}
+
+	for _, test := range tests {
+		if class := Classify(test.err); class != test.class {
+			t.Errorf("Classify(%v) = %s, expected: %s", test.err, class, test.class)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	base, max := 100*time.Millisecond, time.Second
+
+	tests := []struct {
+		attempt int
+		d       time.Duration // Nominal delay: The backoff is in [d/2, d]
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second}, // Capped
+		{50, time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 100; i++ {
+			if delay := Backoff(test.attempt, base, max); delay < test.d/2 || delay > test.d {
+				t.Fatalf("Backoff(%d) = %s, expected in: [%s, %s]", test.attempt, delay, test.d/2, test.d)
+			}
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package vsd
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nuagenetworks/go-bambou/bambou"
+	"github.com/nuagenetworks/vspk-go/vspk"
+
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
+)
+
+////
+//// Tenants: VSD Domains -- optionally in their own Enterprises -- hosting K8S namespaces
+////
+//// By default all K8S namespaces are mapped to the Enterprise / Domain of the agent configuration ("DefaultTenant")
+//// The tenants mapping file ("tenants-config") assigns namespaces to other Domains, for separation between tenants sharing the cluster. Each tenant has:
+//// - The VSD Zones, Subnets and Containers of its namespaces, in the tenant Domain
+//// - Its own Ingress / Egress Policies, initialized as for the default Domain (see policies.go)
+//// - The Network Macros / Groups of its namespaces (K8S services, endpoints, external networks), in the tenant Enterprise
+////
+//// XXX - Notes:
+//// - Tenant Enterprises / Domains are created on demand -- i.e. when the first namespace mapped to them is processed -- the same way "InitClient" creates the default ones
+//// - Tenant Domains are separate L3 domains: There is no connectivity between namespaces of different tenants (incl. K8S services)
+//// - The mapping is not used for namespace annotations on purpose: namespace owners could otherwise move their namespace to another tenant
+//// - The mapping is read at startup. Changing the tenant of an existing namespace does not move its VSD constructs: The namespace has to be deleted and re-created
+
+type Tenant struct {
+	Enterprise *vspk.Enterprise
+	Domain     *vspk.Domain
+
+	// Low priority "allow all" traffic for network egress. Per namespace egress restrictions are added on top of it (see k8s-client/egress.go)
+	EgressPolicy *netpolicy.Policy
+	// Actual policy rules are imposed on network ingress
+	IngressPolicy *netpolicy.Policy
+}
+
+var (
+	// The Enterprise / Domain of the agent configuration
+	DefaultTenant *Tenant
+
+	tenants      map[string]*Tenant // Key: Enterprise name + "/" + Domain name. Incl. "DefaultTenant"
+	tenantsMutex sync.Mutex
+
+	// Tenants mapping file. Key: K8S namespace name
+	namespaceTenants map[string]config.TenantConfig
+
+	// Set by "Connect": Enterprises, Domains and Policies are looked up only, never created
+	readOnly = false
+
+	// Domain template of the agent configuration, and desired settings of all the Domains
+	domainTemplate string
+	domainSettings config.DomainSettings
+)
+
+func (tenant *Tenant) String() string {
+	return tenant.Enterprise.Name + "/" + tenant.Domain.Name
+}
+
+// Read and sanity check the tenants mapping file, if configured
+func initTenants(conf *config.AgentConfig) error {
+	namespaceTenants = make(map[string]config.TenantConfig)
+	domainTemplate = conf.VsdConfig.DomainTemplate
+	domainSettings = conf.VsdConfig.DomainSettings
+
+	if conf.VsdConfig.TenantsConfigFile == "" {
+		log.Info("No tenants mapping file configured. All K8S namespaces are mapped to VSD Domain: " + conf.VsdConfig.Domain)
+		return nil
+	}
+
+	tconf, err := config.LoadTenantsConfig(conf.VsdConfig.TenantsConfigFile)
+	if err != nil {
+		return bambou.NewBambouError("Cannot read tenants mapping file: "+conf.VsdConfig.TenantsConfigFile, err.Error())
+	}
+
+	if errs := tconf.Validate(); len(errs) > 0 {
+		return bambou.NewBambouError("Invalid tenants mapping file: "+conf.VsdConfig.TenantsConfigFile, errs[0].Error())
+	}
+
+	for _, tenant := range tconf.Tenants {
+		for _, ns := range tenant.Namespaces {
+			namespaceTenants[ns] = tenant
+		}
+	}
+
+	log.Infof("Loaded tenants mapping file: %s . %d tenant(s), %d K8S namespace(s)", conf.VsdConfig.TenantsConfigFile, len(tconf.Tenants), len(namespaceTenants))
+	return nil
+}
+
+// The tenant of a K8S namespace, per the tenants mapping file. Finds -- or creates if needed -- the tenant Enterprise / Domain
+func NamespaceTenant(namespace string) (*Tenant, error) {
+	mapping, mapped := namespaceTenants[namespace]
+	if !mapped {
+		return DefaultTenant, nil
+	}
+
+	return GetTenant(mapping.Enterprise, mapping.Domain, mapping.DomainTemplate)
+}
+
+// Find -- or create if needed, from the given Domain template -- the tenant for the given Enterprise / Domain, incl. its Ingress / Egress Policies
+// Empty Enterprise: The Enterprise of the default tenant. Empty template: The Domain template of the agent configuration
+func GetTenant(enterprise, domain, template string) (*Tenant, error) {
+	tenantsMutex.Lock()
+	defer tenantsMutex.Unlock()
+
+	if enterprise == "" {
+		enterprise = DefaultTenant.Enterprise.Name
+	}
+
+	if tenant, exists := tenants[enterprise+"/"+domain]; exists {
+		return tenant, nil
+	}
+
+	tenant := new(Tenant)
+	var err error
+
+	if enterprise == DefaultTenant.Enterprise.Name {
+		tenant.Enterprise = DefaultTenant.Enterprise
+	} else if tenant.Enterprise, err = findEnterprise(enterprise); err != nil {
+		return nil, err
+	}
+
+	if template == "" {
+		template = domainTemplate
+	}
+
+	if tenant.Domain, err = findDomain(tenant.Enterprise, domain, template); err != nil {
+		return nil, err
+	}
+
+	if readOnly {
+		err = tenant.lookupPolicies()
+	} else {
+		err = tenant.initPolicies()
+	}
+	if err != nil {
+		return nil, bambou.NewBambouError("Cannot initialize the Policies of VSD Domain: "+domain, err.Error())
+	}
+
+	tenants[enterprise+"/"+domain] = tenant
+	log.Infof("Initialized tenant: VSD Enterprise: %s , Domain: %s", enterprise, domain)
+	return tenant, nil
+}
+
+// All the tenants initialized so far, the default tenant first
+func Tenants() []*Tenant {
+	tenantsMutex.Lock()
+	defer tenantsMutex.Unlock()
+
+	var others []*Tenant
+	for _, tenant := range tenants {
+		if tenant != DefaultTenant {
+			others = append(others, tenant)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].String() < others[j].String() })
+
+	return append([]*Tenant{DefaultTenant}, others...)
+}
+
+// All the tenants in the mapping file, initializing them if needed, the default tenant first. E.g. for checks / audits covering all the namespaces
+func MappedTenants() ([]*Tenant, error) {
+	for ns := range namespaceTenants {
+		if _, err := NamespaceTenant(ns); err != nil {
+			return nil, err
+		}
+	}
+
+	return Tenants(), nil
+}
+
+////////
+//////// Enterprises / Domains
+////////
+
+// Find -- or create if needed -- the VSD Enterprise with the given name
+func findEnterprise(name string) (*vspk.Enterprise, error) {
+	el, err := fetchEnterprises(name)
+	if err != nil {
+		return nil, bambou.NewBambouError("Error fetching list of Enterprises from the VSD", err.Error())
+	}
+
+	switch {
+	case len(el) == 1: // Given Enterprise already exists
+		log.Infof("Found existing Enterprise: %s , re-using...", name)
+		return el[0], nil
+	case readOnly:
+		return nil, bambou.NewBambouError("Cannot find VSD Enterprise: "+name, "")
+	}
+
+	log.Infof("VSD Enterprise %s not found, creating...", name)
+	enterprise := new(vspk.Enterprise)
+	enterprise.Name = name
+	enterprise.Description = "Automatically created Enterprise for K8S Cluster"
+	if err := vsdCall("create Enterprise: "+name, func() *bambou.Error { return currentRoot().CreateEnterprise(enterprise) }); err != nil {
+		// Created concurrently, or by an earlier attempt whose response was lost: Adopt it
+		if Classify(err) == ErrConflict {
+			if el, ferr := fetchEnterprises(name); ferr == nil && len(el) == 1 {
+				log.Infof("Enterprise: %s already exists, re-using...", name)
+				return el[0], nil
+			}
+		}
+		return nil, bambou.NewBambouError("Cannot create Enterprise: "+name, err.Error())
+	}
+
+	log.Infof("Created Enterprise: %s", name)
+	return enterprise, nil
+}
+
+// Find -- or create if needed -- the VSD Domain with the given name in the Enterprise
+// Missing Domains are instantiated from the given (existing) Domain template or, if empty, from a new Domain template. Existing Domains are checked against the desired settings
+func findDomain(enterprise *vspk.Enterprise, name, template string) (*vspk.Domain, error) {
+	dl, err := fetchDomains(enterprise, name)
+	if err != nil {
+		return nil, bambou.NewBambouError("Error fetching list of Domains from the VSD", err.Error())
+	}
+
+	switch {
+	case len(dl) == 1: // Given Domain already exists
+		log.Infof("Found existing Domain: %s , re-using...", name)
+		checkDomainSettings(dl[0])
+		return dl[0], nil
+	case readOnly:
+		return nil, bambou.NewBambouError("Cannot find VSD Domain: "+name+" in Enterprise: "+enterprise.Name, "")
+	}
+
+	log.Infof("VSD Domain %s not found, creating...", name)
+	// First, we need a Domain template.
+	domaintemplate, terr := findDomainTemplate(enterprise, name, template)
+	if terr != nil {
+		return nil, terr
+	}
+	// Create Domain under this template
+	domain := new(vspk.Domain)
+	domain.Name = name
+	domain.Description = "Automatically created Domain for K8S Cluster"
+	domain.ExternalID = ExternalID(domain.Name)
+	domain.TemplateID = domaintemplate.ID
+	applyDomainSettings(domain)
+	if err := vsdCall("create Domain: "+name, func() *bambou.Error { return enterprise.CreateDomain(domain) }); err != nil {
+		if Classify(err) == ErrConflict {
+			if dl, ferr := fetchDomains(enterprise, name); ferr == nil && len(dl) == 1 {
+				log.Infof("Domain: %s already exists, re-using...", name)
+				checkDomainSettings(dl[0])
+				return dl[0], nil
+			}
+		}
+		return nil, bambou.NewBambouError("Cannot create Domain: "+name, err.Error())
+	}
+
+	log.Infof("Created Domain: %s from Domain template: %s", name, domaintemplate.Name)
+	return domain, nil
+}
+
+// The Domain template to instantiate the given Domain from: The given existing template or, if empty, a new one with default settings
+func findDomainTemplate(enterprise *vspk.Enterprise, domain, template string) (*vspk.DomainTemplate, error) {
+	if template == "" {
+		domaintemplate := new(vspk.DomainTemplate)
+		domaintemplate.Name = "Template for Domain " + domain
+		if err := vsdCall("create Domain Template: "+domaintemplate.Name, func() *bambou.Error { return enterprise.CreateDomainTemplate(domaintemplate) }); err != nil {
+			// E.g. left by a previous attempt to create the Domain
+			if Classify(err) == ErrConflict {
+				if dtl, ferr := fetchDomainTemplates(enterprise, domaintemplate.Name); ferr == nil && len(dtl) == 1 {
+					return dtl[0], nil
+				}
+			}
+			return nil, bambou.NewBambouError("Cannot create Domain Template: "+domaintemplate.Name, err.Error())
+		}
+		return domaintemplate, nil
+	}
+
+	dtl, err := fetchDomainTemplates(enterprise, template)
+	if err != nil {
+		return nil, bambou.NewBambouError("Error fetching list of Domain Templates from the VSD", err.Error())
+	}
+	if len(dtl) != 1 {
+		// Not creating it: The template is maintained outside of the agent, presumably with non-default settings
+		return nil, bambou.NewBambouError("Cannot find VSD Domain Template: "+template+" in Enterprise: "+enterprise.Name, "")
+	}
+
+	log.Infof("Found existing Domain Template: %s , using it for Domain: %s", template, domain)
+	return dtl[0], nil
+}
+
+// The Enterprises with the given name
+func fetchEnterprises(name string) (el vspk.EnterprisesList, err *bambou.Error) {
+	err = vsdCall("fetch Enterprise: "+name, func() (err *bambou.Error) {
+		el, err = currentRoot().Enterprises(&bambou.FetchingInfo{Filter: "name == \"" + name + "\""})
+		return
+	})
+	return
+}
+
+// The Domains of the Enterprise with the given name
+func fetchDomains(enterprise *vspk.Enterprise, name string) (dl vspk.DomainsList, err *bambou.Error) {
+	err = vsdCall("fetch Domain: "+name, func() (err *bambou.Error) {
+		dl, err = enterprise.Domains(&bambou.FetchingInfo{Filter: "name == \"" + name + "\""})
+		return
+	})
+	return
+}
+
+// The Domain templates of the Enterprise with the given name
+func fetchDomainTemplates(enterprise *vspk.Enterprise, name string) (dtl vspk.DomainTemplatesList, err *bambou.Error) {
+	err = vsdCall("fetch Domain Template: "+name, func() (err *bambou.Error) {
+		dtl, err = enterprise.DomainTemplates(&bambou.FetchingInfo{Filter: "name == \"" + name + "\""})
+		return
+	})
+	return
+}
+
+////////
+//////// Domain settings
+////////
+
+//// XXX - Notes:
+//// - Settings left empty in the configuration are as per the Domain template / VSD defaults, and not checked
+//// - Existing Domains are checked at startup (default tenant) or when first used (other tenants)
+//// - Mismatches of existing Domains are only reported, not corrected: Some settings (e.g. route distinguishers) cannot be changed on a Domain in use
+
+// A Domain setting: The Domain field and its desired value
+type domainSetting struct {
+	field *string
+	value string
+}
+
+// The desired Domain settings. Key: Setting name, as in the configuration
+func domainSettingsFields(domain *vspk.Domain) map[string]domainSetting {
+	return map[string]domainSetting{
+		"underlay":            {&domain.UnderlayEnabled, strings.ToUpper(domainSettings.Underlay)},
+		"pat":                 {&domain.PATEnabled, strings.ToUpper(domainSettings.PAT)},
+		"dhcp-behavior":       {&domain.DHCPBehavior, strings.ToUpper(domainSettings.DHCPBehavior)},
+		"encryption":          {&domain.Encryption, strings.ToUpper(domainSettings.Encryption)},
+		"route-distinguisher": {&domain.RouteDistinguisher, domainSettings.RouteDistinguisher},
+		"route-target":        {&domain.RouteTarget, domainSettings.RouteTarget},
+	}
+}
+
+// Set the desired settings on a Domain to be created
+func applyDomainSettings(domain *vspk.Domain) {
+	for _, s := range domainSettingsFields(domain) {
+		if s.value != "" {
+			*s.field = s.value
+		}
+	}
+}
+
+// Report the settings of an existing Domain that differ from the desired ones. Returns the number of mismatches
+func checkDomainSettings(domain *vspk.Domain) int {
+	settings := domainSettingsFields(domain)
+	var names []string
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	mismatches := 0
+	for _, name := range names {
+		if s := settings[name]; s.value != "" && *s.field != s.value {
+			log.Warningf("VSD Domain: %s setting: %s is: %q , configured: %q", domain.Name, name, *s.field, s.value)
+			mismatches++
+		}
+	}
+
+	if mismatches > 0 {
+		log.Warningf("VSD Domain: %s has %d setting(s) differing from the configured Domain settings. Not changing them -- update the Domain on the VSD if needed", domain.Name, mismatches)
+	}
+	return mismatches
+}
+
+// Key of the local caches of VSD constructs: Parent (Domain / Enterprise) ID + Name. Names are unique per parent only
+func cacheKey(parentID, name string) string {
+	return parentID + "/" + name
+}
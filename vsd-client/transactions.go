@@ -0,0 +1,323 @@
+package vsd
+
+import (
+	"github.com/nuagenetworks/go-bambou/bambou"
+	"github.com/nuagenetworks/vspk-go/vspk"
+
+	netpolicy "github.com/OpenPlatformSDN/nuage-policy-framework"
+)
+
+////
+//// Policy transactions: Atomic changes to the Policy Elements of the Ingress / Egress Policies
+////
+//// Changes are staged locally, then committed in one VSD draft:
+//// - BEGIN_POLICY_CHANGES: Draft copies of the Domain ACL templates
+//// - Policy Element changes are made to the draft ACL templates
+//// - APPLY_POLICY_CHANGES: The drafts replace the live ACL templates, all in one go. On any error, DISCARD_POLICY_CHANGES leaves the live ACL templates unchanged
+////
+//// E.g.:
+////    t := NewPolicyTransaction()
+////    t.ApplyIngressPE(pe, ServicesBand)
+////    t.DeleteIngressPE(stale)
+////    err := t.Commit()
+////
+//// XXX - Notes:
+//// - A transaction changes the Policies of one tenant (see tenants.go). "NewPolicyTransaction" is for the default tenant
+//// - Deletions are processed before the Policy Elements are applied. As such a Policy Element may be replaced (deleted and re-applied with the same Name) in the same transaction
+//// - Applying a Policy Element already applied with the same Name within its band is a no-op (same as for single Policy Elements)
+//// - Transactions are serialized with all other policy changes. Priorities are assigned at commit time
+//// - Whole Policies (e.g. NuageNetworkPolicy resources) are applied by the policy framework in a single draft already (see ApplyPolicy)
+//// - The VSD jobs and draft changes are made through "vsdCall": Transient errors are retried in place, within the same draft
+
+// A staged Policy Element change
+type peChange struct {
+	policy *netpolicy.Policy
+	pe     *netpolicy.PolicyElement // Apply. nil for deletions
+	band   PriorityBand
+	name   string
+}
+
+type PolicyTransaction struct {
+	tenant  *Tenant
+	deletes []peChange
+	applies []peChange
+}
+
+func NewPolicyTransaction() *PolicyTransaction {
+	return DefaultTenant.NewPolicyTransaction()
+}
+
+// A transaction for the Policies of the tenant
+func (tenant *Tenant) NewPolicyTransaction() *PolicyTransaction {
+	return &PolicyTransaction{tenant: tenant}
+}
+
+// Stage applying a Policy Element to the Ingress Policy, with a priority in the given band (see priorities.go)
+func (t *PolicyTransaction) ApplyIngressPE(pe *netpolicy.PolicyElement, band PriorityBand) {
+	t.applies = append(t.applies, peChange{policy: t.tenant.IngressPolicy, pe: pe, band: band, name: pe.Name})
+}
+
+// Stage applying a Policy Element to the Egress Policy, with a priority in the given band (see priorities.go)
+func (t *PolicyTransaction) ApplyEgressPE(pe *netpolicy.PolicyElement, band PriorityBand) {
+	t.applies = append(t.applies, peChange{policy: t.tenant.EgressPolicy, pe: pe, band: band, name: pe.Name})
+}
+
+// Stage deleting a Policy Element from the Ingress Policy, if it exists
+func (t *PolicyTransaction) DeleteIngressPE(name string) {
+	t.deletes = append(t.deletes, peChange{policy: t.tenant.IngressPolicy, name: name})
+}
+
+// Stage deleting a Policy Element from the Egress Policy, if it exists
+func (t *PolicyTransaction) DeleteEgressPE(name string) {
+	t.deletes = append(t.deletes, peChange{policy: t.tenant.EgressPolicy, name: name})
+}
+
+// Drop all the staged changes
+func (t *PolicyTransaction) Discard() {
+	t.deletes = nil
+	t.applies = nil
+}
+
+// Whether any changes are staged
+func (t *PolicyTransaction) Empty() bool {
+	return len(t.deletes) == 0 && len(t.applies) == 0
+}
+
+// Commit the staged changes in one VSD draft. Either all or none of the changes are applied
+func (t *PolicyTransaction) Commit() error {
+	policymutex.Lock()
+	defer policymutex.Unlock()
+
+	defer t.Discard()
+
+	////
+	//// Resolve the staged changes against the local copy of the Policies
+	////
+
+	deleted := make(map[*netpolicy.Policy]map[string]bool)
+	var deletes []peChange
+
+	for _, change := range t.deletes {
+		if findPE(change.policy, change.name) == nil || deleted[change.policy][change.name] {
+			continue
+		}
+		if deleted[change.policy] == nil {
+			deleted[change.policy] = make(map[string]bool)
+		}
+		deleted[change.policy][change.name] = true
+		deletes = append(deletes, change)
+	}
+
+	var applies []peChange
+
+	for _, change := range t.applies {
+		if prev := findPE(change.policy, change.name); prev != nil && !deleted[change.policy][change.name] {
+			if change.band.Contains(prev.Priority) {
+				continue
+			}
+			log.Infof("Policy Element: %s has priority: %d outside the %s band. Re-applying...", change.name, prev.Priority, change.band.Name)
+			if deleted[change.policy] == nil {
+				deleted[change.policy] = make(map[string]bool)
+			}
+			deleted[change.policy][change.name] = true
+			deletes = append(deletes, peChange{policy: change.policy, name: change.name})
+		}
+		applies = append(applies, change)
+	}
+
+	if len(deletes) == 0 && len(applies) == 0 {
+		return nil
+	}
+
+	// Detach the deleted Policy Elements and attach the applied ones locally -- i.e. priorities are assigned against the resulting Policies. Reverted on errors
+	var detached, attached []peChange
+
+	revert := func() {
+		for _, change := range attached {
+			change.policy.DetachPE(change.pe)
+		}
+		for _, change := range detached {
+			change.pe.Parent = nil
+			change.policy.AttachPE(change.pe)
+		}
+	}
+
+	for _, change := range deletes {
+		pe := findPE(change.policy, change.name)
+		saved := *pe
+		change.policy.DetachPE(pe)
+		detached = append(detached, peChange{policy: change.policy, pe: &saved, name: change.name})
+	}
+
+	for _, change := range applies {
+		prio, err := change.band.slot(change.policy, change.name)
+		if err != nil {
+			revert()
+			return bambou.NewBambouError("Cannot apply Policy Element: "+change.name, err.Error())
+		}
+		change.pe.Priority = prio
+
+		// Report conflicts with the Policy Elements already applied. Those are not fatal
+		for _, conflict := range PEConflicts(change.policy, change.pe) {
+			log.Warningf("Applying Policy Element: %s . Conflict: %s", change.name, conflict)
+		}
+
+		change.pe.ID = ""
+		change.pe.Parent = nil
+		if err := change.policy.AttachPE(change.pe); err != nil {
+			revert()
+			return bambou.NewBambouError("Cannot apply Policy Element: "+change.name, err.Error())
+		}
+		attached = append(attached, change)
+	}
+
+	////
+	//// VSD draft
+	////
+
+	pd := (*netpolicy.PolicyDomain)(t.tenant.Domain)
+
+	if err := policyJob(pd, "BEGIN_POLICY_CHANGES"); err != nil {
+		revert()
+		return bambou.NewBambouError("Cannot begin policy changes", err.Error())
+	}
+
+	if err := commitDraft(t.tenant.Domain, deletes, applies); err != nil {
+		revert()
+		if joberr := policyJob(pd, "DISCARD_POLICY_CHANGES"); joberr != nil {
+			return bambou.NewBambouError("Cannot commit policy changes", err.Error()+" . Cannot discard policy changes: "+joberr.Error())
+		}
+		return bambou.NewBambouError("Cannot commit policy changes", err.Error())
+	}
+
+	if err := policyJob(pd, "APPLY_POLICY_CHANGES"); err != nil {
+		revert()
+		policyJob(pd, "DISCARD_POLICY_CHANGES")
+		return bambou.NewBambouError("Cannot apply policy changes", err.Error())
+	}
+
+	for _, change := range deletes {
+		log.Infof("Successfully deleted %s Policy Element: %s", change.policy.Type, change.name)
+	}
+	for _, change := range applies {
+		log.Infof("Successfully applied %s Policy Element: %s with priority: %d", change.policy.Type, change.name, change.pe.Priority)
+	}
+
+	return nil
+}
+
+// Run a VSD policy job (see the policy framework "PolicyDomain.Job") on the Domain
+func policyJob(pd *netpolicy.PolicyDomain, cmd string) *bambou.Error {
+	return vsdCall(cmd+" on Domain: "+pd.Name, func() *bambou.Error {
+		if err := pd.Job(cmd); err != nil {
+			return bambou.NewBambouError("VSD job: "+cmd+" failed", err.Error())
+		}
+		return nil
+	})
+}
+
+// Make the staged changes to the draft ACL templates of the Domain
+func commitDraft(vsdd *vspk.Domain, deletes, applies []peChange) error {
+
+	// Draft ACL templates, by Policy
+	idrafts := make(map[*netpolicy.Policy]*vspk.IngressACLTemplate)
+	edrafts := make(map[*netpolicy.Policy]*vspk.EgressACLTemplate)
+
+	for _, change := range append(deletes, applies...) {
+		p := change.policy
+		filter := &bambou.FetchingInfo{Filter: "name == \"" + p.Name + "\" and policyState == \"DRAFT\""}
+
+		switch p.Type {
+		case netpolicy.Ingress:
+			if idrafts[p] != nil {
+				continue
+			}
+			var drafts vspk.IngressACLTemplatesList
+			err := vsdCall("fetch the draft of Policy: "+p.Name, func() (err *bambou.Error) {
+				drafts, err = vsdd.IngressACLTemplates(filter)
+				return
+			})
+			if err != nil {
+				return err
+			}
+			if len(drafts) != 1 {
+				return bambou.NewBambouError("Cannot find the draft of Policy: "+p.Name, "")
+			}
+			idrafts[p] = drafts[0]
+		case netpolicy.Egress:
+			if edrafts[p] != nil {
+				continue
+			}
+			var drafts vspk.EgressACLTemplatesList
+			err := vsdCall("fetch the draft of Policy: "+p.Name, func() (err *bambou.Error) {
+				drafts, err = vsdd.EgressACLTemplates(filter)
+				return
+			})
+			if err != nil {
+				return err
+			}
+			if len(drafts) != 1 {
+				return bambou.NewBambouError("Cannot find the draft of Policy: "+p.Name, "")
+			}
+			edrafts[p] = drafts[0]
+		}
+	}
+
+	for _, change := range deletes {
+		filter := &bambou.FetchingInfo{Filter: "description == \"" + change.name + "\""}
+
+		switch change.policy.Type {
+		case netpolicy.Ingress:
+			var entries vspk.IngressACLEntryTemplatesList
+			err := vsdCall("fetch Policy Element: "+change.name, func() (err *bambou.Error) {
+				entries, err = idrafts[change.policy].IngressACLEntryTemplates(filter)
+				return
+			})
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := vsdCall("delete Policy Element: "+change.name, entry.Delete); err != nil {
+					return bambou.NewBambouError("Cannot delete Policy Element: "+change.name, err.Error())
+				}
+			}
+		case netpolicy.Egress:
+			var entries vspk.EgressACLEntryTemplatesList
+			err := vsdCall("fetch Policy Element: "+change.name, func() (err *bambou.Error) {
+				entries, err = edrafts[change.policy].EgressACLEntryTemplates(filter)
+				return
+			})
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if err := vsdCall("delete Policy Element: "+change.name, entry.Delete); err != nil {
+					return bambou.NewBambouError("Cannot delete Policy Element: "+change.name, err.Error())
+				}
+			}
+		}
+	}
+
+	for _, change := range applies {
+		switch change.policy.Type {
+		case netpolicy.Ingress:
+			entry, err := change.pe.MapToIngressACLEntry()
+			if err != nil {
+				return err
+			}
+			if err := vsdCall("apply Policy Element: "+change.name, func() *bambou.Error { return idrafts[change.policy].CreateIngressACLEntryTemplate(entry) }); err != nil {
+				return bambou.NewBambouError("Cannot apply Policy Element: "+change.name, err.Error())
+			}
+		case netpolicy.Egress:
+			entry, err := change.pe.MapToEgressACLEntry()
+			if err != nil {
+				return err
+			}
+			if err := vsdCall("apply Policy Element: "+change.name, func() *bambou.Error { return edrafts[change.policy].CreateEgressACLEntryTemplate(entry) }); err != nil {
+				return bambou.NewBambouError("Cannot apply Policy Element: "+change.name, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
@@ -11,43 +11,45 @@ import (
 	"sync"
 	"time"
 
-	yaml "gopkg.in/yaml.v2"
-
-	"github.com/golang/glog"
-
 	"github.com/OpenPlatformSDN/nuage-k8s-cni/config"
+	"github.com/OpenPlatformSDN/nuage-k8s-cni/logging"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/nuagenetworks/go-bambou/bambou"
 	"github.com/nuagenetworks/vspk-go/vspk"
 )
 
 const (
 	MAX_SUBNETS = 2048 // Practical, safety max limit on nr Subnets we handle (upper limit for 1<< SubnetLength)
-	////
-	//// Patterns for K8S construct naming in VSD
-	////
-	ZONE_NAME = "K8S namespace "
-	NMG_NAME  = "K8S services in namespace " // Network Macro Group Name
-	NM_NAME   = "K8S service "               // Network Macro Name
+	//// Names for K8S constructs in VSD: see naming.go
 )
 
 var (
+	// Structured logger. The VSD operations use one with the context of the VSD object (see "vsdLog")
+	log = logging.Log.WithField(logging.FieldComponent, "vsd-client")
+
 	// Nuage API connection defaults. We need to keep them as global vars since commands can be invoked in whatever order.
 
 	root      *vspk.Me
 	mysession *bambou.Session
 
+	// The configuration the current user + password session was established with, for logging in again (see "relogin"). nil for X.509 certificate based sessions
+	loginConf *config.AgentConfig
+
+	// Serialize replacing the VSD session ("mysession", "root", "loginConf"): "relogin" and "Reconnect"
+	sessionMutex sync.Mutex
+
 	// K8S Master config -- includes network information and etcd client details
 	k8sMasterConfig config.MasterConfig
 
-	// Nuage Enterprise and Domain for this K8S cluster. Created if they don't exist already
+	// Nuage Enterprise and Domain for this K8S cluster (i.e. "DefaultTenant", see tenants.go). Created if they don't exist already
 	Enterprise *vspk.Enterprise
 	Domain     *vspk.Domain
 
-	//// XXX - VSD view of things. Must be reconciled with K8S data
-	Zones map[string]*Zone              // Key: ZONE_NAME + Name
-	NMGs  map[string]*NetworkMacroGroup // Key: NMG_NAME + Name
-	NMs   map[string]*NetworkMacro      // Key: NM_NAME + Name
+	//// XXX - VSD view of things, for all tenants. Must be reconciled with K8S data
+	Zones map[string]*Zone              // Key: Domain ID + "/" + Zone Name
+	NMGs  map[string]*NetworkMacroGroup // Key: Enterprise ID + "/" + Network Macro Group Name
+	NMs   map[string]*NetworkMacro      // Key: Enterprise ID + "/" + Network Macro Name
 
 	vsdmutex sync.Mutex // Serialize VSD operations, esp creates/updates
 
@@ -56,67 +58,37 @@ var (
 )
 
 func InitClient(conf *config.AgentConfig) error {
-	if err := readK8Sconfig(conf); err != nil {
+	// K8S Master configuration -- NetworkingConfig and EtcdClientInfo. Resolved at startup from the K8S master configuration file or ConfigMap
+	k8sMasterConfig = conf.MasterConfig
+
+	if err := initNaming(conf); err != nil {
 		return err
 	}
 
-	if err := makeX509conn(conf); err != nil {
-		return bambou.NewBambouError("Nuage TLS API connection failed", err.Error())
+	if err := makeConn(conf); err != nil {
+		return bambou.NewBambouError("Nuage API connection failed", err.Error())
 	}
 
 	if conf.VsdConfig.Enterprise == "" || conf.VsdConfig.Domain == "" {
 		return bambou.NewBambouError("Nuage VSD Enterprise and/or Domain for the Kubernetes cluster is absent from configuration file", "")
 	}
 
+	initOwnership(conf)
+
+	if err := initTenants(conf); err != nil {
+		return err
+	}
+
 	//// Find/Create VSD Enterprise and Domain
 
-	//// VSD Enterprise
-	if el, err := root.Enterprises(&bambou.FetchingInfo{Filter: "name == \"" + conf.VsdConfig.Enterprise + "\""}); err != nil {
-		return bambou.NewBambouError("Error fetching list of Enterprises from the VSD", err.Error())
-	} else {
-		switch len(el) {
-		case 1: // Given Enterprise already exists
-			Enterprise = el[0]
-			glog.Infof("Found existing Enterprise: %#s , re-using...", Enterprise.Name)
-		case 0:
-			glog.Infof("VSD Enterprise %#s not found, creating...", conf.VsdConfig.Enterprise)
-			Enterprise = new(vspk.Enterprise)
-			Enterprise.Name = conf.VsdConfig.Enterprise
-			Enterprise.Description = "Automatically created Enterprise for K8S Cluster"
-			if err := root.CreateEnterprise(Enterprise); err != nil {
-				return bambou.NewBambouError("Cannot create Enterprise: "+Enterprise.Name, err.Error())
-			}
-			glog.Infof("Created Enterprise: %s", Enterprise.Name)
-		}
+	var err error
+
+	if Enterprise, err = findEnterprise(conf.VsdConfig.Enterprise); err != nil {
+		return err
 	}
 
-	////  VSD Domain
-	if dl, err := root.Domains(&bambou.FetchingInfo{Filter: "name == \"" + conf.VsdConfig.Domain + "\""}); err != nil {
-		return bambou.NewBambouError("Error fetching list of Domains from the VSD", err.Error())
-	} else {
-		switch len(dl) {
-		case 1: // Given Domain already exists
-			Domain = dl[0]
-			glog.Infof("Found existing Domain: %#s , re-using...", Domain.Name)
-		case 0: // Domain does not exist, create it
-			glog.Infof("VSD Domain %#s not found, creating...", conf.VsdConfig.Domain)
-			// First, we need a Domain template.
-			domaintemplate := new(vspk.DomainTemplate)
-			domaintemplate.Name = "Template for Domain " + conf.VsdConfig.Domain
-			if err := Enterprise.CreateDomainTemplate(domaintemplate); err != nil {
-				return bambou.NewBambouError("Cannot create Domain Template: "+domaintemplate.Name, err.Error())
-			}
-			// Create Domain under this template
-			Domain = new(vspk.Domain)
-			Domain.Name = conf.VsdConfig.Domain
-			Domain.Description = "Automatically created Domain for K8S Cluster"
-			Domain.TemplateID = domaintemplate.ID
-			// Enterprise is valid by now
-			if err := Enterprise.CreateDomain(Domain); err != nil {
-				return bambou.NewBambouError("Cannot create Domain: "+Domain.Name, err.Error())
-			}
-			glog.Infof("Created Domain: %s", Domain.Name)
-		}
+	if Domain, err = findDomain(Enterprise, conf.VsdConfig.Domain, conf.VsdConfig.DomainTemplate); err != nil {
+		return err
 	}
 
 	// Initialize local caches
@@ -134,11 +106,65 @@ func InitClient(conf *config.AgentConfig) error {
 		return err
 	}
 
-	if err := initPolicies(); err != nil {
+	DefaultTenant = &Tenant{Enterprise: Enterprise, Domain: Domain}
+	tenants = map[string]*Tenant{DefaultTenant.String(): DefaultTenant}
+
+	if err := DefaultTenant.initPolicies(); err != nil {
 		return err
 	}
 
-	glog.Info("VSD client initialization completed")
+	log.Info("VSD client initialization completed")
+	return nil
+}
+
+// Read-only VSD connection, e.g. for inspecting the K8S <-> VSD mappings (see nuage-k8s-ctl). Unlike "InitClient", nothing is created on the VSD:
+// - The Enterprises and Domains (incl. the tenant ones) must already exist
+// - The Ingress / Egress Policies are looked up only (nil if absent)
+// - No K8S Master configuration / Pod CIDRs needed
+func Connect(conf *config.AgentConfig) error {
+	if err := initNaming(conf); err != nil {
+		return err
+	}
+
+	if err := makeConn(conf); err != nil {
+		return bambou.NewBambouError("Nuage API connection failed", err.Error())
+	}
+
+	if conf.VsdConfig.Enterprise == "" || conf.VsdConfig.Domain == "" {
+		return bambou.NewBambouError("Nuage VSD Enterprise and/or Domain for the Kubernetes cluster is absent from configuration file", "")
+	}
+
+	initOwnership(conf)
+
+	if err := initTenants(conf); err != nil {
+		return err
+	}
+
+	readOnly = true
+
+	var err error
+
+	if Enterprise, err = findEnterprise(conf.VsdConfig.Enterprise); err != nil {
+		return err
+	}
+
+	if Domain, err = findDomain(Enterprise, conf.VsdConfig.Domain, conf.VsdConfig.DomainTemplate); err != nil {
+		return err
+	}
+
+	Zones = make(map[string]*Zone)
+	NMGs = make(map[string]*NetworkMacroGroup)
+	NMs = make(map[string]*NetworkMacro)
+
+	FreeCIDRs = make(map[string]*net.IPNet)
+
+	DefaultTenant = &Tenant{Enterprise: Enterprise, Domain: Domain}
+	tenants = map[string]*Tenant{DefaultTenant.String(): DefaultTenant}
+
+	if err := DefaultTenant.lookupPolicies(); err != nil {
+		return bambou.NewBambouError("Error fetching the Policies of Domain: "+Domain.Name, err.Error())
+	}
+
 	return nil
 }
 
@@ -166,7 +192,7 @@ func GenerateMAC() string {
 	switch len(zl) {
 	case 1:
 		// Zone already exists
-		glog.Infof("Found existing Zone for K8S Namespace: %#s", k8s.PrivilegedNS)
+		log.Infof("Found existing Zone for K8S Namespace: %#s", k8s.PrivilegedNS)
 		K8Sns[k8s.PrivilegedNS] = zl[0]
 	}
 
@@ -177,18 +203,73 @@ func GenerateMAC() string {
 //////// utils
 ////////
 
-////  Load K8S Master configuration file -- NetworkingConfig and EtcdClientInfo
-func readK8Sconfig(conf *config.AgentConfig) error {
-	if data, err := ioutil.ReadFile(conf.MasterConfigFile); err != nil {
-		return bambou.NewBambouError("Cannot read K8S Master configuration file: "+conf.MasterConfigFile, err.Error())
-	} else {
-		if err := yaml.Unmarshal(data, &k8sMasterConfig); err != nil {
-			return bambou.NewBambouError("Cannot parse K8S Master configuration file: "+conf.MasterConfigFile, err.Error())
+// Close the VSD session, on shutdown
+// XXX - Does not wait for "vsdmutex": VSD calls still in flight past the shutdown deadline fail
+func Close() {
+	session := currentSession()
+	if session == nil {
+		return
+	}
+
+	session.Reset()
+	log.Info("VSD session closed")
+}
+
+// Re-establish the VSD session with a new configuration, e.g. rotated certificate / credentials or a new VSD URL (see main: Configuration reload)
+// If the new session cannot be established, the current one is kept
+// XXX - The VSD constructs (Enterprise, Domains, caches) are kept as is: The new session must be for the same VSD (e.g. another VSD cluster node)
+// XXX - All VSD operations wait for the new session: Tenant lookups / creations ("tenantsMutex"), policy changes incl. transactions ("policymutex") and the other VSD operations ("vsdmutex")
+func Reconnect(conf *config.AgentConfig) error {
+	tenantsMutex.Lock()
+	defer tenantsMutex.Unlock()
+
+	policymutex.Lock()
+	defer policymutex.Unlock()
+
+	vsdmutex.Lock()
+	defer vsdmutex.Unlock()
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	oldsession, oldroot, oldconf := mysession, root, loginConf
+
+	if err := makeConn(conf); err != nil {
+		mysession, root, loginConf = oldsession, oldroot, oldconf
+		// Make the current session the active one again
+		if serr := mysession.Start(); serr != nil {
+			log.Errorf("Cannot restore the current VSD session: %s", serr)
 		}
+		return bambou.NewBambouError("Nuage API connection failed", err.Error())
 	}
+
 	return nil
 }
 
+// The current VSD session / root object. Replaced by "relogin" and "Reconnect"
+func currentSession() *bambou.Session {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	return mysession
+}
+
+func currentRoot() *vspk.Me {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+
+	return root
+}
+
+// Connect to the VSD with user + password (or API key) authentication if a username is configured, X509 certificate based otherwise
+func makeConn(conf *config.AgentConfig) error {
+	if conf.VsdConfig.Username == "" && conf.VsdConfig.UsernameFile == "" {
+		return makeX509conn(conf)
+	}
+
+	return makePasswordConn(conf)
+}
+
 // Create a connection to the VSD using X.509 certificate-based authentication
 func makeX509conn(conf *config.AgentConfig) error {
 	if cert, err := tls.LoadX509KeyPair(conf.VsdConfig.CertFile, conf.VsdConfig.KeyFile); err != nil {
@@ -203,13 +284,72 @@ func makeX509conn(conf *config.AgentConfig) error {
 		return err
 	}
 
-	glog.Infof("vsd-client: Successfully established a connection to the VSD at URL is: %s\n", conf.VsdConfig.VsdUrl)
+	loginConf = nil
+
+	log.Infof("vsd-client: Successfully established a connection to the VSD at URL is: %s\n", conf.VsdConfig.VsdUrl)
 
-	// glog.Infof("vsd-client: Successfuly established bambou session: %#v\n", *mysession)
+	// log.Infof("vsd-client: Successfuly established bambou session: %#v\n", *mysession)
 
 	return nil
 }
 
+//// XXX - Notes on user + password authentication:
+//// - The password (or a static API key) is only used to obtain an API key from the VSD, used for the subsequent calls
+//// - When the API key is rejected (i.e. expired), "vsdCall" logs in again with a new session and retries the call once (see "relogin").
+////   The credentials files are re-read at that point, so that rotated K8S Secrets are picked up
+//// - VSD calls not made through "vsdCall" fail when the API key is rejected. The next "vsdCall" logs in again
+
+// Create a connection to the VSD using user + password (or API key) authentication
+func makePasswordConn(conf *config.AgentConfig) error {
+	username, password, err := vsdCredentials(conf)
+	if err != nil {
+		return err
+	}
+
+	organization := conf.VsdConfig.Organization
+	if organization == "" {
+		organization = "csp"
+	}
+
+	mysession, root = vspk.NewSession(username, password, organization, conf.VsdConfig.VsdUrl)
+
+	if err := mysession.Start(); err != nil {
+		return err
+	}
+
+	loginConf = conf
+
+	log.Infof("vsd-client: Successfully established a connection to the VSD at URL: %s as user: %s (Enterprise: %s)", conf.VsdConfig.VsdUrl, username, organization)
+	return nil
+}
+
+// The VSD username and password / API key, with the credentials files taking precedence over the config values
+func vsdCredentials(conf *config.AgentConfig) (string, string, error) {
+	username, password := conf.VsdConfig.Username, conf.VsdConfig.Password
+
+	if conf.VsdConfig.UsernameFile != "" {
+		data, err := ioutil.ReadFile(conf.VsdConfig.UsernameFile)
+		if err != nil {
+			return "", "", bambou.NewBambouError("Cannot read VSD username file: "+conf.VsdConfig.UsernameFile, err.Error())
+		}
+		username = strings.TrimSpace(string(data))
+	}
+
+	if conf.VsdConfig.PasswordFile != "" {
+		data, err := ioutil.ReadFile(conf.VsdConfig.PasswordFile)
+		if err != nil {
+			return "", "", bambou.NewBambouError("Cannot read VSD password file: "+conf.VsdConfig.PasswordFile, err.Error())
+		}
+		password = strings.TrimSpace(string(data))
+	}
+
+	if username == "" || password == "" {
+		return "", "", bambou.NewBambouError("Invalid VSD credentials", "Both a username and a password / API key are needed")
+	}
+
+	return username, password, nil
+}
+
 //// Initialize the "FreeCIDRs" map with up to MAX_SUBNETS number of prefixes, based on the values of "ClusterCIDR" and "SubnetLength" (sanity checked)
 func initCIDRs(conf *config.AgentConfig) error {
 	var err error
@@ -219,15 +359,15 @@ func initCIDRs(conf *config.AgentConfig) error {
 		return bambou.NewBambouError("Cannot parse K8S cluster network configuration: "+k8sMasterConfig.NetworkConfig.ClusterCIDR, err.Error())
 
 	}
-	glog.Infof("K8S master configuration: %#v", k8sMasterConfig)
-	glog.Infof("Pod cluster CIDR prefix: %s", ccidr.String())
+	log.Infof("K8S master configuration: %#v", k8sMasterConfig)
+	log.Infof("Pod cluster CIDR prefix: %s", ccidr.String())
 	cmask, _ := ccidr.Mask.Size() // Nr bits in the ClusterCIDR prefix mask
 
 	// The resulting subnet mask length for the Pod Subnets in the cluster
 	smask := uint(cmask + k8sMasterConfig.NetworkConfig.SubnetLength)
 
-	if smask >= 32 {
-		glog.Errorf("Invalid resulting subnet mask length for Pod networks: /%d", smask)
+	if smask > 30 { // See config.Validate
+		return bambou.NewBambouError(fmt.Sprintf("Invalid resulting subnet mask length for Pod networks: /%d", smask), "")
 	}
 
 	//////// Intialize "FreeCIDRs" map. Values:
@@ -239,13 +379,22 @@ func initCIDRs(conf *config.AgentConfig) error {
 	for i := 0; i < 1<<uint(k8sMasterConfig.NetworkConfig.SubnetLength) && i < MAX_SUBNETS; i++ {
 		newprefix := intToIP(ipToInt(ccidr.IP) + int32(i*(1<<(32-smask))))
 		FreeCIDRs[newprefix.String()] = &net.IPNet{newprefix, net.CIDRMask(int(smask), 32)}
-		// glog.Infof("=> Generated Subnet Prefix: %s", FreeCIDRs[newprefix.String()].String())
+		// log.Infof("=> Generated Subnet Prefix: %s", FreeCIDRs[newprefix.String()].String())
 
 	}
 
 	return nil
 }
 
+// Logger with the context of a VSD object. The ID is left out until the object is created
+func vsdLog(op, id, name string) *logrus.Entry {
+	return logging.With(log, logrus.Fields{
+		logging.FieldOp:      op,
+		logging.FieldVSDID:   id,
+		logging.FieldVSDName: name,
+	})
+}
+
 // Converts a 4 bytes IP into a 32 bit integer
 func ipToInt(ip net.IP) int32 {
 	return int32(binary.BigEndian.Uint32(ip.To4()))
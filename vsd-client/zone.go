@@ -5,8 +5,6 @@ import (
 
 	"k8s.io/kubernetes/pkg/registry/core/service/ipallocator"
 
-	"github.com/golang/glog"
-
 	"github.com/nuagenetworks/go-bambou/bambou"
 	"github.com/nuagenetworks/vspk-go/vspk"
 )
@@ -14,45 +12,70 @@ import (
 // XXX -- All those methods rely on a configured VSD connection:
 // - "root" object
 // - valid "Enterprise" and "Domain" set
+// - Zones are in the Domain of the tenant of their K8S namespace (see tenants.go)
 
-func (zone *Zone) FetchByName() error {
+func (zone *Zone) FetchByName(tenant *Tenant) error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
+	return zone.fetchByName(tenant)
+}
+
+// Caller must hold "vsdmutex"
+func (zone *Zone) fetchByName(tenant *Tenant) error {
+	key := cacheKey(tenant.Domain.ID, zone.Name)
+
 	// First, check the local cache of VSD constructs. If it's there already, return it from the cache
-	if Zones[zone.Name] != nil {
-		*zone = *Zones[zone.Name]
-		glog.Infof("VSD Zone with name: %s already cached", zone.Name)
+	if Zones[key] != nil {
+		*zone = *Zones[key]
+		log.Infof("VSD Zone with name: %s already cached", zone.Name)
 		return nil
 	}
 
 	// Second, check the VSD. If it's there, update the local cache and return it
-	zonelist, err := Domain.Zones(&bambou.FetchingInfo{Filter: "name == \"" + zone.Name + "\""})
+	var zonelist vspk.ZonesList
+	err := vsdCall("fetch Zone: "+zone.Name, func() (err *bambou.Error) {
+		zonelist, err = tenant.Domain.Zones(&bambou.FetchingInfo{Filter: "name == \"" + zone.Name + "\""})
+		return
+	})
 
 	if err != nil {
 		return bambou.NewBambouError("Cannot fetch Zone: "+zone.Name, err.Error())
 	}
 
 	if len(zonelist) == 1 {
-		glog.Infof("Zone with name: %s found on VSD, caching ...", zone.Name)
-		Zones[zone.Name] = (*Zone)(zonelist[0])
-		*zone = *Zones[zone.Name]
+		if err := claim("Zone", zonelist[0].Name, &zonelist[0].ExternalID, zonelist[0].Save); err != nil {
+			return err
+		}
+		log.Infof("Zone with name: %s found on VSD, caching ...", zone.Name)
+		Zones[key] = (*Zone)(zonelist[0])
+		*zone = *Zones[key]
 	}
 
 	return nil
 }
 
-func (zone *Zone) Create() error {
+func (zone *Zone) Create(tenant *Tenant) error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
-	if err := Domain.CreateZone((*vspk.Zone)(zone)); err != nil {
+	zone.ExternalID = ExternalID(zone.Name)
+	zone.Description = OwnerDescription()
+
+	if err := vsdCall("create Zone: "+zone.Name, func() *bambou.Error { return tenant.Domain.CreateZone((*vspk.Zone)(zone)) }); err != nil {
+		// Created concurrently (e.g. by another agent instance, or an earlier attempt whose response was lost): Adopt it
+		if Classify(err) == ErrConflict {
+			vsdLog("create", "", zone.Name).Info("Zone already exists, fetching it")
+			if ferr := zone.fetchByName(tenant); ferr == nil && zone.ID != "" {
+				return nil
+			}
+		}
 		return bambou.NewBambouError("Cannot create Zone: "+zone.Name, err.Error())
 	}
 	// Add it to the local cache as well.
 	// XXX - Up to the caller to ensure there are no map conflicts
-	Zones[zone.Name] = zone
-	glog.Infof("Successfully created Zone: %s", zone.Name)
+	Zones[cacheKey(tenant.Domain.ID, zone.Name)] = zone
+	vsdLog("create", zone.ID, zone.Name).Infof("Successfully created Zone in Domain: %s", tenant.Domain.Name)
 	return nil
 }
 
@@ -64,7 +87,11 @@ func (zone *Zone) Subnets() ([]Subnet, error) {
 
 	var resp []Subnet
 
-	sl, err := (*vspk.Zone)(zone).Subnets(&bambou.FetchingInfo{})
+	var sl vspk.SubnetsList
+	err := vsdCall("fetch Subnets of Zone: "+zone.Name, func() (err *bambou.Error) {
+		sl, err = (*vspk.Zone)(zone).Subnets(&bambou.FetchingInfo{})
+		return
+	})
 
 	if err != nil {
 		return nil, bambou.NewBambouError("Cannot fetch list of Subnets for Zone: "+zone.Name, err.Error())
@@ -76,13 +103,13 @@ func (zone *Zone) Subnets() ([]Subnet, error) {
 		scidr := net.IPNet{net.ParseIP(s.Address).To4(), net.IPMask(net.ParseIP(s.Netmask).To4())}
 		// Remove this prefix from the list of FreeCIDRs, if it was previously available
 		if _, wasfree := FreeCIDRs[s.Address]; wasfree {
-			glog.Infof("Subnet: %s. Subnet prefix: %s is part of ClusterCIDR address space. Reserving subnet address range...", s.Name, scidr.String())
+			log.Infof("Subnet: %s. Subnet prefix: %s is part of ClusterCIDR address space. Reserving subnet address range...", s.Name, scidr.String())
 			subnet.Customed = false
 			delete(FreeCIDRs, s.Address)
 		} else {
 			// Flag it as a custom network
 			subnet.Customed = true
-			glog.Infof("Custom subnet range: %s found. Reserving subnet address range...", scidr.String())
+			log.Infof("Custom subnet range: %s found. Reserving subnet address range...", scidr.String())
 		}
 		subnet.Subnet = s
 		// Create a new ipallocator for this subnet
@@ -95,11 +122,11 @@ func (zone *Zone) Subnets() ([]Subnet, error) {
 		// - No clean way of getting all the endpoints with an IP address in this subnet
 
 		cifaces, _ := s.ContainerInterfaces(&bambou.FetchingInfo{})
-		glog.Infof("Found: %d container interfaces in subnet range: %s . Reserving their respective IP addresses..", len(cifaces), scidr.String())
+		log.Infof("Found: %d container interfaces in subnet range: %s . Reserving their respective IP addresses..", len(cifaces), scidr.String())
 
 		for _, cif := range cifaces {
 			if err := subnet.Range.Allocate(net.ParseIP(cif.IPAddress).To4()); err != nil {
-				glog.Errorf("--> Cannot allocate IP address: %s from subnet range: %s . Error: %s", cif.IPAddress, scidr.String(), err)
+				log.Errorf("--> Cannot allocate IP address: %s from subnet range: %s . Error: %s", cif.IPAddress, scidr.String(), err)
 			}
 		}
 	}
@@ -112,11 +139,14 @@ func (zone *Zone) AddSubnet(s Subnet) error {
 	vsdmutex.Lock()
 	defer vsdmutex.Unlock()
 
-	if err := (*vspk.Zone)(zone).CreateSubnet(s.Subnet); err != nil {
+	s.Subnet.ExternalID = ExternalID(zone.Name + "/" + s.Subnet.Name)
+	s.Subnet.Description = OwnerDescription()
+
+	if err := vsdCall("create Subnet: "+s.Subnet.Name, func() *bambou.Error { return (*vspk.Zone)(zone).CreateSubnet(s.Subnet) }); err != nil {
 		return bambou.NewBambouError("Zone: "+zone.Name+" cannot add Subnet: Name: "+s.Subnet.Name+" , Address: "+s.Subnet.Address+" , Netmask: "+s.Subnet.Netmask, err.Error())
 	}
 
-	glog.Infof("Zone: %s successfully added Subnet: Name: %s , Address: %s , Netmask: %s", zone.Name, s.Subnet.Name, s.Subnet.Address, s.Subnet.Netmask)
+	log.Infof("Zone: %s successfully added Subnet: Name: %s , Address: %s , Netmask: %s", zone.Name, s.Subnet.Name, s.Subnet.Address, s.Subnet.Netmask)
 
 	return nil
 }